@@ -0,0 +1,53 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/contactless/wb-rules/wbrules"
+	"github.com/contactless/wbgong"
+)
+
+// checkMain implements 'wb-rules check' subcommand which loads
+// the scripts into a sandboxed engine and reports the problems
+// found in them. The exit code is non-zero if there are any
+func checkMain(args []string) int {
+	flags := flag.NewFlagSet("check", flag.ExitOnError)
+	debug := flags.Bool("debug", false, "Enable debugging")
+	wbgoso := flags.String("wbgo", WBGO_SO_PATH, "Location to wbgo.so file")
+	flags.Usage = func() {
+		fmt.Fprintf(os.Stderr, "usage: %s check [options] <script file/dir>...\n", os.Args[0])
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+
+	if flags.NArg() < 1 {
+		flags.Usage()
+		return 2
+	}
+	if *debug {
+		wbgong.SetDebuggingEnabled(true)
+	}
+	if err := wbgong.Init(*wbgoso); err != nil {
+		fmt.Fprintf(os.Stderr, "ERROR in init wbgo.so: '%s'\n", err)
+		return 1
+	}
+
+	engineOptions := wbrules.NewESEngineOptions()
+	engineOptions.SetModulesDirs(strings.Split(os.Getenv(WBRULES_MODULES_ENV), ":"))
+	problems, err := wbrules.CheckScripts(flags.Args(), engineOptions)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "check failed: %s\n", err)
+		return 1
+	}
+
+	for _, problem := range problems {
+		fmt.Println(problem)
+	}
+	if len(problems) > 0 {
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/contactless/wbgong"
+)
+
+// graphMain implements 'wb-rules graph' subcommand which
+// dumps rule dependency graph of the running instance
+func graphMain(args []string) int {
+	flags := flag.NewFlagSet("graph", flag.ExitOnError)
+	brokerAddress := flags.String("broker", "tcp://localhost:1883", "MQTT broker url")
+	format := flags.String("format", "dot", "Output format: dot or json")
+	timeout := flags.Duration("timeout", RPC_DEFAULT_TIMEOUT, "RPC timeout")
+	wbgoso := flags.String("wbgo", WBGO_SO_PATH, "Location to wbgo.so file")
+	flags.Parse(args)
+
+	if err := wbgong.Init(*wbgoso); err != nil {
+		fmt.Fprintf(os.Stderr, "ERROR in init wbgo.so: '%s'\n", err)
+		return 1
+	}
+
+	switch *format {
+	case "dot":
+		var dot string
+		if err := callRpc(*brokerAddress, "Rules", "GraphDot", struct{}{}, &dot, *timeout); err != nil {
+			fmt.Fprintf(os.Stderr, "failed to get rule graph: %s\n", err)
+			return 1
+		}
+		fmt.Print(dot)
+	case "json":
+		var graph json.RawMessage
+		if err := callRpc(*brokerAddress, "Rules", "Graph", struct{}{}, &graph, *timeout); err != nil {
+			fmt.Fprintf(os.Stderr, "failed to get rule graph: %s\n", err)
+			return 1
+		}
+		os.Stdout.Write(graph)
+		fmt.Println()
+	default:
+		fmt.Fprintf(os.Stderr, "unknown graph format: %s\n", *format)
+		return 2
+	}
+	return 0
+}
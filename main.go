@@ -8,6 +8,7 @@ import (
 	"os/signal"
 	"strings"
 	"syscall"
+	"time"
 
 	"github.com/contactless/wb-rules/wbrules"
 	"github.com/contactless/wbgong"
@@ -26,13 +27,26 @@ const (
 	VIRTUAL_DEVICES_DB_FILE = "/var/lib/wirenboard/wbrules-vdev.db"
 
 	WBRULES_MODULES_ENV = "WB_RULES_MODULES"
+
+	WBGO_SO_PATH = "/usr/share/wb-rules/wbgo.so"
 )
 
 func main() {
 
-	if os.Args[1] == "version" {
-		fmt.Println(version)
-		os.Exit(0)
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "version":
+			fmt.Println(version)
+			os.Exit(0)
+		case "graph":
+			os.Exit(graphMain(os.Args[2:]))
+		case "replay":
+			os.Exit(replayMain(os.Args[2:]))
+		case "test":
+			os.Exit(testMain(os.Args[2:]))
+		case "check":
+			os.Exit(checkMain(os.Args[2:]))
+		}
 	}
 
 	var err error
@@ -59,13 +73,31 @@ func main() {
 	persistentDbFile := flag.String("pdb", PERSISTENT_DB_FILE, "Persistent storage DB file")
 	vdevDbFile := flag.String("vdb", VIRTUAL_DEVICES_DB_FILE, "Virtual devices values DB file")
 
-	wbgoso := flag.String("wbgo", "/usr/share/wb-rules/wbgo.so", "Location to wbgo.so file")
+	eventBufferCap := flag.Int("event-buffer-cap", wbrules.EVENT_BUFFER_UNLIMITED, "Maximum number of pending control change events (0 for no limit)")
+	eventBufferPolicy := flag.String("event-buffer-policy", wbrules.EVENT_BUFFER_KEEP_ALL.String(), "Pending events policy: keep-all or coalesce")
+	maxCascadeDepth := flag.Int("max-cascade-depth", wbrules.CASCADE_UNLIMITED, "Maximum length of a chain of rules triggering each other (0 for no limit)")
+	disableCascading := flag.Bool("disable-cascading-rules", false, "Disable the rules involved in a cascade exceeding maximum depth")
+	maxHTTPRequests := flag.Int("http-max-requests", wbrules.HTTP_DEFAULT_MAX_REQUESTS, "Maximum number of http.request() calls running at the same time")
+	dryRun := flag.Bool("dry-run", false, "Log control writes, MQTT publishes and external commands made by the rules instead of doing them")
+	dryRunScripts := flag.String("dry-run-scripts", "", "Comma-separated list of scripts to run in dry-run mode")
+	latitude := flag.Float64("latitude", 0, "Latitude for sunrise/sunset schedules")
+	longitude := flag.Float64("longitude", 0, "Longitude for sunrise/sunset schedules")
+	timezone := flag.String("timezone", "", "Timezone for sunrise/sunset schedules (system timezone by default)")
+	journalFile := flag.String("journal", "", "Record control changes, timer fires and tracked MQTT messages to the file for 'wb-rules replay'")
+	shutdownTimeout := flag.Duration("shutdown-timeout", wbrules.DEFAULT_SHUTDOWN_PHASE_TIMEOUT, "Time limit for each shutdown phase: pending events, onUnload hooks, child processes")
+
+	wbgoso := flag.String("wbgo", WBGO_SO_PATH, "Location to wbgo.so file")
 
 	flag.Parse()
 
 	if flag.NArg() < 1 {
 		wbgong.Error.Fatal("must specify rule file/directory name(s)")
 	}
+	bufferPolicy, err := wbrules.ParseEventBufferPolicy(*eventBufferPolicy)
+	if err != nil {
+		wbgong.Error.Fatal(err)
+	}
+
 	if *useSyslog {
 		wbgong.UseSyslog()
 	}
@@ -133,9 +165,41 @@ func main() {
 
 	engineOptions := wbrules.NewESEngineOptions()
 	engineOptions.SetPersistentDBFile(*persistentDbFile)
-	engineOptions.SetModulesDirs(strings.Split(os.Getenv(WBRULES_MODULES_ENV), ":"))
+	modulesDirs := strings.Split(os.Getenv(WBRULES_MODULES_ENV), ":")
+	engineOptions.SetModulesDirs(modulesDirs)
 	engineOptions.SetCleanupOnStop(*cleanup)
 	engineOptions.SetStatsdClient(statsdClient)
+	engineOptions.SetMaxHTTPRequests(*maxHTTPRequests)
+	engineOptions.SetEventBufferCapacity(*eventBufferCap)
+	engineOptions.SetEventBufferPolicy(bufferPolicy)
+	engineOptions.SetMaxCascadeDepth(*maxCascadeDepth)
+	engineOptions.SetDisableCascadingRules(*disableCascading)
+	engineOptions.SetDryRun(*dryRun)
+	if *dryRunScripts != "" {
+		engineOptions.SetDryRunScripts(strings.Split(*dryRunScripts, ","))
+	}
+
+	astroLocation := wbrules.AstroLocation{Latitude: *latitude, Longitude: *longitude}
+	flag.Visit(func(f *flag.Flag) {
+		if f.Name == "latitude" || f.Name == "longitude" {
+			astroLocation.Configured = true
+		}
+	})
+	if *timezone != "" {
+		if astroLocation.Timezone, err = time.LoadLocation(*timezone); err != nil {
+			wbgong.Error.Fatalf("invalid timezone: %s", err)
+		}
+	}
+	engineOptions.SetAstroLocation(astroLocation)
+
+	if *journalFile != "" {
+		journal, err := wbrules.OpenJournal(*journalFile)
+		if err != nil {
+			wbgong.Error.Fatalf("can't open event journal: %s", err)
+		}
+		defer journal.Close()
+		engineOptions.SetJournal(journal)
+	}
 
 	if *noQueues {
 		engineOptions.SetTesting(true)
@@ -165,16 +229,41 @@ func main() {
 	}
 	wbgong.Info.Println("all rule files are loaded")
 
+	// reload the scripts when the modules they require change
+	moduleWatcher := wbgong.NewDirWatcher("\\.(js|json)$", wbrules.NewModuleWatcherClient(engine))
+	for _, dir := range modulesDirs {
+		if dir == "" {
+			continue
+		}
+		if err := moduleWatcher.Load(dir); err != nil {
+			wbgong.Warn.Printf("can't watch module directory %s: %s", dir, err)
+		}
+	}
+
 	if *editDir != "" {
 		rpc := wbgong.NewMQTTRPCServer("wbrules", engineMqttClient)
-		rpc.Register(wbrules.NewEditor(engine))
+		editor := wbrules.NewEditor(engine)
+		checkOptions := wbrules.NewESEngineOptions()
+		checkOptions.SetModulesDirs(strings.Split(os.Getenv(WBRULES_MODULES_ENV), ":"))
+		editor.SetCheckOptions(checkOptions)
+		rpc.Register(editor)
+		rpc.Register(wbrules.NewRules(engine))
 		rpc.Start()
 	}
 
 	// wait for quit signal
-	<-exitCh
-
-	engine.Stop()
+	sig := <-exitCh
+	wbgong.Info.Printf("got %s, shutting down", sig)
+	go func() {
+		sig := <-exitCh
+		wbgong.Warn.Printf("got %s during shutdown, exiting immediately", sig)
+		os.Exit(1)
+	}()
+
+	engine.Shutdown(wbrules.NewShutdownOptions().
+		SetDrainTimeout(*shutdownTimeout).
+		SetUnloadTimeout(*shutdownTimeout).
+		SetProcessTimeout(*shutdownTimeout))
 	driver.StopLoop()
 	driver.Close()
 }
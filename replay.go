@@ -0,0 +1,78 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/contactless/wb-rules/wbrules"
+	"github.com/contactless/wbgong"
+)
+
+// replayMain implements 'wb-rules replay' subcommand which runs
+// the scripts against the events recorded with -journal option
+func replayMain(args []string) int {
+	flags := flag.NewFlagSet("replay", flag.ExitOnError)
+	tail := flags.Duration("tail", 0, "Keep the virtual clock running for the specified time after the last event")
+	debug := flags.Bool("debug", false, "Enable debugging")
+	wbgoso := flags.String("wbgo", WBGO_SO_PATH, "Location to wbgo.so file")
+	flags.Usage = func() {
+		fmt.Fprintf(os.Stderr, "usage: %s replay [options] <journal> <script file/dir>...\n", os.Args[0])
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+
+	if flags.NArg() < 2 {
+		flags.Usage()
+		return 2
+	}
+	if *debug {
+		wbgong.SetDebuggingEnabled(true)
+	}
+	if err := wbgong.Init(*wbgoso); err != nil {
+		fmt.Fprintf(os.Stderr, "ERROR in init wbgo.so: '%s'\n", err)
+		return 1
+	}
+
+	f, err := os.Open(flags.Arg(0))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "can't open journal: %s\n", err)
+		return 1
+	}
+	entries, err := wbrules.ReadJournal(f)
+	f.Close()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "can't read journal: %s\n", err)
+		return 1
+	}
+
+	start := time.Now()
+	if len(entries) > 0 {
+		start = entries[0].Time
+	}
+
+	engineOptions := wbrules.NewESEngineOptions()
+	engineOptions.SetModulesDirs(strings.Split(os.Getenv(WBRULES_MODULES_ENV), ":"))
+	replayer, err := wbrules.NewReplayer(start, os.Stdout, engineOptions)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "can't start replay: %s\n", err)
+		return 1
+	}
+	defer replayer.Close()
+
+	watcher := wbgong.NewDirWatcher("\\.js$", replayer.Engine())
+	for _, path := range flags.Args()[1:] {
+		if err := watcher.Load(path); err != nil {
+			fmt.Fprintf(os.Stderr, "error loading script file/dir %s: %s\n", path, err)
+			return 1
+		}
+	}
+
+	if err := replayer.Run(entries, *tail); err != nil {
+		fmt.Fprintf(os.Stderr, "replay failed: %s\n", err)
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/contactless/wbgong"
+)
+
+const (
+	RPC_DRIVER_ID       = "wbrules"
+	RPC_DEFAULT_TIMEOUT = 5 * time.Second
+)
+
+type rpcRequest struct {
+	Id     int         `json:"id"`
+	Params interface{} `json:"params"`
+}
+
+type rpcResponse struct {
+	Id     int             `json:"id"`
+	Result json.RawMessage `json:"result"`
+	Error  json.RawMessage `json:"error"`
+}
+
+// callRpc performs MQTT RPC request to the running wb-rules
+// instance and unmarshals the result into the specified value
+func callRpc(brokerAddress, service, method string, params, result interface{}, timeout time.Duration) error {
+	clientId := fmt.Sprintf("wb-rules-cli-%d", os.Getpid())
+	client := wbgong.NewPahoMQTTClient(brokerAddress, clientId)
+	client.Start()
+	defer client.Stop()
+
+	topic := fmt.Sprintf("/rpc/v1/%s/%s/%s/%s", RPC_DRIVER_ID, service, method, clientId)
+	replyCh := make(chan wbgong.MQTTMessage, 1)
+	client.Subscribe(func(msg wbgong.MQTTMessage) {
+		select {
+		case replyCh <- msg:
+		default:
+		}
+	}, topic+"/reply")
+
+	payload, err := json.Marshal(rpcRequest{1, params})
+	if err != nil {
+		return err
+	}
+	client.Publish(wbgong.MQTTMessage{
+		Topic:   topic,
+		Payload: string(payload),
+		QoS:     1,
+	})
+
+	select {
+	case msg := <-replyCh:
+		var resp rpcResponse
+		if err := json.Unmarshal([]byte(msg.Payload), &resp); err != nil {
+			return fmt.Errorf("bad RPC response: %s", err)
+		}
+		if len(resp.Error) != 0 && string(resp.Error) != "null" {
+			return fmt.Errorf("RPC error: %s", resp.Error)
+		}
+		return json.Unmarshal(resp.Result, result)
+	case <-time.After(timeout):
+		return errors.New("RPC timeout, is wb-rules running with -editdir?")
+	}
+}
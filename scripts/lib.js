@@ -25,13 +25,30 @@ function __esInitEnv(glob) {
         });
       }).join("{");
     };
+
+    // "./" and "../" ids are resolved relative to the script,
+    // see SCRIPT_RELATIVE_MODULE_PREFIX
+    var require = glob.require;
+    if (require) {
+      glob.require = function (id) {
+        if (/^\.\.?\//.test(id) && glob.__filename)
+          id = "~" + glob.__filename.replace(/\/[^\/]*$/, "/") + id;
+        return require(id);
+      };
+    }
 }
 
 __esInitEnv(global);
 
 var _WbRules = {
   requireCompleteCells: 0,
-  timers: {},
+  timers: {
+    list: function () {
+      return scheduled().timers.filter(function (t) {
+        return !!t.name;
+      });
+    }
+  },
   aliases: {},
 
   CronEntry: function (spec) {
@@ -198,10 +215,9 @@ var _WbRules = {
     var d = Object.create(def);
     function transformWhenChangedItem (item) {
       if (typeof item == "string") {
-        if (item.indexOf("/") >= 0)
+        // unknown aliases are reported by the engine
+        if (item.indexOf("/") >= 0 || !_WbRules.aliases.hasOwnProperty(item))
           return item;
-        if (!_WbRules.aliases.hasOwnProperty(item))
-          throw new Error("invalid cell alias in whenChanged: " + item);
         return _WbRules.aliases[item];
       }
       if (typeof item != "function")
@@ -235,8 +251,8 @@ var _WbRules = {
         d[k] = function (options) {
           if (options) {
             if (options.hasOwnProperty("device"))
-              // TBD: pass options.oldValue right after newValue here -- for consistency
-              orig.call(d, options.newValue, options.device, options.cell);
+              orig.call(d, options.newValue, options.device, options.cell,
+                        options.oldValue, options.meta);
             else
               orig.call(d, options.newValue);
           } else
@@ -252,8 +268,11 @@ var _WbRules = {
     }
   },
 
-  startTimer: function startTimer(name, ms, periodic) {
-    _wbStartTimer(name, ms, !!periodic);
+  startTimer: function startTimer(name, ms, periodic, options) {
+    if (!periodic && options && options.persistent)
+      _wbPersistentTimer(name, ms);
+    else
+      _wbStartTimer(name, ms, !!periodic);
   }
 };
 
@@ -267,22 +286,41 @@ var timers = _WbRules.autoload(_WbRules.timers, function (name) {
     get firing() {
       return _wbCheckCurrentTimer(name);
     },
+    get late() {
+      return _wbCheckLateTimer(name);
+    },
+    get remaining() {
+      return _wbTimerRemaining(name);
+    },
     stop: function () {
       _wbStopTimer(name);
+    },
+    pause: function () {
+      return _wbPauseTimer(name);
+    },
+    resume: function () {
+      return _wbResumeTimer(name);
+    },
+    restart: function (ms) {
+      return _wbRestartTimer(name, ms || 0);
     }
   };
 });
 
 var defineRule = _WbRules.defineRule;
 
-function startTimer (name, ms) {
-  _WbRules.startTimer(name, ms, false);
+function startTimer (name, ms, options) {
+  _WbRules.startTimer(name, ms, false, options);
 }
 
 function startTicker (name, ms) {
   _WbRules.startTimer(name, ms, true);
 }
 
+function setPersistentTimeout (name, ms) {
+  _WbRules.startTimer(name, ms, false, { persistent: true });
+}
+
 function setTimeout(callback, ms) {
   return _wbStartTimer(callback, ms, false);
 }
@@ -339,6 +377,67 @@ function runShellCommand(cmd, options) {
   spawn("/bin/sh", ["-c", cmd], options);
 }
 
+function rpcCall(driver, service, method, params, options, callback) {
+  if (typeof options == "function") {
+    callback = options;
+    options = null;
+  }
+  options = options || {};
+
+  var name = "{}/{}/{}".format(driver, service, method);
+  _wbRpcCall(driver, service, method,
+    JSON.stringify(params === undefined ? null : params),
+    options.timeout || 0,
+    callback ? function (args) {
+      try {
+        if (args.error) {
+          var err = new Error(args.error.message);
+          err.code = args.error.code;
+          err.timeout = args.error.timeout;
+          if (args.error.data !== undefined)
+            err.data = JSON.parse(args.error.data);
+          callback(err, null);
+        } else
+          callback(null, JSON.parse(args.result));
+      } catch (e) {
+        log("error running rpcCall callback for " + name + ": " + (e.stack || e));
+      }
+    } : null);
+}
+
+var http = {
+  request: function request(options, callback) {
+    if (typeof options == "string")
+      options = { url: options };
+
+    var headers = {};
+    for (var name in options.headers || {})
+      headers[name] = "" + options.headers[name];
+
+    var body = options.body;
+    if (body != null && typeof body != "string")
+      body = JSON.stringify(body);
+
+    _wbHttpRequest(JSON.stringify({
+      url: options.url,
+      method: options.method || "GET",
+      headers: headers,
+      body: body || "",
+      timeout: options.timeout || 0,
+      tls: options.tls || null
+    }), callback ? function (args) {
+      try {
+        if (args.error)
+          callback(new Error(args.error), null);
+        else
+          callback(null, args.response);
+      } catch (e) {
+        log("error running http.request callback for " + options.url + ": " + (e.stack || e));
+      }
+    } : null);
+  }
+};
+
 var defineAlias = _WbRules.defineAlias;
 
 function cron(spec) {
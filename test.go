@@ -0,0 +1,85 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/contactless/wb-rules/wbrules"
+	"github.com/contactless/wbgong"
+)
+
+// testMain implements 'wb-rules test' subcommand which runs
+// the tests written in JS against the scripts
+func testMain(args []string) int {
+	flags := flag.NewFlagSet("test", flag.ExitOnError)
+	format := flags.String("format", wbrules.TEST_REPORT_TAP, "Report format: tap or junit")
+	output := flags.String("o", "", "Write the report to the file instead of stdout")
+	debug := flags.Bool("debug", false, "Enable debugging")
+	wbgoso := flags.String("wbgo", WBGO_SO_PATH, "Location to wbgo.so file")
+	flags.Usage = func() {
+		fmt.Fprintf(os.Stderr, "usage: %s test [options] <spec.js> [script file/dir]...\n", os.Args[0])
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+
+	if flags.NArg() < 1 {
+		flags.Usage()
+		return 2
+	}
+	if *format != wbrules.TEST_REPORT_TAP && *format != wbrules.TEST_REPORT_JUNIT {
+		fmt.Fprintf(os.Stderr, "unknown report format: %s\n", *format)
+		return 2
+	}
+	if *debug {
+		wbgong.SetDebuggingEnabled(true)
+	}
+	if err := wbgong.Init(*wbgoso); err != nil {
+		fmt.Fprintf(os.Stderr, "ERROR in init wbgo.so: '%s'\n", err)
+		return 1
+	}
+
+	var out io.Writer = os.Stdout
+	if *output != "" {
+		f, err := os.Create(*output)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "can't create report file: %s\n", err)
+			return 1
+		}
+		defer f.Close()
+		out = f
+	}
+
+	specPath := flags.Arg(0)
+	engineOptions := wbrules.NewESEngineOptions()
+	engineOptions.SetModulesDirs(strings.Split(os.Getenv(WBRULES_MODULES_ENV), ":"))
+	runner := wbrules.NewTestRunner(specPath, flags.Args()[1:], engineOptions)
+	results, err := runner.Run()
+	if err != nil {
+		if *format == wbrules.TEST_REPORT_TAP {
+			fmt.Fprintf(out, "Bail out! %s\n", err)
+		}
+		fmt.Fprintf(os.Stderr, "test run failed: %s\n", err)
+		return 1
+	}
+
+	if *format == wbrules.TEST_REPORT_JUNIT {
+		err = wbrules.WriteJUnit(out, filepath.Base(specPath), results)
+	} else {
+		err = wbrules.WriteTAP(out, results)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "can't write the report: %s\n", err)
+		return 1
+	}
+
+	for _, result := range results {
+		if !result.Passed() {
+			return 1
+		}
+	}
+	return 0
+}
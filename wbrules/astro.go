@@ -0,0 +1,454 @@
+package wbrules
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/contactless/wbgong"
+	"github.com/stretchr/objx"
+	cron "gopkg.in/robfig/cron.v1"
+)
+
+const (
+	ASTRO_SPEC_SUNRISE = "@sunrise"
+	ASTRO_SPEC_SUNSET  = "@sunset"
+
+	// the controls on the rule engine settings device
+	// holding the location used for astronomical schedules
+	RULE_LATITUDE_CELL_NAME  = "Latitude"
+	RULE_LONGITUDE_CELL_NAME = "Longitude"
+	RULE_TIMEZONE_CELL_NAME  = "Timezone"
+
+	// ASTRO_LOCATION_DB_BUCKET is the persistent DB bucket
+	// holding the location set via the settings device
+	ASTRO_LOCATION_DB_BUCKET = "_wbrules_astro_location"
+
+	// sunrise and sunset are the moments when the upper edge
+	// of the Sun touches the horizon, taking refraction into account
+	SUN_ZENITH = 90.833
+
+	// in polar regions the Sun may not rise or set for months
+	ASTRO_MAX_SEARCH_DAYS = 366
+)
+
+// AstroLocation is the place for which sunrise
+// and sunset times are calculated
+type AstroLocation struct {
+	Latitude  float64
+	Longitude float64
+	Timezone  *time.Location
+	// Configured is false till the coordinates are set,
+	// astronomical schedules never fire then
+	Configured bool
+}
+
+func (loc AstroLocation) timezone() *time.Location {
+	if loc.Timezone == nil {
+		return time.Local
+	}
+	return loc.Timezone
+}
+
+// astroSpec is a parsed astronomical cron spec:
+// '@sunrise' or '@sunset' with optional offset
+// like '@sunset+15m' followed by optional
+// 'notbefore HH:MM' and 'notafter HH:MM' limits
+type astroSpec struct {
+	sunrise   bool
+	offset    time.Duration
+	notBefore time.Duration // since midnight, -1 if not set
+	notAfter  time.Duration // since midnight, -1 if not set
+}
+
+func isAstroSpec(spec string) bool {
+	spec = strings.TrimSpace(spec)
+	return strings.HasPrefix(spec, ASTRO_SPEC_SUNRISE) || strings.HasPrefix(spec, ASTRO_SPEC_SUNSET)
+}
+
+func parseAstroSpec(spec string) (*astroSpec, error) {
+	fields := strings.Fields(spec)
+	if len(fields) == 0 {
+		return nil, fmt.Errorf("empty astronomical spec")
+	}
+
+	s := &astroSpec{notBefore: -1, notAfter: -1}
+	event := fields[0]
+	switch {
+	case strings.HasPrefix(event, ASTRO_SPEC_SUNRISE):
+		s.sunrise = true
+		event = event[len(ASTRO_SPEC_SUNRISE):]
+	case strings.HasPrefix(event, ASTRO_SPEC_SUNSET):
+		event = event[len(ASTRO_SPEC_SUNSET):]
+	default:
+		return nil, fmt.Errorf("astronomical spec must start with %s or %s: %s",
+			ASTRO_SPEC_SUNRISE, ASTRO_SPEC_SUNSET, spec)
+	}
+	if event != "" {
+		if event[0] != '+' && event[0] != '-' {
+			return nil, fmt.Errorf("invalid astronomical spec: %s", spec)
+		}
+		offset, err := time.ParseDuration(event)
+		if err != nil {
+			return nil, fmt.Errorf("invalid offset in astronomical spec %s: %s", spec, err)
+		}
+		s.offset = offset
+	}
+
+	for rest := fields[1:]; len(rest) > 0; rest = rest[2:] {
+		if len(rest) < 2 {
+			return nil, fmt.Errorf("missing time after '%s' in astronomical spec: %s", rest[0], spec)
+		}
+		t, err := time.Parse("15:04", rest[1])
+		if err != nil {
+			return nil, fmt.Errorf("invalid time '%s' in astronomical spec: %s", rest[1], spec)
+		}
+		sinceMidnight := time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute
+		switch rest[0] {
+		case "notbefore":
+			s.notBefore = sinceMidnight
+		case "notafter":
+			s.notAfter = sinceMidnight
+		default:
+			return nil, fmt.Errorf("unknown modifier '%s' in astronomical spec: %s", rest[0], spec)
+		}
+	}
+	if s.notBefore >= 0 && s.notAfter >= 0 && s.notBefore > s.notAfter {
+		return nil, fmt.Errorf("'notbefore' is later than 'notafter' in astronomical spec: %s", spec)
+	}
+	return s, nil
+}
+
+// at returns the time of the event on the date
+// of the specified time in the location timezone
+func (s *astroSpec) at(date time.Time, loc AstroLocation) (time.Time, bool) {
+	t, ok := sunEventTime(date, loc.Latitude, loc.Longitude, s.sunrise)
+	if !ok {
+		return time.Time{}, false
+	}
+	t = t.Add(s.offset)
+
+	year, month, day := date.Date()
+	midnight := time.Date(year, month, day, 0, 0, 0, 0, date.Location())
+	if s.notBefore >= 0 && t.Before(midnight.Add(s.notBefore)) {
+		t = midnight.Add(s.notBefore)
+	}
+	if s.notAfter >= 0 && t.After(midnight.Add(s.notAfter)) {
+		t = midnight.Add(s.notAfter)
+	}
+	return t, true
+}
+
+func dateKey(t time.Time) int {
+	year, month, day := t.Date()
+	return year*10000 + int(month)*100 + day
+}
+
+func degToRad(d float64) float64 {
+	return d * math.Pi / 180
+}
+
+func radToDeg(r float64) float64 {
+	return r * 180 / math.Pi
+}
+
+// normalizeAngle brings v to [0, max) range
+func normalizeAngle(v, max float64) float64 {
+	v = math.Mod(v, max)
+	if v < 0 {
+		v += max
+	}
+	return v
+}
+
+// sunEventUTC calculates the time of sunrise or sunset
+// in hours since UTC midnight for the specified day of year.
+// See 'Almanac for Computers', 1990 by Nautical Almanac Office
+func sunEventUTC(yearDay int, lat, lon float64, sunrise bool) (float64, bool) {
+	lonHour := lon / 15
+	t := float64(yearDay) + (18-lonHour)/24
+	if sunrise {
+		t = float64(yearDay) + (6-lonHour)/24
+	}
+
+	// the Sun's mean anomaly and true longitude
+	m := 0.9856*t - 3.289
+	l := normalizeAngle(m+1.916*math.Sin(degToRad(m))+0.020*math.Sin(degToRad(2*m))+282.634, 360)
+
+	// the Sun's right ascension, in the same quadrant as l
+	ra := normalizeAngle(radToDeg(math.Atan(0.91764*math.Tan(degToRad(l)))), 360)
+	ra += math.Floor(l/90)*90 - math.Floor(ra/90)*90
+	ra /= 15
+
+	// the Sun's declination and local hour angle
+	sinDec := 0.39782 * math.Sin(degToRad(l))
+	cosDec := math.Cos(math.Asin(sinDec))
+	cosH := (math.Cos(degToRad(SUN_ZENITH)) - sinDec*math.Sin(degToRad(lat))) /
+		(cosDec * math.Cos(degToRad(lat)))
+	if cosH > 1 || cosH < -1 {
+		// polar night or polar day
+		return 0, false
+	}
+	h := radToDeg(math.Acos(cosH))
+	if sunrise {
+		h = 360 - h
+	}
+	h /= 15
+
+	localMeanTime := h + ra - 0.06571*t - 6.622
+	return normalizeAngle(localMeanTime-lonHour, 24), true
+}
+
+// sunEventTime returns the time of sunrise or sunset on
+// the date of the specified time in its timezone.
+// false is returned if there's no such event on that day
+func sunEventTime(date time.Time, lat, lon float64, sunrise bool) (time.Time, bool) {
+	year, month, day := date.Date()
+	noon := time.Date(year, month, day, 12, 0, 0, 0, date.Location())
+	hours, ok := sunEventUTC(noon.YearDay(), lat, lon, sunrise)
+	if !ok {
+		return time.Time{}, false
+	}
+
+	year, month, day = noon.UTC().Date()
+	t := time.Date(year, month, day, 0, 0, 0, 0, time.UTC).
+		Add(time.Duration(hours * float64(time.Hour))).
+		In(date.Location())
+
+	// the UTC date may differ from the local one
+	switch want := dateKey(noon); {
+	case dateKey(t) < want:
+		t = t.Add(24 * time.Hour)
+	case dateKey(t) > want:
+		t = t.Add(-24 * time.Hour)
+	}
+	return t, true
+}
+
+// astroSchedule implements cron.Schedule for astronomical specs.
+// The location is requested each time so the changes of it
+// are applied when the entries are rescheduled
+type astroSchedule struct {
+	spec     *astroSpec
+	location func() AstroLocation
+}
+
+func (s *astroSchedule) Next(t time.Time) time.Time {
+	loc := s.location()
+	if !loc.Configured {
+		// never fires
+		return time.Time{}
+	}
+
+	date := t.In(loc.timezone())
+	for i := 0; i <= ASTRO_MAX_SEARCH_DAYS; i++ {
+		if next, ok := s.spec.at(date.AddDate(0, 0, i), loc); ok && next.After(t) {
+			return next
+		}
+	}
+	return time.Time{}
+}
+
+// scheduleCron makes robfig cron accept all the specs
+// supported by the engine
+type scheduleCron struct {
+	*cron.Cron
+	parse func(spec string) (cron.Schedule, error)
+}
+
+func (c *scheduleCron) AddFunc(spec string, cmd func()) error {
+	schedule, err := c.parse(spec)
+	if err != nil {
+		return err
+	}
+	c.Schedule(schedule, cron.FuncJob(cmd))
+	return nil
+}
+
+// ParseCronSpec parses either robfig cron spec or astronomical
+// spec like '@sunset+15m' or '@sunrise notbefore 07:00'
+func (engine *RuleEngine) ParseCronSpec(spec string) (cron.Schedule, error) {
+	if !isAstroSpec(spec) {
+		return cron.Parse(spec)
+	}
+	s, err := parseAstroSpec(spec)
+	if err != nil {
+		return nil, err
+	}
+	engine.setupAstroControls()
+	return &astroSchedule{s, engine.AstroLocation}, nil
+}
+
+// AstroLocation returns the location used to calculate
+// sunrise and sunset times
+func (engine *RuleEngine) AstroLocation() AstroLocation {
+	engine.astroMutex.Lock()
+	defer engine.astroMutex.Unlock()
+	return engine.astroLocation
+}
+
+// SetAstroLocation changes the location used to calculate
+// sunrise and sunset times and reschedules cron entries
+func (engine *RuleEngine) SetAstroLocation(loc AstroLocation) {
+	engine.CallSync(func() {
+		engine.applyAstroLocation(loc)
+	})
+}
+
+// applyAstroLocation must be called from the sync loop
+func (engine *RuleEngine) applyAstroLocation(loc AstroLocation) {
+	engine.astroMutex.Lock()
+	engine.astroLocation = loc
+	engine.astroMutex.Unlock()
+
+	if engine.cron != nil {
+		engine.setupCron()
+	}
+}
+
+// AstroLocationStorage keeps the location set via
+// the settings device across restarts
+type AstroLocationStorage interface {
+	LoadAstroLocation() (loc AstroLocation, found bool)
+	StoreAstroLocation(loc AstroLocation)
+}
+
+func (engine *RuleEngine) SetAstroLocationStorage(storage AstroLocationStorage) {
+	engine.astroLocationStorage = storage
+}
+
+type astroControl struct {
+	id    string
+	typ   string
+	value interface{}
+}
+
+// setupAstroControls adds the location controls to the rule
+// engine settings device when the first astronomical spec is used.
+// The location given in the options takes precedence
+// over the one set via the settings device before restart
+func (engine *RuleEngine) setupAstroControls() {
+	engine.astroMutex.Lock()
+	if engine.astroControlsReady {
+		engine.astroMutex.Unlock()
+		return
+	}
+	engine.astroControlsReady = true
+	if !engine.astroLocation.Configured && engine.astroLocationStorage != nil {
+		if stored, found := engine.astroLocationStorage.LoadAstroLocation(); found {
+			engine.astroLocation = stored
+		}
+	}
+	loc := engine.astroLocation
+	engine.astroMutex.Unlock()
+
+	timezone := ""
+	if loc.Timezone != nil && loc.Timezone != time.Local {
+		timezone = loc.Timezone.String()
+	}
+	controls := []astroControl{
+		{RULE_LATITUDE_CELL_NAME, "value", loc.Latitude},
+		{RULE_LONGITUDE_CELL_NAME, "value", loc.Longitude},
+		{RULE_TIMEZONE_CELL_NAME, "text", timezone},
+	}
+	for _, ctrl := range controls {
+		err := engine.AddControl(RULE_ENGINE_SETTINGS_DEV_NAME, ctrl.id, objx.Map{
+			VDEV_CONTROL_DESCR_PROP_TYPE:         ctrl.typ,
+			VDEV_CONTROL_DESCR_PROP_VALUE:        ctrl.value,
+			VDEV_CONTROL_DESCR_PROP_READONLY:     false,
+			VDEV_CONTROL_DESCR_PROP_FORCEDEFAULT: true, // the location is kept in the persistent DB
+		})
+		if err != nil {
+			wbgong.Error.Printf("can't add %s control to the settings device: %s", ctrl.id, err)
+			return
+		}
+	}
+}
+
+// applyAstroControlValue changes the location according
+// to the value of a location control
+func applyAstroControlValue(loc *AstroLocation, ctrlId string, value interface{}) error {
+	switch ctrlId {
+	case RULE_LATITUDE_CELL_NAME, RULE_LONGITUDE_CELL_NAME:
+		var v float64
+		switch value := value.(type) {
+		case float64:
+			v = value
+		case string:
+			var err error
+			if v, err = strconv.ParseFloat(value, 64); err != nil {
+				return err
+			}
+		default:
+			return fmt.Errorf("bad value type %T", value)
+		}
+		if ctrlId == RULE_LATITUDE_CELL_NAME {
+			if v < -90 || v > 90 {
+				return fmt.Errorf("latitude out of range: %v", v)
+			}
+			loc.Latitude = v
+		} else {
+			if v < -180 || v > 180 {
+				return fmt.Errorf("longitude out of range: %v", v)
+			}
+			loc.Longitude = v
+		}
+	case RULE_TIMEZONE_CELL_NAME:
+		name, ok := value.(string)
+		if !ok {
+			return fmt.Errorf("bad value type %T", value)
+		}
+		if name == "" {
+			loc.Timezone = nil
+			return nil
+		}
+		tz, err := time.LoadLocation(name)
+		if err != nil {
+			return err
+		}
+		loc.Timezone = tz
+	}
+	return nil
+}
+
+func isAstroControl(spec ControlSpec) bool {
+	if spec.DeviceId != RULE_ENGINE_SETTINGS_DEV_NAME {
+		return false
+	}
+	switch spec.ControlId {
+	case RULE_LATITUDE_CELL_NAME, RULE_LONGITUDE_CELL_NAME, RULE_TIMEZONE_CELL_NAME:
+		return true
+	}
+	return false
+}
+
+// maybeUpdateAstroLocation applies the change of a location
+// control on the settings device
+func (engine *RuleEngine) maybeUpdateAstroLocation(event *ControlChangeEvent) {
+	if !isAstroControl(event.Spec) {
+		return
+	}
+
+	prev := engine.AstroLocation()
+	loc := prev
+	if err := applyAstroControlValue(&loc, event.Spec.ControlId, event.Value); err != nil {
+		wbgong.Warn.Printf("invalid %s: %s", event.Spec.ControlId, err)
+		return
+	}
+	if loc == prev {
+		// e.g. the default value published when
+		// the control is created
+		return
+	}
+	if event.Spec.ControlId != RULE_TIMEZONE_CELL_NAME {
+		loc.Configured = true
+	}
+	wbgong.Info.Printf("astronomical schedules location changed: %v, %v (%s)",
+		loc.Latitude, loc.Longitude, loc.timezone())
+	engine.applyAstroLocation(loc)
+	if engine.astroLocationStorage != nil {
+		engine.astroLocationStorage.StoreAstroLocation(loc)
+	}
+}
@@ -0,0 +1,148 @@
+package wbrules
+
+import (
+	"testing"
+	"time"
+
+	"github.com/contactless/wbgong/testutils"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func mustLoadLocation(t *testing.T, name string) *time.Location {
+	loc, err := time.LoadLocation(name)
+	require.NoError(t, err)
+	return loc
+}
+
+// the values are checked against the published tables
+// with a tolerance of a couple of minutes
+func TestSunEventTime(t *testing.T) {
+	moscow := mustLoadLocation(t, "Europe/Moscow")
+	newYork := mustLoadLocation(t, "America/New_York")
+	for _, c := range []struct {
+		date      time.Time
+		lat, lon  float64
+		sunrise   string
+		sunset    string
+		polarDays bool
+	}{
+		{time.Date(2021, 6, 21, 0, 0, 0, 0, moscow), 55.7558, 37.6173, "03:44", "21:18", false},
+		{time.Date(2021, 12, 21, 23, 0, 0, 0, moscow), 55.7558, 37.6173, "08:58", "15:57", false},
+		{time.Date(2021, 3, 20, 12, 0, 0, 0, newYork), 40.7128, -74.0060, "07:00", "19:08", false},
+		{time.Date(2021, 6, 21, 0, 0, 0, 0, moscow), 69, 33, "", "", true},
+	} {
+		sunrise, ok := sunEventTime(c.date, c.lat, c.lon, true)
+		require.Equal(t, !c.polarDays, ok)
+		sunset, ok := sunEventTime(c.date, c.lat, c.lon, false)
+		require.Equal(t, !c.polarDays, ok)
+		if c.polarDays {
+			continue
+		}
+		for _, e := range []struct {
+			expected string
+			actual   time.Time
+		}{{c.sunrise, sunrise}, {c.sunset, sunset}} {
+			expected, err := time.ParseInLocation("2006-01-02 15:04",
+				c.date.Format("2006-01-02 ")+e.expected, c.date.Location())
+			require.NoError(t, err)
+			assert.WithinDuration(t, expected, e.actual, 2*time.Minute)
+		}
+	}
+}
+
+func TestParseAstroSpec(t *testing.T) {
+	s, err := parseAstroSpec("@sunset+15m")
+	require.NoError(t, err)
+	assert.Equal(t, &astroSpec{false, 15 * time.Minute, -1, -1}, s)
+
+	s, err = parseAstroSpec("@sunrise-1h30m notbefore 07:00 notafter 09:30")
+	require.NoError(t, err)
+	assert.Equal(t, &astroSpec{true, -90 * time.Minute, 7 * time.Hour, 9*time.Hour + 30*time.Minute}, s)
+
+	for _, spec := range []string{
+		"@sunrise15m",
+		"@sunset+15",
+		"@sunrise notbefore",
+		"@sunrise notbefore 25:00",
+		"@sunrise after 07:00",
+		"@sunrise notbefore 09:00 notafter 07:00",
+	} {
+		_, err = parseAstroSpec(spec)
+		assert.Error(t, err, spec)
+	}
+}
+
+func TestAstroSchedule(t *testing.T) {
+	moscow := mustLoadLocation(t, "Europe/Moscow")
+	loc := AstroLocation{55.7558, 37.6173, moscow, true}
+	next := func(spec string, after time.Time) time.Time {
+		s, err := parseAstroSpec(spec)
+		require.NoError(t, err)
+		return (&astroSchedule{s, func() AstroLocation { return loc }}).Next(after)
+	}
+	at := func(day, hour, min int) time.Time {
+		return time.Date(2021, 6, day, hour, min, 0, 0, moscow)
+	}
+
+	// sunset is at 21:18
+	assert.WithinDuration(t, at(21, 21, 33), next("@sunset+15m", at(21, 12, 0)), 2*time.Minute)
+	assert.WithinDuration(t, at(22, 21, 33), next("@sunset+15m", at(21, 21, 40)), 2*time.Minute)
+
+	// sunrise is at 03:44
+	assert.Equal(t, at(22, 7, 0), next("@sunrise notbefore 07:00", at(21, 7, 0)))
+	assert.Equal(t, at(21, 21, 0), next("@sunset notafter 21:00", at(21, 20, 0)))
+
+	// zero coordinates are valid
+	loc = AstroLocation{0, 0, time.UTC, true}
+	assert.False(t, next("@sunset", at(21, 12, 0)).IsZero())
+
+	// the schedule never fires till the location is set
+	loc = AstroLocation{}
+	assert.True(t, next("@sunset", at(21, 12, 0)).IsZero())
+}
+
+type RuleAstroSuite struct {
+	RuleSuiteBase
+}
+
+func (s *RuleAstroSuite) SetupTest() {
+	s.SetupSkippingDefs("testrules_astro.js")
+}
+
+func (s *RuleAstroSuite) TestAstroCron() {
+	s.WaitFor(func() bool {
+		c := make(chan bool)
+		s.engine.CallSync(func() {
+			c <- s.cron != nil && s.cron.started
+		})
+		return <-c
+	})
+
+	s.cron.invokeEntries("@sunset+15m")
+	s.cron.invokeEntries("@sunrise-30m notbefore 07:00")
+	s.Verify(
+		"[info] lights on",
+		"[info] lights off",
+	)
+}
+
+func (s *RuleAstroSuite) TestLocationControls() {
+	s.publish("/devices/wbrules/controls/Latitude/on", "55.75", "wbrules/Latitude")
+	s.publish("/devices/wbrules/controls/Longitude/on", "37.62", "wbrules/Longitude")
+	s.Verify(
+		"tst -> /devices/wbrules/controls/Latitude/on: [55.75] (QoS 1)",
+		"driver -> /devices/wbrules/controls/Latitude: [55.75] (QoS 1, retained)",
+		"tst -> /devices/wbrules/controls/Longitude/on: [37.62] (QoS 1)",
+		"driver -> /devices/wbrules/controls/Longitude: [37.62] (QoS 1, retained)",
+	)
+	s.WaitFor(func() bool {
+		return s.engine.AstroLocation() == AstroLocation{Latitude: 55.75, Longitude: 37.62, Configured: true}
+	})
+}
+
+func TestRuleAstroSuite(t *testing.T) {
+	testutils.RunSuites(t,
+		new(RuleAstroSuite),
+	)
+}
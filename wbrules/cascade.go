@@ -0,0 +1,149 @@
+package wbrules
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+const (
+	// CASCADE_PENDING_TTL limits the time between a control write
+	// made by a rule and the corresponding control change event
+	// for the event to be considered a part of the cascade
+	CASCADE_PENDING_TTL = 5 * time.Second
+
+	// CASCADE_UNLIMITED disables cascade depth checking
+	CASCADE_UNLIMITED = 0
+)
+
+// Cascade describes the chain of rules which led to
+// a control change event, starting with the rule
+// that was triggered by something else (an external
+// control change, a timer or cron)
+type Cascade struct {
+	Rules []*Rule
+}
+
+// Depth returns the number of rules in the cascade,
+// 0 for events that aren't caused by rules
+func (c *Cascade) Depth() int {
+	if c == nil {
+		return 0
+	}
+	return len(c.Rules)
+}
+
+func (c *Cascade) String() string {
+	items := make([]string, len(c.Rules))
+	for i, rule := range c.Rules {
+		items[i] = describeRule(rule)
+	}
+	return strings.Join(items, " -> ")
+}
+
+// describeRule returns rule name along with its location
+func describeRule(rule *Rule) string {
+	name := rule.name
+	if name == "" {
+		name = fmt.Sprintf("<rule %d>", rule.id)
+	}
+	return fmt.Sprintf("%s (%s)", name, rule.location)
+}
+
+type pendingCascade struct {
+	cascade *Cascade
+	ts      time.Time
+}
+
+// EnterRule marks the beginning of rule body execution
+func (engine *RuleEngine) EnterRule(rule *Rule) {
+	engine.firingRules = append(engine.firingRules, rule)
+}
+
+// LeaveRule marks the end of rule body execution
+func (engine *RuleEngine) LeaveRule(rule *Rule) {
+	if n := len(engine.firingRules); n > 0 && engine.firingRules[n-1] == rule {
+		engine.firingRules = engine.firingRules[:n-1]
+	}
+}
+
+// currentCascade returns the chain of the rules being executed
+// along with the rules that caused them, nil if there are no
+// such rules or cascades aren't tracked. Timers and debounced
+// rules keep it so the writes they make later continue the cascade
+func (engine *RuleEngine) currentCascade() *Cascade {
+	if engine.maxCascadeDepth == CASCADE_UNLIMITED || len(engine.firingRules) == 0 {
+		return engine.eventCascade
+	}
+
+	rules := make([]*Rule, 0, engine.eventCascade.Depth()+len(engine.firingRules))
+	if engine.eventCascade != nil {
+		rules = append(rules, engine.eventCascade.Rules...)
+	}
+	rules = append(rules, engine.firingRules...)
+	return &Cascade{rules}
+}
+
+// noteControlWrite remembers the cascade of the rules that are
+// being executed so it can be attached to the control change
+// event caused by the write
+func (engine *RuleEngine) noteControlWrite(spec ControlSpec) {
+	engine.noteJournalWrite(spec)
+	if engine.maxCascadeDepth == CASCADE_UNLIMITED {
+		return
+	}
+	cascade := engine.currentCascade()
+	if cascade == nil {
+		return
+	}
+
+	engine.cascadeMutex.Lock()
+	defer engine.cascadeMutex.Unlock()
+	engine.pendingCascades[spec] = pendingCascade{cascade, time.Now()}
+}
+
+// takePendingCascade returns the cascade which caused the change
+// of the specified control, if any
+func (engine *RuleEngine) takePendingCascade(spec ControlSpec) *Cascade {
+	engine.cascadeMutex.Lock()
+	defer engine.cascadeMutex.Unlock()
+
+	p, found := engine.pendingCascades[spec]
+	if !found {
+		return nil
+	}
+	delete(engine.pendingCascades, spec)
+	if time.Since(p.ts) > CASCADE_PENDING_TTL {
+		return nil
+	}
+	return p.cascade
+}
+
+// checkCascade returns the rules which must not be run for the
+// event because it exceeds maximum cascade depth, i.e. the rules
+// of the offending chain, or nil if the event may be processed
+// by all the rules. Must be called with rulesMutex locked
+func (engine *RuleEngine) checkCascade(event *ControlChangeEvent) map[*Rule]bool {
+	if engine.maxCascadeDepth == CASCADE_UNLIMITED || event.Cascade.Depth() <= engine.maxCascadeDepth {
+		return nil
+	}
+
+	engine.Logf(ENGINE_LOG_ERROR, "rule cascade depth limit (%d) exceeded on %s change: %s",
+		engine.maxCascadeDepth, event.Spec.String(), event.Cascade)
+
+	blocked := make(map[*Rule]bool, len(event.Cascade.Rules))
+	disabled := make([]string, 0, len(event.Cascade.Rules))
+	for _, rule := range event.Cascade.Rules {
+		blocked[rule] = true
+		if !engine.disableCascadingRules || engine.ruleMap[rule.id] != rule || !rule.enabled {
+			continue
+		}
+		rule.enabled = false
+		disabled = append(disabled, describeRule(rule))
+	}
+	if len(disabled) > 0 {
+		engine.Logf(ENGINE_LOG_ERROR, "disabling rules involved in the cascade: %s",
+			strings.Join(disabled, ", "))
+	}
+	return blocked
+}
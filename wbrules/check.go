@@ -0,0 +1,230 @@
+package wbrules
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	CHECK_SEVERITY_ERROR   = "error"
+	CHECK_SEVERITY_WARNING = "warning"
+)
+
+// ScriptProblem is an error or a warning found by CheckScripts
+type ScriptProblem struct {
+	Path     string `json:"path"`
+	Line     int    `json:"line,omitempty"`
+	Severity string `json:"severity"`
+	Message  string `json:"message"`
+}
+
+func (p ScriptProblem) String() string {
+	if p.Line > 0 {
+		return fmt.Sprintf("%s:%d: %s: %s", p.Path, p.Line, p.Severity, p.Message)
+	}
+	return fmt.Sprintf("%s: %s: %s", p.Path, p.Severity, p.Message)
+}
+
+// expandScriptPaths returns the list of .js files found in the
+// specified files and directories, skipping the excluded file
+func expandScriptPaths(paths []string, exclude string) (files []string, err error) {
+	if exclude != "" {
+		if exclude, err = filepath.Abs(exclude); err != nil {
+			return nil, err
+		}
+	}
+	for _, path := range paths {
+		err = filepath.Walk(path, func(path string, info os.FileInfo, err error) error {
+			if err != nil || info.IsDir() || !strings.HasSuffix(path, ".js") {
+				return err
+			}
+			if absPath, err := filepath.Abs(path); err != nil || absPath == exclude {
+				return err
+			}
+			files = append(files, path)
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	sort.Strings(files)
+	return
+}
+
+// commonDir returns the deepest directory containing all the files
+func commonDir(files []string) (dir string, err error) {
+	for i, file := range files {
+		if file, err = filepath.Abs(file); err != nil {
+			return "", err
+		}
+		if i == 0 {
+			dir = filepath.Dir(file)
+			continue
+		}
+		for dir != "/" && !strings.HasPrefix(file, dir+string(filepath.Separator)) {
+			dir = filepath.Dir(dir)
+		}
+	}
+	return
+}
+
+// CheckScripts loads the scripts found in the specified files
+// and directories into a sandboxed engine and reports the errors
+// and the warnings found while loading them. The scripts run in
+// dry-run mode. The paths in the problems are relative to the
+// common directory of the scripts
+func CheckScripts(paths []string, options *ESEngineOptions) ([]ScriptProblem, error) {
+	files, err := expandScriptPaths(paths, "")
+	if err != nil {
+		return nil, err
+	}
+	if len(files) == 0 {
+		return nil, nil
+	}
+	root, err := commonDir(files)
+	if err != nil {
+		return nil, err
+	}
+	return checkScriptFiles(root, files, options)
+}
+
+func checkScriptFiles(root string, files []string, options *ESEngineOptions) ([]ScriptProblem, error) {
+	// the options may be shared by concurrent checks
+	options = options.Copy()
+	options.SetDryRun(true)
+	sb, err := newSandbox(NewVirtualClock(time.Now()), nil, options)
+	if err != nil {
+		return nil, err
+	}
+	defer sb.Close()
+
+	if err = sb.engine.SetSourceRoot(root); err != nil {
+		return nil, err
+	}
+
+	var problems []ScriptProblem
+	for _, file := range files {
+		err := sb.engine.LoadFile(file)
+		if _, isScriptError := err.(ScriptError); err != nil && !isScriptError {
+			// script errors are reported by checkLoadedScripts
+			path := file
+			if absPath, err := filepath.Abs(file); err == nil {
+				if relPath, err := filepath.Rel(root, absPath); err == nil {
+					path = relPath
+				}
+			}
+			problems = append(problems, ScriptProblem{
+				Path:     path,
+				Severity: CHECK_SEVERITY_ERROR,
+				Message:  err.Error(),
+			})
+		}
+	}
+
+	entries, err := sb.engine.ListSourceFiles()
+	if err != nil {
+		return nil, err
+	}
+	problems = append(problems, checkLoadedScripts(entries)...)
+	sort.SliceStable(problems, func(i, j int) bool {
+		if problems[i].Path != problems[j].Path {
+			return problems[i].Path < problems[j].Path
+		}
+		return problems[i].Line < problems[j].Line
+	})
+	return problems, nil
+}
+
+// checkLoadedScripts collects the problems found while
+// loading the scripts and reports the rules and the virtual
+// devices defined more than once
+func checkLoadedScripts(entries []LocFileEntry) (problems []ScriptProblem) {
+	rules := newDuplicateChecker("rule")
+	devices := newDuplicateChecker("virtual device")
+	for _, entry := range entries {
+		if entry.Error != nil {
+			problem := ScriptProblem{
+				Path:     entry.VirtualPath,
+				Severity: CHECK_SEVERITY_ERROR,
+				Message:  entry.Error.Message,
+			}
+			for _, loc := range entry.Error.Traceback {
+				if loc.Name == entry.VirtualPath {
+					problem.Line = loc.Line
+					break
+				}
+			}
+			problems = append(problems, problem)
+		}
+
+		for _, warning := range entry.Warnings {
+			problems = append(problems, ScriptProblem{
+				Path:     entry.VirtualPath,
+				Line:     warning.Line,
+				Severity: CHECK_SEVERITY_WARNING,
+				Message:  warning.Message,
+			})
+		}
+
+		for _, rule := range entry.Rules {
+			rules.add(entry.VirtualPath, rule)
+		}
+		for _, dev := range entry.Devices {
+			devices.add(entry.VirtualPath, dev)
+		}
+	}
+	problems = append(problems, rules.problems()...)
+	return append(problems, devices.problems()...)
+}
+
+type duplicateChecker struct {
+	kind      string
+	names     []string
+	locations map[string][]ScriptProblem
+}
+
+func newDuplicateChecker(kind string) *duplicateChecker {
+	return &duplicateChecker{kind: kind, locations: make(map[string][]ScriptProblem)}
+}
+
+func (c *duplicateChecker) add(path string, item LocItem) {
+	if item.Name == "" {
+		return
+	}
+	if _, found := c.locations[item.Name]; !found {
+		c.names = append(c.names, item.Name)
+	}
+	c.locations[item.Name] = append(c.locations[item.Name], ScriptProblem{
+		Path:     path,
+		Line:     item.Line,
+		Severity: CHECK_SEVERITY_WARNING,
+	})
+}
+
+// problems reports each definition of the name
+// that's defined more than once
+func (c *duplicateChecker) problems() (problems []ScriptProblem) {
+	for _, name := range c.names {
+		locations := c.locations[name]
+		if len(locations) < 2 {
+			continue
+		}
+		for i, problem := range locations {
+			others := make([]string, 0, len(locations)-1)
+			for j, other := range locations {
+				if j != i {
+					others = append(others, fmt.Sprintf("%s:%d", other.Path, other.Line))
+				}
+			}
+			problem.Message = fmt.Sprintf("%s '%s' is also defined at %s",
+				c.kind, name, strings.Join(others, ", "))
+			problems = append(problems, problem)
+		}
+	}
+	return
+}
@@ -0,0 +1,81 @@
+package wbrules
+
+import (
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCheckScripts(t *testing.T) {
+	problems, err := CheckScripts([]string{
+		"testrules_check_1.js",
+		"testrules_check_2.js",
+		"testrules_check_3.js",
+		"testrules_check_4.js",
+		"testrules_check_5.js",
+	}, NewESEngineOptions())
+	require.NoError(t, err)
+
+	expected := []struct {
+		path     string
+		line     int
+		severity string
+		message  string
+	}{
+		{"testrules_check_1.js", 3, CHECK_SEVERITY_WARNING,
+			"invalid control reference in whenChanged: 'check_dev/on/extra', must be 'device/control'"},
+		{"testrules_check_1.js", 3, CHECK_SEVERITY_WARNING,
+			"rule 'check_rule' is also defined at testrules_check_2.js:2"},
+		{"testrules_check_1.js", 5, CHECK_SEVERITY_WARNING,
+			"invalid cron spec 'no such spec'"},
+		{"testrules_check_2.js", 2, CHECK_SEVERITY_WARNING,
+			"rule 'check_rule' is also defined at testrules_check_1.js:3"},
+		{"testrules_check_2.js", 4, CHECK_SEVERITY_WARNING,
+			"invalid cell alias in whenChanged: noSuchAlias"},
+		{"testrules_check_2.js", 6, CHECK_SEVERITY_WARNING,
+			"invalid cell alias in whenChanged: otherAlias"},
+		{"testrules_check_3.js", 1, CHECK_SEVERITY_ERROR,
+			"Device with given ID already exists"},
+		{"testrules_check_4.js", 1, CHECK_SEVERITY_WARNING,
+			"check_dev_2/on: writeable flag is deprecated"},
+		{"testrules_check_4.js", 2, CHECK_SEVERITY_WARNING,
+			"check_dev_3/on: writeable flag is deprecated"},
+		{"testrules_check_5.js", 4, CHECK_SEVERITY_ERROR,
+			"SyntaxError"},
+	}
+	require.Len(t, problems, len(expected), "%v", problems)
+	for n, e := range expected {
+		assert.Equal(t, e.path, problems[n].Path)
+		assert.Equal(t, e.line, problems[n].Line, problems[n].String())
+		assert.Equal(t, e.severity, problems[n].Severity)
+		assert.Contains(t, problems[n].Message, e.message)
+	}
+}
+
+func TestCheckScriptsSharedOptions(t *testing.T) {
+	// the editor runs the checks concurrently with the same options
+	options := NewESEngineOptions()
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			problems, err := CheckScripts([]string{"testrules_check_4.js"}, options)
+			assert.NoError(t, err)
+			assert.Len(t, problems, 2)
+		}()
+	}
+	wg.Wait()
+
+	assert.False(t, options.dryRun)
+	assert.Equal(t, "", options.PersistentDBFile)
+}
+
+func TestCheckProblemFormat(t *testing.T) {
+	assert.Equal(t, "a.js:10: warning: something is wrong",
+		ScriptProblem{"a.js", 10, CHECK_SEVERITY_WARNING, "something is wrong"}.String())
+	assert.Equal(t, "a.js: error: can't load",
+		ScriptProblem{"a.js", 0, CHECK_SEVERITY_ERROR, "can't load"}.String())
+}
@@ -0,0 +1,66 @@
+package wbrules
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+
+	"github.com/contactless/wbgong"
+)
+
+const (
+	// DRY_RUN_LOG_TOPIC receives the descriptions of the actions
+	// that were intercepted in dry-run mode
+	DRY_RUN_LOG_TOPIC = "/wbrules/log/dryrun"
+)
+
+// DryRunScopeFunc returns the description of the script and
+// the rule calling into the engine if the script runs in
+// dry-run mode
+type DryRunScopeFunc func() (where string, dryRun bool)
+
+// SetDryRunScopeFunc sets the function used to find out
+// whether the control writes and MQTT publishes are made
+// by a script running in dry-run mode
+func (engine *RuleEngine) SetDryRunScopeFunc(f DryRunScopeFunc) {
+	engine.dryRunScopeFunc = f
+}
+
+// IsDryRun returns true if the actions made by the specified
+// script must be logged instead of being executed. The script
+// is matched against the path given to SetDryRunScripts either
+// as a whole or by its trailing path components
+func (engine *RuleEngine) IsDryRun(path string) bool {
+	if engine.dryRun {
+		return true
+	}
+	path = filepath.Clean(path)
+	for _, script := range engine.dryRunScripts {
+		script = filepath.Clean(script)
+		if path == script || strings.HasSuffix(path, string(filepath.Separator)+script) {
+			return true
+		}
+	}
+	return false
+}
+
+// LogDryRun reports an action intercepted in dry-run mode.
+// where describes the script and the rule making the call
+func (engine *RuleEngine) LogDryRun(where, format string, v ...interface{}) {
+	message := fmt.Sprintf("%s: %s", where, fmt.Sprintf(format, v...))
+	wbgong.Info.Printf("[dry run] %s", message)
+	engine.publish(DRY_RUN_LOG_TOPIC, message, 1, false)
+}
+
+// checkDryRun logs the action and returns true if it's
+// made by a script running in dry-run mode
+func (engine *RuleEngine) checkDryRun(format string, v ...interface{}) bool {
+	if engine.dryRunScopeFunc == nil {
+		return false
+	}
+	where, dryRun := engine.dryRunScopeFunc()
+	if dryRun {
+		engine.LogDryRun(where, format, v...)
+	}
+	return dryRun
+}
@@ -0,0 +1,68 @@
+package wbrules
+
+import (
+	"testing"
+
+	"github.com/contactless/wbgong/testutils"
+)
+
+type DryRunSuite struct {
+	RuleSuiteBase
+}
+
+func (s *DryRunSuite) SetupTest() {
+	s.EngineOptions = NewESEngineOptions()
+	s.EngineOptions.SetDryRun(true)
+	s.SetupSkippingDefs("testrules_dryrun.js")
+}
+
+func (s *DryRunSuite) TestDryRun() {
+	s.publish("/devices/dryrun/controls/trigger/on", "1", "dryrun/trigger", "dryrun/state")
+	s.VerifyUnordered(
+		"tst -> /devices/dryrun/controls/trigger/on: [1] (QoS 1)",
+		"driver -> /devices/dryrun/controls/trigger: [1] (QoS 1, retained)",
+		"[dryrun] testrules_dryrun.js, rule actuate: setValue somedev/sw = true",
+		// virtual devices keep working
+		"driver -> /devices/dryrun/controls/state: [42] (QoS 1, retained)",
+		"[info] state: 42",
+		"driver -> /devices/dryrun/controls/state/meta/description: [new description] (QoS 1, retained)",
+		"[dryrun] testrules_dryrun.js, rule actuate: publish /abc/def: [hello] (QoS 0, retain false)",
+		"[dryrun] testrules_dryrun.js, rule actuate: spawn /bin/sh -c touch /nonexistent/file",
+		"[info] exit(0)",
+	)
+}
+
+type DryRunScriptsSuite struct {
+	RuleSuiteBase
+}
+
+func (s *DryRunScriptsSuite) SetupTest() {
+	s.EngineOptions = NewESEngineOptions()
+	s.EngineOptions.SetDryRunScripts([]string{"testrules_dryrun.js"})
+	s.SetupSkippingDefs("testrules_dryrun.js", "testrules_dryrun_2.js")
+}
+
+func (s *DryRunScriptsSuite) TestDryRunScripts() {
+	s.publish("/devices/dryrun/controls/trigger/on", "1", "dryrun/trigger", "dryrun/state")
+	s.VerifyUnordered(
+		"tst -> /devices/dryrun/controls/trigger/on: [1] (QoS 1)",
+		"driver -> /devices/dryrun/controls/trigger: [1] (QoS 1, retained)",
+		"[dryrun] testrules_dryrun.js, rule actuate: setValue somedev/sw = true",
+		"driver -> /devices/dryrun/controls/state: [42] (QoS 1, retained)",
+		"[info] state: 42",
+		"driver -> /devices/dryrun/controls/state/meta/description: [new description] (QoS 1, retained)",
+		"[dryrun] testrules_dryrun.js, rule actuate: publish /abc/def: [hello] (QoS 0, retain false)",
+		"[dryrun] testrules_dryrun.js, rule actuate: spawn /bin/sh -c touch /nonexistent/file",
+		"[info] exit(0)",
+		// the other script isn't affected
+		"driver -> /devices/somedev/controls/temp/on: [20] (QoS 1)",
+		"wbrules-log -> /abc/real: [hello] (QoS 0)",
+	)
+}
+
+func TestDryRunSuite(t *testing.T) {
+	testutils.RunSuites(t,
+		new(DryRunSuite),
+		new(DryRunScriptsSuite),
+	)
+}
@@ -4,6 +4,7 @@ import (
 	"io/ioutil"
 	"os"
 	"path"
+	"path/filepath"
 	"regexp"
 	"strings"
 
@@ -14,6 +15,7 @@ var editorPathRx = regexp.MustCompile(`^[\w /-]{0,256}[\w -]{1,253}\.js$`)
 
 type Editor struct {
 	locFileManager LocFileManager
+	checkOptions   *ESEngineOptions
 }
 
 type EditorError struct {
@@ -42,6 +44,7 @@ const (
 	EDITOR_ERROR_OVERWRITE      = 1007
 	EDITOR_ERROR_INVALID_EXT    = 1008
 	EDITOR_ERROR_INVALID_LEN    = 1009
+	EDITOR_ERROR_CHECK          = 1010
 )
 
 var invalidPathError = &EditorError{EDITOR_ERROR_INVALID_PATH, "File path should contains only digits, letters, whitespaces, '_' and '-' chars"}
@@ -54,9 +57,16 @@ var rmError = &EditorError{EDITOR_ERROR_REMOVE, "Error removing the file"}
 var renameError = &EditorError{EDITOR_ERROR_RENAME, "Error renaming the file"}
 var readError = &EditorError{EDITOR_ERROR_READ, "Error reading the file"}
 var overwriteError = &EditorError{EDITOR_ERROR_OVERWRITE, "New-state file already exists"}
+var checkError = &EditorError{EDITOR_ERROR_CHECK, "Error checking the file"}
 
 func NewEditor(locFileManager LocFileManager) *Editor {
-	return &Editor{locFileManager}
+	return &Editor{locFileManager, nil}
+}
+
+// SetCheckOptions sets the options of the engine
+// used to check the scripts
+func (editor *Editor) SetCheckOptions(options *ESEngineOptions) {
+	editor.checkOptions = options
 }
 
 func (editor *Editor) List(args *struct{}, reply *[]LocFileEntry) (err error) {
@@ -70,24 +80,32 @@ type EditorSaveArgs struct {
 }
 
 type EditorSaveResponse struct {
-	Error     interface{} `json:"error,omitempty",`
+	Error     interface{} `json:"error,omitempty"`
 	Path      string      `json:"path"`
 	Traceback []LocItem   `json:"traceback,omitempty"`
 }
 
-func (editor *Editor) Save(args *EditorSaveArgs, reply *EditorSaveResponse) error {
-	pth := path.Clean(args.Path)
+func cleanEditorPath(p string) (string, error) {
+	pth := path.Clean(p)
 
 	for strings.HasPrefix(pth, "/") {
 		pth = pth[1:]
 	}
 
 	if !strings.HasSuffix(pth, ".js") {
-		return invalidExtensionError
-	} else if len(args.Path) > 512 {
-		return invalidLenError
+		return "", invalidExtensionError
+	} else if len(p) > 512 {
+		return "", invalidLenError
 	} else if !editorPathRx.MatchString(pth) {
-		return invalidPathError
+		return "", invalidPathError
+	}
+	return pth, nil
+}
+
+func (editor *Editor) Save(args *EditorSaveArgs, reply *EditorSaveResponse) error {
+	pth, err := cleanEditorPath(args.Path)
+	if err != nil {
+		return err
 	}
 
 	*reply = EditorSaveResponse{nil, pth, nil}
@@ -97,7 +115,7 @@ func (editor *Editor) Save(args *EditorSaveArgs, reply *EditorSaveResponse) erro
 		pth = pth + FILE_DISABLED_SUFFIX
 	}
 
-	err := editor.locFileManager.LiveWriteScript(pth, args.Content)
+	err = editor.locFileManager.LiveWriteScript(pth, args.Content)
 	switch err.(type) {
 	case nil:
 		return nil
@@ -112,6 +130,84 @@ func (editor *Editor) Save(args *EditorSaveArgs, reply *EditorSaveResponse) erro
 	return nil
 }
 
+type EditorCheckResponse struct {
+	Problems []ScriptProblem `json:"problems"`
+}
+
+// Check loads the content along with the rest of enabled
+// scripts into a sandboxed engine without saving it and
+// reports the problems found in the content
+func (editor *Editor) Check(args *EditorSaveArgs, reply *EditorCheckResponse) error {
+	pth, err := cleanEditorPath(args.Path)
+	if err != nil {
+		return err
+	}
+
+	problems, err := editor.checkContent(pth, args.Content)
+	if err != nil {
+		wbgong.Error.Printf("error checking %s: %s", pth, err)
+		return checkError
+	}
+
+	*reply = EditorCheckResponse{make([]ScriptProblem, 0)}
+	for _, problem := range problems {
+		if problem.Path == pth {
+			reply.Problems = append(reply.Problems, problem)
+		}
+	}
+	return nil
+}
+
+func (editor *Editor) checkContent(pth, content string) ([]ScriptProblem, error) {
+	entries, err := editor.locFileManager.ListSourceFiles()
+	if err != nil {
+		return nil, err
+	}
+
+	tmpDir, err := ioutil.TempDir(os.TempDir(), "wbrules-check")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(tmpDir)
+
+	// the copies of the scripts keep their virtual paths
+	// so the problems refer to the right files
+	writeFile := func(virtualPath string, content []byte) (string, error) {
+		dst := filepath.Join(tmpDir, filepath.FromSlash(virtualPath))
+		if err := os.MkdirAll(filepath.Dir(dst), 0777); err != nil {
+			return "", err
+		}
+		return dst, ioutil.WriteFile(dst, content, 0666)
+	}
+
+	files := make([]string, 0, len(entries)+1)
+	for _, entry := range entries {
+		if !entry.Enabled || entry.VirtualPath == pth {
+			continue
+		}
+		bs, err := ioutil.ReadFile(entry.PhysicalPath)
+		if err != nil {
+			return nil, err
+		}
+		dst, err := writeFile(entry.VirtualPath, bs)
+		if err != nil {
+			return nil, err
+		}
+		files = append(files, dst)
+	}
+	dst, err := writeFile(pth, []byte(content))
+	if err != nil {
+		return nil, err
+	}
+	files = append(files, dst)
+
+	options := editor.checkOptions
+	if options == nil {
+		options = NewESEngineOptions()
+	}
+	return checkScriptFiles(tmpDir, files, options)
+}
+
 type EditorPathArgs struct {
 	Path string `json:"path"`
 }
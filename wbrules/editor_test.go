@@ -37,7 +37,7 @@ func (s *EditorSuite) SetupTest() {
 	s.RpcFixture = testutils.NewRpcFixture(
 		s.T(), "wbrules", "Editor", "wbrules",
 		NewEditor(s),
-		"ChangeState", "List", "Load", "Remove", "Save")
+		"ChangeState", "Check", "List", "Load", "Remove", "Save")
 }
 
 func (s *EditorSuite) TearDownTest() {
@@ -376,6 +376,36 @@ func (s *EditorSuite) TestEnableDisableFile() {
 	s.EnsureGotErrors()
 }
 
+func (s *EditorSuite) TestCheckFile() {
+	s.VerifyRpc("Check", objx.Map{
+		"path":    "sub/check.js",
+		"content": `defineRule("check", { whenChanged: "a/b/c", then: function () {} });`,
+	}, objx.Map{
+		"problems": []objx.Map{
+			{
+				"path":     "sub/check.js",
+				"line":     1,
+				"severity": "warning",
+				"message":  "invalid control reference in whenChanged: 'a/b/c', must be 'device/control'",
+			},
+		},
+	})
+	s.EnsureGotWarnings()
+
+	s.VerifyRpc("Check", objx.Map{"path": "sample1.js", "content": "// ok"},
+		objx.Map{"problems": []objx.Map{}})
+
+	s.VerifyRpcError("Check", objx.Map{"path": "../foo/bar.js", "content": "evilfile"},
+		EDITOR_ERROR_INVALID_PATH, "EditorError", invalidPathError.Error())
+
+	// checked content is not saved
+	s.verifySources(map[string]string{
+		"sample1.js":          "// sample1",
+		"sample2.js":          "// sample2",
+		"sample3.js.disabled": "// disabled sample3",
+	})
+}
+
 func TestEditorSuite(t *testing.T) {
 	testutils.RunSuites(t, new(EditorSuite))
 }
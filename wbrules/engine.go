@@ -1,9 +1,11 @@
 package wbrules
 
 import (
+	"encoding/json"
 	"errors"
 	"fmt"
 	"log"
+	"regexp"
 	"sort"
 	"strconv"
 	"sync"
@@ -42,8 +44,9 @@ const (
 
 	ENGINE_UNINITIALIZED_RULES_CAPACITY = 16
 
-	ENGINE_ACTIVE = 1
-	ENGINE_STOP   = 0
+	ENGINE_ACTIVE   = 1
+	ENGINE_STOP     = 0
+	ENGINE_SHUTDOWN = 2 // not accepting driver events
 
 	ATOMIC_TRUE  = 1
 	ATOMIC_FALSE = 0
@@ -59,6 +62,8 @@ var (
 	ControlNotFoundError = errors.New("Control is not found")
 )
 
+var statsdBucketRx = regexp.MustCompile(`[^\w-]+`)
+
 type ControlSpec struct {
 	DeviceId  string
 	ControlId string
@@ -70,6 +75,8 @@ func (c *ControlSpec) String() string {
 
 type TimerFunc func(id TimerId, d time.Duration, periodic bool) wbgong.Timer
 
+// newTimer is a TimerFunc using real timers. Unlike the scheduler,
+// it makes the engine run a goroutine for each timer
 func newTimer(id TimerId, d time.Duration, periodic bool) wbgong.Timer {
 	if periodic {
 		return wbgong.NewRealTicker(d)
@@ -80,26 +87,40 @@ func newTimer(id TimerId, d time.Duration, periodic bool) wbgong.Timer {
 
 type TimerEntry struct {
 	sync.Mutex
-	timer          wbgong.Timer
 	periodic       bool
-	quit, quitted  chan struct{}
+	interval       time.Duration
+	deadline       time.Time // zero till the timer is actually started
+	ticking        bool      // the underlying timer is periodic
+	generation     uint64    // incremented each time the timer is rescheduled
+	paused         bool
+	remaining      time.Duration // time left when paused
+	script         string
+	persistent     bool
+	late           bool   // persistent timer which expired while the engine was down
+	cancel         func() // stops the countdown, nil if the timer isn't armed
 	name           string
 	thunk          func()
 	active         bool
 	onRemoveHndlrs []func()
+	cascade        *Cascade // the rules which started the timer
 }
 
 func (entry *TimerEntry) stop() {
 	entry.Lock()
 	defer entry.Unlock()
-	if entry.quit != nil {
-		close(entry.quit)
-		// make sure the timer is really stopped before continuing
-		<-entry.quitted
-	}
+	entry.disarm()
 	entry.active = false
 }
 
+// disarm stops the countdown of the timer keeping
+// the entry. Must be called with the entry locked
+func (entry *TimerEntry) disarm() {
+	if entry.cancel != nil {
+		entry.cancel()
+		entry.cancel = nil
+	}
+}
+
 func (entry *TimerEntry) onRemove(thunk func()) {
 	entry.onRemoveHndlrs = append(entry.onRemoveHndlrs, thunk)
 }
@@ -114,6 +135,8 @@ type proxyOwner interface {
 	Driver() wbgong.Driver
 	getRev() uint32
 	trackControlSpec(ControlSpec)
+	noteControlWrite(ControlSpec)
+	checkDryRun(format string, v ...interface{}) bool
 }
 
 type DeviceProxy struct {
@@ -261,6 +284,10 @@ func (ctrlProxy *ControlProxy) getControl() wbgong.Control {
 	return ctrlProxy.control
 }
 
+func (ctrlProxy *ControlProxy) spec() ControlSpec {
+	return ControlSpec{ctrlProxy.devProxy.name, ctrlProxy.name}
+}
+
 // TODO: return error on non-existing/incomplete control
 func (ctrlProxy *ControlProxy) RawValue() (v string) {
 	ctrl := ctrlProxy.getControl()
@@ -355,6 +382,14 @@ func (ctrlProxy *ControlProxy) SetValue(value interface{}) {
 		return
 	}
 
+	// virtual devices keep working in dry-run mode
+	spec := ctrlProxy.spec()
+	if !ctrlProxy.IsLocal() && ctrlProxy.devProxy.owner.checkDryRun("setValue %s = %v", &spec, value) {
+		return
+	}
+
+	ctrlProxy.devProxy.owner.noteControlWrite(spec)
+
 	isLocal := false
 	err := ctrlProxy.accessDriver(func(tx wbgong.DriverTx) error {
 		ctrl.SetTx(tx)
@@ -384,6 +419,13 @@ func (ctrlProxy *ControlProxy) SetMeta(key, value string) (cce *ControlChangeEve
 		return
 	}
 
+	if !ctrlProxy.IsLocal() {
+		ctrlSpec := ctrlProxy.spec()
+		if ctrlProxy.devProxy.owner.checkDryRun("setMeta %s#%s = %s", &ctrlSpec, key, value) {
+			return
+		}
+	}
+
 	var spec ControlSpec
 	isComplete := false
 	isRetained := false
@@ -443,6 +485,21 @@ func (ctrlProxy *ControlProxy) SetMeta(key, value string) (cce *ControlChangeEve
 	return
 }
 
+// IsLocal returns true if the control belongs to
+// a virtual device defined by the rules
+func (ctrlProxy *ControlProxy) IsLocal() (v bool) {
+	ctrl := ctrlProxy.getControl()
+	if ctrl == nil {
+		return false
+	}
+
+	_ = ctrlProxy.accessDriver(func(tx wbgong.DriverTx) error {
+		_, v = ctrl.GetDevice().(wbgong.LocalDevice)
+		return nil
+	})
+	return v
+}
+
 // FIXME: error handling here
 func (ctrlProxy *ControlProxy) IsComplete() (v bool) {
 	ctrl := ctrlProxy.getControl()
@@ -480,19 +537,50 @@ type ControlChangeEvent struct {
 	Spec       ControlSpec
 	IsComplete bool
 	IsRetained bool
-	Value      interface{}
+	// IsPushbutton is set for pushbutton controls,
+	// such events are never coalesced
+	IsPushbutton bool
+	Value        interface{}
+	// Cascade is the chain of rules which caused this event,
+	// nil if the event didn't originate from a rule
+	Cascade *Cascade
+	// OldValue is the previous value of the control,
+	// nil if it's not known yet or the event is a meta one
+	OldValue  interface{}
+	Timestamp time.Time
+	// IsMeta is set for the events of meta pseudo-controls
+	// such as "temp#type"
+	IsMeta bool
+	// FromRules is set for the value events caused by
+	// the control writes made by the scripts
+	FromRules bool
+	// FromMeta is set for the value events caused by a change
+	// of the control meta, the value itself may be unchanged
+	FromMeta bool
 }
 
 type RuleEngineOptions struct {
-	debugQueues   bool
-	cleanupOnStop bool
-	Statsd        wbgong.StatsdClientWrapper
+	debugQueues         bool
+	cleanupOnStop       bool
+	eventBufferCapacity int
+	eventBufferPolicy   EventBufferPolicy
+	maxCascadeDepth     int
+	disableCascading    bool
+	journal             *Journal
+	dryRun              bool
+	dryRunScripts       []string
+	astroLocation       AstroLocation
+	Statsd              wbgong.StatsdClientWrapper
 }
 
 func NewRuleEngineOptions() *RuleEngineOptions {
 	return &RuleEngineOptions{
-		debugQueues:   false,
-		cleanupOnStop: false,
+		debugQueues:         false,
+		cleanupOnStop:       false,
+		eventBufferCapacity: EVENT_BUFFER_UNLIMITED,
+		eventBufferPolicy:   EVENT_BUFFER_KEEP_ALL,
+		maxCascadeDepth:     CASCADE_UNLIMITED,
+		disableCascading:    false,
 	}
 }
 
@@ -506,6 +594,59 @@ func (o *RuleEngineOptions) SetCleanupOnStop(v bool) *RuleEngineOptions {
 	return o
 }
 
+// SetEventBufferCapacity limits the number of events waiting
+// to be processed, the oldest events are dropped on overflow
+func (o *RuleEngineOptions) SetEventBufferCapacity(capacity int) *RuleEngineOptions {
+	o.eventBufferCapacity = capacity
+	return o
+}
+
+func (o *RuleEngineOptions) SetEventBufferPolicy(policy EventBufferPolicy) *RuleEngineOptions {
+	o.eventBufferPolicy = policy
+	return o
+}
+
+// SetMaxCascadeDepth limits the length of the chain of rules
+// triggering each other by writing controls
+func (o *RuleEngineOptions) SetMaxCascadeDepth(depth int) *RuleEngineOptions {
+	o.maxCascadeDepth = depth
+	return o
+}
+
+// SetDisableCascadingRules makes the engine disable the rules
+// involved in a cascade that exceeds maximum depth
+func (o *RuleEngineOptions) SetDisableCascadingRules(v bool) *RuleEngineOptions {
+	o.disableCascading = v
+	return o
+}
+
+// SetJournal makes the engine record control change events,
+// timer fires and tracked MQTT messages to the journal
+func (o *RuleEngineOptions) SetJournal(journal *Journal) *RuleEngineOptions {
+	o.journal = journal
+	return o
+}
+
+// SetDryRun makes all the scripts log the control writes,
+// MQTT publishes and external commands instead of doing them
+func (o *RuleEngineOptions) SetDryRun(v bool) *RuleEngineOptions {
+	o.dryRun = v
+	return o
+}
+
+// SetDryRunScripts enables dry-run mode for the specified scripts only
+func (o *RuleEngineOptions) SetDryRunScripts(scripts []string) *RuleEngineOptions {
+	o.dryRunScripts = scripts
+	return o
+}
+
+// SetAstroLocation sets the location used to calculate
+// sunrise and sunset times for astronomical cron specs
+func (o *RuleEngineOptions) SetAstroLocation(loc AstroLocation) *RuleEngineOptions {
+	o.astroLocation = loc
+	return o
+}
+
 func (o *RuleEngineOptions) SetStatsdClient(c wbgong.StatsdClientWrapper) *RuleEngineOptions {
 	o.Statsd = c
 	return o
@@ -522,11 +663,17 @@ type RuleEngine struct {
 	driver          wbgong.Driver
 	driverReadyCh   chan struct{}
 
-	eventBuffer *EventBuffer
+	eventBuffer         *EventBuffer
+	eventBufferCapacity int
+	eventBufferPolicy   EventBufferPolicy
+	processingEvents    uint32 // atomic
 
-	timerFunc   TimerFunc
+	timerFunc   TimerFunc // nil to use the scheduler
 	nextTimerId TimerId
 
+	schedulerMtx sync.Mutex
+	scheduler    *timerScheduler
+
 	timersMutex sync.Mutex
 	timers      map[TimerId]*TimerEntry
 
@@ -541,11 +688,46 @@ type RuleEngine struct {
 	timerRules            map[string][]*Rule
 	uninitializedRules    []*Rule
 
+	ruleTagsMutex  sync.Mutex
+	ruleTags       map[string]*RuleTag
+	ruleTagStorage RuleTagStateStorage
+
+	persistentTimersMutex  sync.Mutex
+	persistentTimers       map[string]PersistentTimerState // nil till loaded
+	persistentTimerStorage PersistentTimerStorage
+
+	maxCascadeDepth       int
+	disableCascadingRules bool
+	firingRules           []*Rule
+	eventCascade          *Cascade
+	cascadeMutex          sync.Mutex
+	pendingCascades       map[ControlSpec]pendingCascade
+
+	// the latest values of complete controls, used to fill
+	// OldValue of ControlChangeEvent
+	lastValuesMutex sync.Mutex
+	lastValues      map[ControlSpec]interface{}
+
+	journal            *Journal
+	journalWritesMutex sync.Mutex
+	journalWrites      map[ControlSpec]time.Time
+
+	dryRun          bool
+	dryRunScripts   []string
+	dryRunScopeFunc DryRunScopeFunc
+
+	astroMutex           sync.Mutex
+	astroLocation        AstroLocation
+	astroControlsReady   bool
+	astroLocationStorage AstroLocationStorage
+
 	notedControls   []ControlSpec
 	notedTimers     map[string]bool
 	currentTimer    string
+	lateTimer       bool
 	cronMaker       func() Cron
 	cron            Cron
+	nowFunc         func() time.Time
 	statusMtx       sync.Mutex
 	getTimerMtx     sync.Mutex
 	debugEnabled    uint32 // atomic
@@ -557,6 +739,8 @@ type RuleEngine struct {
 	nextTrackID      uint32 // TrackID is used to watch a track in cleanups
 	mqttTrackerMutex sync.Mutex
 
+	rpc *rpcClient
+
 	cleanupOnStop bool
 
 	statsdClient wbgong.StatsdClientWrapper
@@ -582,7 +766,8 @@ func NewRuleEngine(driver wbgong.Driver, mqtt wbgong.MQTTClient, options *RuleEn
 		mqttClient:            mqtt,
 		driver:                driver,
 		driverReadyCh:         nil,
-		timerFunc:             newTimer,
+		timerFunc:             nil,
+		nowFunc:               time.Now,
 		nextTimerId:           1,
 		timers:                make(map[TimerId]*TimerEntry),
 		callbackIndex:         1,
@@ -595,13 +780,25 @@ func NewRuleEngine(driver wbgong.Driver, mqtt wbgong.MQTTClient, options *RuleEn
 		rulesWithoutControls:  make(map[*Rule]bool),
 		timerRules:            make(map[string][]*Rule),
 		currentTimer:          NO_TIMER_NAME,
-		cronMaker:             func() Cron { return cron.New() },
 		cron:                  nil,
 		debugEnabled:          ATOMIC_FALSE,
 		readyCh:               nil,
 		uninitializedRules:    make([]*Rule, 0, ENGINE_UNINITIALIZED_RULES_CAPACITY),
 		cleanupOnStop:         options.cleanupOnStop,
+		eventBufferCapacity:   options.eventBufferCapacity,
+		eventBufferPolicy:     options.eventBufferPolicy,
+		maxCascadeDepth:       options.maxCascadeDepth,
+		disableCascadingRules: options.disableCascading,
+		pendingCascades:       make(map[ControlSpec]pendingCascade),
+		ruleTags:              make(map[string]*RuleTag),
+		lastValues:            make(map[ControlSpec]interface{}),
+		journal:               options.journal,
+		journalWrites:         make(map[ControlSpec]time.Time),
+		dryRun:                options.dryRun,
+		dryRunScripts:         options.dryRunScripts,
+		astroLocation:         options.astroLocation,
 		tracks:                make(map[string]map[uint32]MqttTracker),
+		rpc:                   newRPCClient(mqtt),
 
 		controlChangeSubs: make([]chan *ControlChangeEvent, 0, ENGINE_CONTROL_CHANGE_SUBS_CAPACITY),
 	}
@@ -612,6 +809,10 @@ func NewRuleEngine(driver wbgong.Driver, mqtt wbgong.MQTTClient, options *RuleEn
 	// engine.controlChangeChLen = ENGINE_CONTROL_CHANGE_QUEUE_LEN
 	// }
 
+	engine.cronMaker = func() Cron {
+		return &scheduleCron{cron.New(), engine.ParseCronSpec}
+	}
+
 	engine.readyQueue = wbgong.NewDeferredList(engine.CallSync)
 	engine.timerDeferQueue = wbgong.NewDeferredList(engine.CallHere)
 
@@ -635,6 +836,41 @@ func (engine *RuleEngine) collectStats(s *statsd.Client) {
 
 	// length of event buffer
 	s.Gauge("events", engine.eventBuffer.length())
+	dropped, coalesced := engine.eventBuffer.counters()
+	s.Gauge("events.dropped", dropped)
+	s.Gauge("events.coalesced", coalesced)
+
+	// per-rule execution statistics
+	for _, entry := range engine.RuleStats() {
+		bucket := "rules." + ruleStatsBucketName(entry)
+		s.Gauge(bucket+".fire_count", entry.FireCount)
+		s.Gauge(bucket+".skipped_checks", entry.SkippedChecks)
+		s.Timing(bucket+".last_duration", entry.LastDuration)
+		s.Timing(bucket+".max_duration", entry.MaxDuration)
+	}
+}
+
+// ruleStatsBucketName makes statsd-safe bucket name for the rule
+func ruleStatsBucketName(entry RuleStatsEntry) string {
+	if entry.Name == "" {
+		return fmt.Sprintf("rule_%d", entry.Id)
+	}
+	return statsdBucketRx.ReplaceAllString(entry.Name, "_")
+}
+
+// RuleStats returns execution statistics for all defined rules
+// in rule checking order
+func (engine *RuleEngine) RuleStats() []RuleStatsEntry {
+	engine.rulesMutex.Lock()
+	defer engine.rulesMutex.Unlock()
+
+	entries := make([]RuleStatsEntry, 0, len(engine.ruleList))
+	for i, ruleId := range engine.ruleList {
+		entry := engine.ruleMap[ruleId].Stats()
+		entry.Order = i
+		entries = append(entries, entry)
+	}
+	return entries
 }
 
 func (engine *RuleEngine) ReadyCh() <-chan struct{} {
@@ -707,6 +943,8 @@ func (engine *RuleEngine) processEvent(event *ControlChangeEvent) {
 	}
 
 	engine.CallSync(func() {
+		engine.maybeUpdateRuleTag(event)
+		engine.maybeUpdateAstroLocation(event)
 		engine.RunRules(event, NO_TIMER_NAME)
 	})
 
@@ -756,10 +994,14 @@ ReadyWaitLoop:
 		select {
 		case _, ok := <-engine.eventBuffer.Observe():
 			if ok {
+				// the flag is set before the events are retrieved,
+				// see drainEvents()
+				atomic.StoreUint32(&engine.processingEvents, ATOMIC_TRUE)
 				events := engine.eventBuffer.Retrieve()
 				for _, event := range events {
 					engine.processEvent(event)
 				}
+				atomic.StoreUint32(&engine.processingEvents, ATOMIC_FALSE)
 			} else {
 				engine.handleStop()
 				wbgong.Info.Println("[engine] Stop main loop")
@@ -770,12 +1012,42 @@ ReadyWaitLoop:
 }
 
 // PushToEventBuffer sends prepared ControlChangeEvent to engines event buffer
+// stamping it with the change time and the previous value of the control
 func (engine *RuleEngine) PushToEventBuffer(cce *ControlChangeEvent) {
+	if cce.Timestamp.IsZero() {
+		cce.Timestamp = time.Now()
+	}
+
+	// meta pseudo-controls don't get into the value history
+	if !cce.IsMeta {
+		engine.lastValuesMutex.Lock()
+		cce.OldValue = engine.lastValues[cce.Spec]
+		if cce.IsComplete {
+			engine.lastValues[cce.Spec] = cce.Value
+		}
+		engine.lastValuesMutex.Unlock()
+	}
+
+	// the value events caused by meta changes are
+	// reproduced by replaying the meta entries
+	if !cce.FromMeta {
+		engine.recordJournal(JournalEntry{
+			Time:       cce.Timestamp,
+			Kind:       JOURNAL_CONTROL,
+			Device:     cce.Spec.DeviceId,
+			Control:    cce.Spec.ControlId,
+			Value:      cce.Value,
+			Retained:   cce.IsRetained,
+			Pushbutton: cce.IsPushbutton,
+			Self:       cce.FromRules,
+		})
+	}
+
 	engine.eventBuffer.PushEvent(cce)
 }
 
 func (engine *RuleEngine) driverEventHandler(event wbgong.DriverEvent) {
-	if atomic.LoadUint32(&engine.active) == ENGINE_STOP {
+	if atomic.LoadUint32(&engine.active) != ENGINE_ACTIVE {
 		return
 	}
 
@@ -787,6 +1059,10 @@ func (engine *RuleEngine) driverEventHandler(event wbgong.DriverEvent) {
 	var spec ControlSpec
 	isComplete := false
 	isRetained := false
+	isPushbutton := false
+	fromMeta := false
+	fromRules := false
+	var cascade *Cascade
 
 	switch e := event.(type) {
 	case wbgong.ControlValueEvent:
@@ -794,6 +1070,9 @@ func (engine *RuleEngine) driverEventHandler(event wbgong.DriverEvent) {
 		spec = ControlSpec{e.Control.GetDevice().GetId(), e.Control.GetId()}
 		isComplete = e.Control.IsComplete()
 		isRetained = e.Control.IsRetained()
+		isPushbutton = e.Control.GetType() == "pushbutton"
+		cascade = engine.takePendingCascade(spec)
+		fromRules = engine.takeJournalWrite(spec) || cascade != nil
 	case wbgong.NewExternalDeviceControlMetaEvent:
 		value, _ = e.Control.GetValue()
 		spec = ControlSpec{e.Control.GetDevice().GetId(), e.Control.GetId()}
@@ -812,20 +1091,26 @@ func (engine *RuleEngine) driverEventHandler(event wbgong.DriverEvent) {
 			IsComplete: true, //TODO: find if all controls complete
 			IsRetained: isRetained,
 			Value:      ev.Value,
+			IsMeta:     true,
 		}
-		engine.eventBuffer.PushEvent(metaCCE)
+		engine.PushToEventBuffer(metaCCE)
+		fromMeta = true
 	default:
 		return
 	}
 
 	cce := &ControlChangeEvent{
-		Spec:       spec,
-		IsComplete: isComplete,
-		IsRetained: isRetained,
-		Value:      value,
+		Spec:         spec,
+		IsComplete:   isComplete,
+		IsRetained:   isRetained,
+		IsPushbutton: isPushbutton,
+		Value:        value,
+		Cascade:      cascade,
+		FromRules:    fromRules,
+		FromMeta:     fromMeta,
 	}
 
-	engine.eventBuffer.PushEvent(cce)
+	engine.PushToEventBuffer(cce)
 }
 
 func (engine *RuleEngine) CallSync(thunk func()) {
@@ -871,6 +1156,9 @@ func (engine *RuleEngine) setupRuleEngineSettingsDevice() {
 	}
 }
 
+// SetTimerFunc makes the engine run each timer using
+// the timer returned by timerFunc instead of the scheduler
+// shared by all the timers, e.g. to use fake timers in tests
 func (engine *RuleEngine) SetTimerFunc(timerFunc TimerFunc) {
 	engine.timerFunc = timerFunc
 }
@@ -879,6 +1167,12 @@ func (engine *RuleEngine) SetCronMaker(cronMaker func() Cron) {
 	engine.cronMaker = cronMaker
 }
 
+// SetNowFunc sets the function returning current time
+// for the engine clock driven by the timer func
+func (engine *RuleEngine) SetNowFunc(nowFunc func() time.Time) {
+	engine.nowFunc = nowFunc
+}
+
 func (engine *RuleEngine) SetUninitializedRule(rule *Rule) {
 	engine.uninitializedRules = append(engine.uninitializedRules, rule)
 }
@@ -969,13 +1263,51 @@ func (engine *RuleEngine) fireTimer(n TimerId) {
 		wbgong.Error.Printf("firing unknown timer %d", n)
 		return
 	}
+	engine.recordJournal(JournalEntry{
+		Kind:    JOURNAL_TIMER,
+		Timer:   entry.name,
+		TimerId: n,
+	})
+
+	entry.Lock()
+	generation := entry.generation
+	cascade := entry.cascade
+	entry.Unlock()
+
+	// the writes made by the timer continue
+	// the cascade of the rules which started it
+	prevCascade := engine.eventCascade
+	engine.eventCascade = cascade
 	if entry.name == NO_TIMER_NAME {
 		entry.thunk()
 	} else {
+		if entry.persistent {
+			// the state is removed before running the rules
+			// because they may restart the timer
+			engine.forgetPersistentTimer(entry.name)
+		}
+		engine.lateTimer = entry.late
 		engine.RunRules(nil, entry.name)
+		engine.lateTimer = false
 	}
+	engine.eventCascade = prevCascade
 
-	if !entry.periodic {
+	entry.Lock()
+	rescheduled := entry.generation != generation || entry.paused
+	switch {
+	case rescheduled:
+		// restarted or paused by the rules
+	case entry.periodic && entry.ticking:
+		entry.deadline = entry.deadline.Add(entry.interval)
+	case entry.periodic && entry.active:
+		// the first tick of the resumed timer,
+		// continue with the interval
+		entry.disarm()
+		engine.armTimer(n, entry, entry.interval)
+	}
+	entry.Unlock()
+
+	if !entry.periodic && !rescheduled {
 		engine.timersMutex.Lock()
 		engine.removeTimer(n)
 		engine.timersMutex.Unlock()
@@ -990,6 +1322,13 @@ func (engine *RuleEngine) removeTimer(n TimerId) {
 }
 
 func (engine *RuleEngine) StopTimerByName(name string) {
+	engine.forgetPersistentTimer(name)
+	engine.stopTimerByName(name)
+}
+
+// stopTimerByName stops the timer keeping the state
+// of the persistent timer
+func (engine *RuleEngine) stopTimerByName(name string) {
 	engine.timersMutex.Lock()
 
 	for n, entry := range engine.timers {
@@ -1051,7 +1390,15 @@ func (engine *RuleEngine) RunRules(ctrlEvent *ControlChangeEvent, timerName stri
 	// clear uninitialized rules list
 	engine.uninitializedRules = make([]*Rule, 0, ENGINE_UNINITIALIZED_RULES_CAPACITY)
 
+	var blocked map[*Rule]bool
 	if ctrlEvent != nil {
+		// the rules of the chain exceeding maximum depth
+		// are skipped while the others still run
+		blocked = engine.checkCascade(ctrlEvent)
+		prevCascade := engine.eventCascade
+		engine.eventCascade = ctrlEvent.Cascade
+		defer func() { engine.eventCascade = prevCascade }()
+
 		/*if cell.IsFreshButton() {
 			// special case - a button that wasn't pressed yet
 			return
@@ -1082,11 +1429,27 @@ func (engine *RuleEngine) RunRules(ctrlEvent *ControlChangeEvent, timerName stri
 	}
 
 	for _, ruleId := range engine.ruleList {
-		engine.ruleMap[ruleId].Check(ctrlEvent)
+		if rule := engine.ruleMap[ruleId]; !blocked[rule] {
+			rule.Check(ctrlEvent)
+		}
 	}
 	engine.currentTimer = NO_TIMER_NAME
 }
 
+// CheckRule checks the single rule outside of RunRules,
+// e.g. when its condition depends on time
+func (engine *RuleEngine) CheckRule(rule *Rule) {
+	engine.rulesMutex.Lock()
+	defer engine.rulesMutex.Unlock()
+
+	if engine.ruleMap[rule.id] != rule {
+		// the rule is removed
+		return
+	}
+	rule.ShouldCheck()
+	rule.Check(nil)
+}
+
 func (engine *RuleEngine) setupCron() {
 	if engine.cron != nil {
 		engine.cron.Stop()
@@ -1122,6 +1485,8 @@ func (engine *RuleEngine) handleStop() {
 	for _, entry := range timerEntries {
 		entry.stop()
 	}
+	engine.stopTimerScheduler()
+	engine.rpc.cancelAll()
 
 	engine.statusMtx.Lock()
 	engine.readyCh = nil
@@ -1174,7 +1539,7 @@ func (engine *RuleEngine) Start() {
 
 	engine.readyCh = make(chan struct{})
 	engine.driverReadyCh = make(chan struct{}, 1)
-	engine.eventBuffer = NewEventBuffer()
+	engine.eventBuffer = NewEventBuffer(engine.eventBufferCapacity, engine.eventBufferPolicy)
 
 	engine.driver.OnDriverEvent(engine.driverEventHandler)
 	engine.driver.OnRetainReady(func(tx wbgong.DriverTx) {
@@ -1188,7 +1553,10 @@ func (engine *RuleEngine) Start() {
 }
 
 func (engine *RuleEngine) Stop() {
-	atomic.StoreUint32(&engine.active, ENGINE_STOP)
+	if atomic.SwapUint32(&engine.active, ENGINE_STOP) == ENGINE_STOP {
+		// already stopped, e.g. by Shutdown()
+		return
+	}
 
 	// run all necessary cleanups
 	if engine.cleanupOnStop {
@@ -1219,84 +1587,153 @@ func (engine *RuleEngine) IsActive() bool {
 func (engine *RuleEngine) StartTimer(name string, callback func(), interval time.Duration, periodic bool) TimerId {
 	entry := &TimerEntry{
 		periodic: periodic,
-		quit:     nil,
-		quitted:  nil,
+		interval: interval,
 		name:     name,
 		active:   true,
 	}
 
-	engine.timersMutex.Lock()
-	n := engine.nextTimerId
-	engine.nextTimerId += 1
-	engine.timers[n] = entry
-	engine.timersMutex.Unlock()
-
 	if name == NO_TIMER_NAME {
 		entry.thunk = callback
 	} else if callback != nil {
 		wbgong.Warn.Printf("warning: ignoring callback func for a named timer")
 	}
 
-	wbgong.Debug.Printf("[engine] Starting timer '%s' (id %d)", name, n)
+	return engine.startTimerEntry(entry)
+}
+
+func (engine *RuleEngine) startTimerEntry(entry *TimerEntry) TimerId {
+	entry.cascade = engine.currentCascade()
+
+	engine.timersMutex.Lock()
+	n := engine.nextTimerId
+	engine.nextTimerId += 1
+	engine.timers[n] = entry
+	engine.timersMutex.Unlock()
+
+	wbgong.Debug.Printf("[engine] Starting timer '%s' (id %d)", entry.name, n)
 
 	engine.timerDeferQueue.MaybeDefer(func() {
 		entry.Lock()
 		defer entry.Unlock()
-		if !entry.active {
-			// stopped before the engine is ready
+		if !entry.active || entry.paused || entry.cancel != nil {
+			// stopped, paused or restarted before the engine is ready
 			return
 		}
-		entry.quit = make(chan struct{}, 2) // FIXME: is 2 necessary here?
-		entry.quitted = make(chan struct{})
+		engine.armTimer(n, entry, entry.interval)
+	})
 
-		engine.getTimerMtx.Lock()
-		entry.timer = engine.timerFunc(n, interval, periodic)
-		engine.getTimerMtx.Unlock()
+	return n
+}
 
-		tickCh := entry.timer.GetChannel()
-		go func() {
-			for {
-				select {
-				case <-tickCh:
-					entryFunc := func() {
-						entry.Lock()
-						wasActive := entry.active
-						entry.Unlock()
-						if wasActive {
-							engine.fireTimer(n)
-						}
-					}
+// armTimer starts the countdown of the timer entry which fires
+// after the specified time. Periodic timers fire with their
+// interval after that. Must be called with the entry locked
+func (engine *RuleEngine) armTimer(n TimerId, entry *TimerEntry, d time.Duration) {
+	periodic := entry.periodic && d == entry.interval
+	entry.ticking = periodic
+	entry.generation++
+	generation := entry.generation
+	entry.deadline = engine.nowFunc().Add(d)
 
-					// try to push entry processing function into sync queue or
-					// exit immediately on quit signal
-					// timer may block here if you try to use classic CallSync
-					select {
-					case engine.syncQueue <- entryFunc:
-					case <-entry.quit:
-						entry.timer.Stop()
-						close(entry.quitted)
-						return
-					}
+	entryFunc := func() {
+		entry.Lock()
+		// skip the ticks of stopped, paused
+		// and rescheduled timers
+		isCurrent := entry.active && !entry.paused &&
+			entry.generation == generation
+		entry.Unlock()
+		if isCurrent {
+			engine.fireTimer(n)
+		}
+	}
 
-					// stop timer loop if it is not periodical
-					if !periodic {
-						close(entry.quitted)
-						return
-					}
+	if engine.timerFunc == nil {
+		var period time.Duration
+		if periodic {
+			period = d
+		}
+		scheduler := engine.timerScheduler()
+		item := scheduler.add(d, period, entryFunc)
+		entry.cancel = func() {
+			scheduler.remove(item)
+		}
+		return
+	}
+
+	engine.getTimerMtx.Lock()
+	timer := engine.timerFunc(n, d, periodic)
+	engine.getTimerMtx.Unlock()
+
+	quit := make(chan struct{}, 2) // FIXME: is 2 necessary here?
+	quitted := make(chan struct{})
+	entry.cancel = func() {
+		close(quit)
+		// make sure the timer is really stopped before continuing
+		<-quitted
+	}
+
+	tickCh := timer.GetChannel()
+	go func() {
+		for {
+			select {
+			case <-tickCh:
+				// try to push entry processing function into sync queue or
+				// exit immediately on quit signal
+				// timer may block here if you try to use classic CallSync
+				select {
+				case engine.syncQueue <- entryFunc:
+				case <-quit:
+					timer.Stop()
+					close(quitted)
+					return
+				}
 
-				case <-entry.quit:
-					entry.timer.Stop()
-					close(entry.quitted)
+				// stop timer loop if it is not periodical
+				if !periodic {
+					close(quitted)
 					return
 				}
+
+			case <-quit:
+				timer.Stop()
+				close(quitted)
+				return
 			}
-		}()
-	})
+		}
+	}()
+}
 
-	return n
+// timerScheduler returns the scheduler running the timers
+// unless the timer func is set, starting it if necessary
+func (engine *RuleEngine) timerScheduler() *timerScheduler {
+	engine.schedulerMtx.Lock()
+	defer engine.schedulerMtx.Unlock()
+	if engine.scheduler == nil {
+		engine.scheduler = newTimerScheduler(engine.syncQueue)
+	}
+	return engine.scheduler
+}
+
+func (engine *RuleEngine) stopTimerScheduler() {
+	engine.schedulerMtx.Lock()
+	defer engine.schedulerMtx.Unlock()
+	if engine.scheduler != nil {
+		engine.scheduler.stop()
+		engine.scheduler = nil
+	}
 }
 
+// Publish publishes the message on behalf of the scripts,
+// the message is only logged in dry-run mode
 func (engine *RuleEngine) Publish(topic, payload string, qos byte, retain bool) {
+	if engine.checkDryRun("publish %s: [%s] (QoS %d, retain %v)", topic, payload, qos, retain) {
+		return
+	}
+	engine.publish(topic, payload, qos, retain)
+}
+
+// publish publishes the engine's own message such as a log entry
+func (engine *RuleEngine) publish(topic, payload string, qos byte, retain bool) {
 	engine.mqttClient.Start()
 	engine.mqttClient.Publish(wbgong.MQTTMessage{
 		Topic:    topic,
@@ -1616,11 +2053,17 @@ func (engine *RuleEngine) DefineRule(rule *Rule, ctx *ESContext) (id RuleId, err
 	if err = ctx.AddRule(rule.name, rule); err != nil {
 		return
 	}
+	rule.context = ctx
 
 	// needed for rules defined after initial file load, for instance in timers or other rules
 	rule.MaybeAddToCron(engine.cron);
 
-	engine.ruleList = append(engine.ruleList, rule.id)
+	pos := sort.Search(len(engine.ruleList), func(i int) bool {
+		return rule.checkedBefore(engine.ruleMap[engine.ruleList[i]])
+	})
+	engine.ruleList = append(engine.ruleList, 0)
+	copy(engine.ruleList[pos+1:], engine.ruleList[pos:])
+	engine.ruleList[pos] = rule.id
 
 	engine.ruleMap[rule.id] = rule
 
@@ -1648,47 +2091,122 @@ func (engine *RuleEngine) DefineRule(rule *Rule, ctx *ESContext) (id RuleId, err
 	return
 }
 
-// DefineMqttTracker creates new mqtt tracker and subscribe to specified topic if needed
-func (engine *RuleEngine) DefineMqttTracker(topic string, ctx *ESContext) (err error) {
+// DefineMqttTracker creates new mqtt tracker and subscribe to specified topic if needed.
+// If parseJSON is true, the payloads are parsed as JSON for the tracker
+func (engine *RuleEngine) DefineMqttTracker(topic string, callback ESCallbackFunc, parseJSON bool) (trackerID uint32, err error) {
 	engine.mqttTrackerMutex.Lock()
 	defer engine.mqttTrackerMutex.Unlock()
 
-	trackerID := atomic.AddUint32(&engine.nextTrackID, 1)
+	trackerID = atomic.AddUint32(&engine.nextTrackID, 1)
 
 	tracker := NewMqttTracker(topic, trackerID)
-	tracker.Callback = ctx.WrapCallback(-1)
+	tracker.Callback = callback
+	tracker.ParseJSON = parseJSON
 	if _, ok := engine.tracks[topic]; !ok {
 		engine.tracks[topic] = make(MqttTrackerMap)
+		engine.mqttClient.Subscribe(engine.newTrackHandler(topic), topic)
 	}
-	engine.mqttClient.Subscribe(engine.newTrackHandler(topic), topic)
 	engine.tracks[topic][trackerID] = tracker
 
 	engine.cleanup.AddCleanup(func() {
-		engine.mqttTrackerMutex.Lock()
-		defer engine.mqttTrackerMutex.Unlock()
-		delete(engine.tracks[topic], trackerID)
-		if len(engine.tracks[topic]) < 1 {
+		engine.RemoveMqttTracker(trackerID)
+	})
+
+	return trackerID, nil
+}
+
+// RemoveMqttTracker removes the tracker unsubscribing from
+// its topic if it's not tracked anymore. Returns false if
+// there's no such tracker
+func (engine *RuleEngine) RemoveMqttTracker(trackerID uint32) bool {
+	engine.mqttTrackerMutex.Lock()
+	defer engine.mqttTrackerMutex.Unlock()
+
+	for topic, trackers := range engine.tracks {
+		if _, found := trackers[trackerID]; !found {
+			continue
+		}
+		delete(trackers, trackerID)
+		if len(trackers) < 1 {
+			delete(engine.tracks, topic)
 			engine.mqttClient.Unsubscribe(topic)
 		}
-	})
+		return true
+	}
+	return false
+}
 
-	return nil
+func (engine *RuleEngine) hasMqttTracker(topic string, trackerID uint32) bool {
+	engine.mqttTrackerMutex.Lock()
+	defer engine.mqttTrackerMutex.Unlock()
+	_, found := engine.tracks[topic][trackerID]
+	return found
+}
+
+// mqttTrackerArgs returns the argument of tracker callbacks
+func (engine *RuleEngine) mqttTrackerArgs(msg wbgong.MQTTMessage, parseJSON bool) objx.Map {
+	args := objx.New(map[string]interface{}{
+		"topic":    msg.Topic,
+		"value":    msg.Payload,
+		"qos":      int(msg.QoS),
+		"retained": msg.Retained,
+	})
+	if parseJSON {
+		var v interface{}
+		if err := json.Unmarshal([]byte(msg.Payload), &v); err != nil {
+			engine.Log(ENGINE_LOG_ERROR, fmt.Sprintf("trackMqtt: invalid JSON payload in %s: %s", msg.Topic, err))
+			args["jsonError"] = err.Error()
+		} else {
+			args["json"] = v
+		}
+	}
+	return args
 }
 
 func (engine *RuleEngine) newTrackHandler(subTopic string) func(wbgong.MQTTMessage) {
 	return func(msg wbgong.MQTTMessage) {
-		var args objx.Map
-		if _, ok := engine.tracks[subTopic]; ok {
-			for _, tracker := range engine.tracks[subTopic] {
-				tr := tracker
-				args = objx.New(map[string]interface{}{
-					"topic": msg.Topic,
-					"value": msg.Payload,
-				})
-				engine.CallSync(func() {
-					tr.Callback(args)
-				})
+		// the trackers may be added or removed by the scripts
+		// while the message is handled
+		engine.mqttTrackerMutex.Lock()
+		trackers := make([]MqttTracker, 0, len(engine.tracks[subTopic]))
+		for _, tracker := range engine.tracks[subTopic] {
+			trackers = append(trackers, tracker)
+		}
+		engine.mqttTrackerMutex.Unlock()
+
+		if len(trackers) == 0 {
+			return
+		}
+		sort.Slice(trackers, func(i, j int) bool {
+			return trackers[i].ID < trackers[j].ID
+		})
+
+		engine.recordJournal(JournalEntry{
+			Kind:    JOURNAL_MQTT,
+			Topic:   msg.Topic,
+			Payload: msg.Payload,
+		})
+
+		var args, jsonArgs objx.Map
+		for _, tracker := range trackers {
+			tr := tracker
+			trArgs := args
+			if tr.ParseJSON {
+				if jsonArgs == nil {
+					jsonArgs = engine.mqttTrackerArgs(msg, true)
+				}
+				trArgs = jsonArgs
+			} else if args == nil {
+				args = engine.mqttTrackerArgs(msg, false)
+				trArgs = args
 			}
+			engine.CallSync(func() {
+				// the tracker may be removed
+				// while the message is queued
+				if engine.hasMqttTracker(subTopic, tr.ID) {
+					tr.Callback(trArgs)
+				}
+			})
 		}
 	}
 }
@@ -1747,7 +2265,7 @@ func (engine *RuleEngine) Log(level EngineLogLevel, message string) {
 		wbgong.Error.Printf("[rule error] %s", message)
 		topicItem = "error"
 	}
-	engine.Publish("/wbrules/log/"+topicItem, message, 1, false)
+	engine.publish("/wbrules/log/"+topicItem, message, 1, false)
 }
 
 func (engine *RuleEngine) Logf(level EngineLogLevel, format string, v ...interface{}) {
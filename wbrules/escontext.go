@@ -43,6 +43,14 @@ type ESContext struct {
 
 	ruleNames map[string]*Rule
 
+	// lastCallbackError holds the last error caught
+	// by invokeCallback, used for rule statistics
+	lastCallbackError *ESError
+
+	// currentRule is the name of the rule whose callback
+	// is being executed, used for dry-run logging
+	currentRule string
+
 	valid bool
 }
 
@@ -57,6 +65,9 @@ type ESError struct {
 type ESContextFactory struct {
 	duktapeToESContextMap map[duktape.Context]*ESContext
 	callbackIndex         ESCallback
+	// activeCtx is the context of the innermost Go
+	// function called from JS, nil outside such calls
+	activeCtx *ESContext
 }
 
 func newESContextFactory() *ESContextFactory {
@@ -81,6 +92,8 @@ func (f *ESContextFactory) newESContextFromDuktape(syncFunc ESSyncFunc, filename
 		nil,      // callbackErrorHandler
 		f,        // factory
 		make(map[string]*Rule),
+		nil,  // lastCallbackError
+		"",   // currentRule
 		true, // validation flag
 	}
 	ctx.callbackErrorHandler = ctx.DefaultCallbackErrorHandler
@@ -309,7 +322,9 @@ func (ctx *ESContext) invokeCallback(key ESCallback, args objx.Map) interface{}
 	}
 	defer ctx.Pop3() // pop: result, callback list object, global stash
 	if s := ctx.PcallProp(-2-argCount, argCount); s != 0 {
-		ctx.callbackErrorHandler(ctx.GetESError())
+		err := ctx.GetESError()
+		ctx.lastCallbackError = &err
+		ctx.callbackErrorHandler(err)
 		return nil
 	} else if ctx.IsBoolean(-1) {
 		return ctx.ToBoolean(-1)
@@ -487,6 +502,9 @@ func (ctx *ESContext) DefineFunctions(fns map[string]func(*ESContext) int) {
 		factory := ctx.factory
 		ctx.PushGoFunc(func(dctx *duktape.Context) int {
 			if ctx, ok := factory.duktapeToESContextMap[*dctx]; ok {
+				prevCtx := factory.activeCtx
+				factory.activeCtx = ctx
+				defer func() { factory.activeCtx = prevCtx }()
 				return f(ctx)
 			} else {
 				wbgong.Error.Panicf("No known conversion for duktape context to ESContext from %v", dctx)
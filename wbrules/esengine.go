@@ -3,13 +3,16 @@ package wbrules
 import (
 	"crypto/md5"
 	"encoding/base64"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"io/ioutil"
 	"log"
+	"math"
 	"os"
 	"path/filepath"
 	"sort"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
@@ -68,6 +71,7 @@ type ESEngineOptions struct {
 	PersistentDBFile     string
 	PersistentDBFileMode os.FileMode
 	ModulesDirs          []string
+	MaxHTTPRequests      int
 }
 
 func NewESEngineOptions() *ESEngineOptions {
@@ -77,6 +81,15 @@ func NewESEngineOptions() *ESEngineOptions {
 	}
 }
 
+// Copy returns a copy of the options which can be
+// changed without affecting the original ones
+func (o *ESEngineOptions) Copy() *ESEngineOptions {
+	c := *o
+	ruleOptions := *o.RuleEngineOptions
+	c.RuleEngineOptions = &ruleOptions
+	return &c
+}
+
 func (o *ESEngineOptions) SetPersistentDBFile(file string) {
 	o.PersistentDBFile = file
 }
@@ -89,6 +102,12 @@ func (o *ESEngineOptions) SetModulesDirs(dirs []string) {
 	o.ModulesDirs = dirs
 }
 
+// SetMaxHTTPRequests limits the number of http.request() calls
+// running at the same time, 0 means the default limit
+func (o *ESEngineOptions) SetMaxHTTPRequests(n int) {
+	o.MaxHTTPRequests = n
+}
+
 type TimerSet struct {
 	sync.Mutex
 	timers map[TimerId]bool
@@ -107,6 +126,11 @@ type ESEngine struct {
 	localCtxs  map[string]*ESContext // local scripts' contexts, mapped from script paths
 	ctxTimers  map[*ESContext]*TimerSet
 
+	// onUnload() hooks of the scripts
+	unloadHooks map[*ESContext][]ESCallbackFunc
+	processes   *processTracker
+	httpClient  *httpClient
+
 	sourceRoot      string
 	sources         map[string]*LocFileEntry // entries for all loaded files, including system files. Keys are abs paths
 	editableSources map[string]string        // map from virtual paths to abs paths for editable files
@@ -116,6 +140,7 @@ type ESEngine struct {
 	persistentDBCache map[string]string
 	persistentDB      *bolt.DB
 	modulesDirs       []string
+	moduleCache       map[string]*cachedModule // keys are module file paths
 }
 
 func init() {
@@ -138,14 +163,19 @@ func NewESEngine(driver wbgong.Driver, logMqttClient wbgong.MQTTClient, options
 		ctxFactory:        newESContextFactory(),
 		localCtxs:         make(map[string]*ESContext),
 		ctxTimers:         make(map[*ESContext]*TimerSet),
+		unloadHooks:       make(map[*ESContext][]ESCallbackFunc),
+		processes:         newProcessTracker(),
+		httpClient:        newHTTPClient(options.MaxHTTPRequests),
 		sources:           make(map[string]*LocFileEntry),
 		editableSources:   make(map[string]string),
 		tracker:           wbgong.NewContentTracker(),
 		persistentDBCache: make(map[string]string),
 		persistentDB:      nil,
 		modulesDirs:       options.ModulesDirs,
+		moduleCache:       make(map[string]*cachedModule),
 	}
 	engine.globalCtx = engine.ctxFactory.newESContext(engine.MaybeCallSync, "")
+	engine.SetDryRunScopeFunc(engine.activeDryRunScope)
 
 	if options.PersistentDBFile != "" {
 		if err = engine.SetPersistentDBMode(options.PersistentDBFile,
@@ -156,6 +186,10 @@ func NewESEngine(driver wbgong.Driver, logMqttClient wbgong.MQTTClient, options
 		engine.Log(ENGINE_LOG_INFO, fmt.Sprintf("using file %s for persistent DB", options.PersistentDBFile))
 	}
 
+	engine.SetRuleTagStateStorage(engine)
+	engine.SetAstroLocationStorage(engine)
+	engine.SetPersistentTimerStorage(engine)
+
 	engine.globalCtx.SetCallbackErrorHandler(engine.CallbackErrorHandler)
 
 	// init modSearch for global
@@ -188,7 +222,15 @@ func NewESEngine(driver wbgong.Driver, logMqttClient wbgong.MQTTClient, options
 		"_wbStartTimer":        engine.esWbStartTimer,
 		"_wbStopTimer":         engine.esWbStopTimer,
 		"_wbCheckCurrentTimer": engine.esWbCheckCurrentTimer,
+		"_wbCheckLateTimer":    engine.esWbCheckLateTimer,
+		"_wbPersistentTimer":   engine.esWbPersistentTimer,
+		"_wbTimerRemaining":    engine.esWbTimerRemaining,
+		"_wbPauseTimer":        engine.esWbPauseTimer,
+		"_wbResumeTimer":       engine.esWbResumeTimer,
+		"_wbRestartTimer":      engine.esWbRestartTimer,
 		"_wbSpawn":             engine.esWbSpawn,
+		"_wbRpcCall":           engine.esWbRpcCall,
+		"_wbHttpRequest":       engine.esWbHttpRequest,
 		"_wbDefineRule":        engine.esWbDefineRule,
 		"runRules":             engine.esWbRunRules,
 		"readConfig":           engine.esReadConfig,
@@ -202,6 +244,9 @@ func NewESEngine(driver wbgong.Driver, logMqttClient wbgong.MQTTClient, options
 		"getControl":           engine.esGetControl,
 		"_wbPersistentName":    engine.esPersistentName,
 		"trackMqtt":            engine.trackMqtt,
+		"untrackMqtt":          engine.untrackMqtt,
+		"scheduled":            engine.esScheduled,
+		"onUnload":             engine.esOnUnload,
 	})
 	engine.globalCtx.GetPropString(-1, "log")
 	engine.globalCtx.DefineFunctions(map[string]func(*ESContext) int{
@@ -238,10 +283,28 @@ func NewESEngine(driver wbgong.Driver, logMqttClient wbgong.MQTTClient, options
 	return
 }
 
+// DefineGlobalFunctions adds the functions to the global object
+// shared by all the scripts, e.g. the test API. It must be called
+// before the scripts using the functions are loaded
+func (engine *ESEngine) DefineGlobalFunctions(fns map[string]func(*ESContext) int) {
+	done := make(chan struct{})
+	engine.WhenEngineReady(func() {
+		engine.globalCtx.PushGlobalObject()
+		engine.globalCtx.DefineFunctions(fns)
+		engine.globalCtx.Pop()
+		close(done)
+	})
+	<-done
+}
+
 func (engine *ESEngine) exportModSearch(ctx *ESContext) {
 	ctx.GetGlobalString("Duktape")
 	ctx.PushGoFunc(func(c *duktape.Context) int {
-		return engine.ModSearch(c)
+		path, r := engine.modSearch(c)
+		if path != "" {
+			engine.addModuleDependency(ctx, path)
+		}
+		return r
 	})
 	ctx.PutPropString(-2, "modSearch")
 	ctx.Pop()
@@ -451,7 +514,14 @@ func (engine *ESEngine) buildSingleWhenChangedRuleCondition(ctx *ESContext, defI
 		controlFullId := ctx.SafeToString(defIndex)
 		parts := strings.SplitN(controlFullId, "/", 2)
 		if len(parts) != 2 {
-			return nil, fmt.Errorf("invalid whenChanged spec: '%s'", controlFullId)
+			// lib.js resolves known aliases, so the rule
+			// is kept but never fires for this one
+			engine.scriptWarning(ctx, "invalid cell alias in whenChanged: %s", controlFullId)
+			return NewCellChangedRuleCondition(ControlSpec{"", controlFullId})
+		}
+		if !isValidControlRef(parts[0], parts[1]) {
+			engine.scriptWarning(ctx, "invalid control reference in whenChanged: '%s', "+
+				"must be 'device/control'", controlFullId)
 		}
 		return NewCellChangedRuleCondition(ControlSpec{parts[0], parts[1]})
 	}
@@ -492,6 +562,14 @@ func (engine *ESEngine) buildRuleCond(ctx *ESContext, defIndex int) (RuleConditi
 	hasWhenChanged := ctx.HasPropString(defIndex, "whenChanged")
 	hasCron := ctx.HasPropString(defIndex, "_cron")
 
+	if ctx.HasPropString(defIndex, "for") {
+		if hasWhenChanged || hasCron || hasWhen == hasAsSoonAs {
+			return nil, errors.New(
+				"invalid rule -- 'for' may only be used with either 'when' or 'asSoonAs'")
+		}
+		return engine.buildDurationRuleCond(ctx, defIndex, hasWhen)
+	}
+
 	switch {
 	case hasWhen && (hasAsSoonAs || hasWhenChanged || hasCron):
 		// _cron is added by lib.js. Under normal circumstances
@@ -519,7 +597,12 @@ func (engine *ESEngine) buildRuleCond(ctx *ESContext, defIndex int) (RuleConditi
 	case hasCron:
 		ctx.GetPropString(defIndex, "_cron")
 		defer ctx.Pop()
-		return NewCronRuleCondition(ctx.SafeToString(-1)), nil
+		spec := ctx.SafeToString(-1)
+		if _, err := engine.ParseCronSpec(spec); err != nil {
+			// such rule never fires
+			engine.scriptWarning(ctx, "invalid cron spec '%s': %s", spec, err)
+		}
+		return NewCronRuleCondition(spec), nil
 
 	default:
 		return nil, errors.New(
@@ -527,20 +610,188 @@ func (engine *ESEngine) buildRuleCond(ctx *ESContext, defIndex int) (RuleConditi
 	}
 }
 
+func (engine *ESEngine) buildDurationRuleCond(ctx *ESContext, defIndex int, levelTriggered bool) (RuleCondition, error) {
+	ctx.GetPropString(defIndex, "for")
+	isNumber, ms := ctx.IsNumber(-1), ctx.GetNumber(-1)
+	ctx.Pop()
+	if !isNumber || ms <= 0 {
+		return nil, errors.New("invalid rule -- 'for' must be a positive number of milliseconds")
+	}
+	if ms < MIN_INTERVAL_MS {
+		ms = MIN_INTERVAL_MS
+	}
+
+	condProp := "asSoonAs"
+	if levelTriggered {
+		condProp = "when"
+	}
+	return NewDurationRuleCondition(engine.wrapRuleCondFunc(ctx, defIndex, condProp), levelTriggered,
+		time.Duration(ms*float64(time.Millisecond)),
+		engine.ruleTimerFunc(ctx), engine.StopTimerByIndex), nil
+}
+
+// ruleTimerFunc returns a function starting the timers used
+// internally by the rules defined in the specified context.
+// Such timers are stopped along with other script timers
+func (engine *ESEngine) ruleTimerFunc(ctx *ESContext) RuleTimerFunc {
+	return func(interval time.Duration, callback func()) TimerId {
+		timerId := engine.StartTimer(NO_TIMER_NAME, callback, interval, false)
+		engine.SetTimerScript(timerId, engine.currentSourceLocation(ctx).File)
+		engine.handleTimerCleanup(ctx, timerId)
+		return timerId
+	}
+}
+
 func (engine *ESEngine) buildRule(ctx *ESContext, name string, defIndex int) (*Rule, error) {
 	if !ctx.HasPropString(defIndex, "then") {
 		// this should be handled by lib.js
 		return nil, errors.New("invalid rule -- no then")
 	}
 	then := engine.wrapRuleCallback(ctx, defIndex, "then")
-	if cond, err := engine.buildRuleCond(ctx, defIndex); err != nil {
+	cond, err := engine.buildRuleCond(ctx, defIndex)
+	if err != nil {
 		return nil, err
-	} else {
-		ruleId := engine.nextRuleId
-		engine.nextRuleId++
+	}
+	limiter, err := engine.buildRuleLimiter(ctx, defIndex)
+	if err != nil {
+		return nil, err
+	}
+
+	priority, err := getOptionalIntProp(ctx, defIndex, "priority", 0)
+	if err != nil {
+		return nil, err
+	}
+	tags, err := engine.buildRuleTags(ctx, defIndex)
+	if err != nil {
+		return nil, err
+	}
+
+	ruleId := engine.nextRuleId
+	engine.nextRuleId++
+
+	rule := NewRule(engine, ruleId, name, cond, then)
+	rule.SetPriority(priority)
+	rule.SetTags(tags)
+	if limiter != nil {
+		rule.SetLimiter(limiter)
+	}
+	if durationCond, ok := cond.(*DurationRuleCondition); ok {
+		durationCond.SetOnElapsed(func() {
+			engine.CheckRule(rule)
+		})
+	}
+	return rule, nil
+}
+
+// getOptionalBoolProp returns the value of boolean property
+// of the object or the default value if it's not set
+func getOptionalBoolProp(ctx *ESContext, objIndex int, name string, defValue bool) (bool, error) {
+	if !ctx.HasPropString(objIndex, name) {
+		return defValue, nil
+	}
+	ctx.GetPropString(objIndex, name)
+	defer ctx.Pop()
+	if ctx.IsUndefined(-1) {
+		return defValue, nil
+	}
+	if !ctx.IsBoolean(-1) {
+		return false, fmt.Errorf("'%s' must be boolean", name)
+	}
+	return ctx.GetBoolean(-1), nil
+}
 
-		return NewRule(engine, ruleId, name, cond, then), nil
+// getOptionalIntProp returns the value of integer property
+// of the object or the default value if it's not set
+func getOptionalIntProp(ctx *ESContext, objIndex int, name string, defValue int) (int, error) {
+	if !ctx.HasPropString(objIndex, name) {
+		return defValue, nil
+	}
+	ctx.GetPropString(objIndex, name)
+	defer ctx.Pop()
+	if ctx.IsUndefined(-1) {
+		return defValue, nil
+	}
+	if !ctx.IsNumber(-1) {
+		return 0, fmt.Errorf("'%s' must be a number", name)
 	}
+	v := ctx.GetNumber(-1)
+	if v != math.Trunc(v) {
+		return 0, fmt.Errorf("'%s' must be an integer", name)
+	}
+	return int(v), nil
+}
+
+func (engine *ESEngine) buildRuleTags(ctx *ESContext, defIndex int) ([]*RuleTag, error) {
+	if !ctx.HasPropString(defIndex, "tags") {
+		return nil, nil
+	}
+	ctx.GetPropString(defIndex, "tags")
+	defer ctx.Pop()
+	if ctx.IsUndefined(-1) {
+		return nil, nil
+	}
+	if !ctx.IsArray(-1) {
+		return nil, errors.New("invalid rule -- 'tags' must be an array of strings")
+	}
+
+	names := ctx.StringArrayToGo(-1)
+	tags := make([]*RuleTag, 0, len(names))
+	for _, name := range names {
+		if name == "" {
+			return nil, errors.New("invalid rule -- empty tag name")
+		}
+		tag, err := engine.RuleTag(name)
+		if err != nil {
+			return nil, fmt.Errorf("can't create tag '%s': %s", name, err)
+		}
+		tags = append(tags, tag)
+	}
+	return tags, nil
+}
+
+func (engine *ESEngine) buildRuleLimiter(ctx *ESContext, defIndex int) (*RuleLimiter, error) {
+	hasDebounce := ctx.HasPropString(defIndex, "debounce")
+	hasThrottle := ctx.HasPropString(defIndex, "throttle")
+
+	var kind RuleLimiterKind
+	var prop string
+	switch {
+	case hasDebounce && hasThrottle:
+		return nil, errors.New("invalid rule -- cannot combine 'debounce' with 'throttle'")
+	case hasDebounce:
+		kind, prop = RULE_LIMIT_DEBOUNCE, "debounce"
+	case hasThrottle:
+		kind, prop = RULE_LIMIT_THROTTLE, "throttle"
+	default:
+		return nil, nil
+	}
+
+	ctx.GetPropString(defIndex, prop)
+	isNumber, ms := ctx.IsNumber(-1), ctx.GetNumber(-1)
+	ctx.Pop()
+	if !isNumber || ms <= 0 {
+		return nil, fmt.Errorf("invalid rule -- '%s' must be a positive number of milliseconds", prop)
+	}
+	if ms < MIN_INTERVAL_MS {
+		ms = MIN_INTERVAL_MS
+	}
+
+	// debounce fires on the trailing edge by default,
+	// throttle fires on both edges
+	leading, err := getOptionalBoolProp(ctx, defIndex, "leading", kind == RULE_LIMIT_THROTTLE)
+	if err != nil {
+		return nil, fmt.Errorf("invalid rule -- %s", err)
+	}
+	trailing, err := getOptionalBoolProp(ctx, defIndex, "trailing", true)
+	if err != nil {
+		return nil, fmt.Errorf("invalid rule -- %s", err)
+	}
+	if !leading && !trailing {
+		return nil, errors.New("invalid rule -- 'leading' and 'trailing' cannot be both false")
+	}
+
+	return NewRuleLimiter(kind, time.Duration(ms*float64(time.Millisecond)),
+		leading, trailing, engine.ruleTimerFunc(ctx), engine.StopTimerByIndex), nil
 }
 
 func (engine *ESEngine) loadLib() error {
@@ -578,6 +829,41 @@ func (engine *ESEngine) registerSourceItem(ctx *ESContext, typ itemType, name st
 		log.Panicf("bad source item type %d", typ)
 	}
 
+	line := currentSourceLine(ctx, currentPath)
+	if line == -1 {
+		return
+	}
+	*items = append(*items, LocItem{line, name})
+}
+
+// scriptWarning reports a problem in the script being loaded which
+// doesn't prevent it from working, e.g. a rule that never fires
+func (engine *ESEngine) scriptWarning(ctx *ESContext, format string, v ...interface{}) {
+	message := fmt.Sprintf(format, v...)
+	currentPath := ctx.GetCurrentFilename()
+	line := currentSourceLine(ctx, currentPath)
+	wbgong.Warn.Printf("%s:%d: %s", currentPath, line, message)
+
+	if currentSource := engine.sources[currentPath]; currentSource != nil {
+		currentSource.Warnings = append(currentSource.Warnings, ScriptWarning{line, message})
+	}
+}
+
+// isValidControlRef checks 'device/control' or 'device/control#meta'
+// reference split by the first slash
+func isValidControlRef(devId, ctrlId string) bool {
+	if i := strings.IndexByte(ctrlId, '#'); i >= 0 {
+		if i == len(ctrlId)-1 {
+			return false
+		}
+		ctrlId = ctrlId[:i]
+	}
+	return devId != "" && ctrlId != "" && !strings.Contains(ctrlId, "/")
+}
+
+// currentSourceLine returns the line of the specified script
+// which is being executed now or -1 if it's not on the stack
+func currentSourceLine(ctx *ESContext, currentPath string) int {
 	line := -1
 	for _, loc := range ctx.GetTraceback() {
 		// Here we depend upon the fact that duktape displays
@@ -586,10 +872,25 @@ func (engine *ESEngine) registerSourceItem(ctx *ESContext, typ itemType, name st
 			line = loc.line
 		}
 	}
-	if line == -1 {
+	return line
+}
+
+// currentSourceLocation returns the location of the statement
+// being executed in the current script, using virtual path
+// for editable scripts
+func (engine *ESEngine) currentSourceLocation(ctx *ESContext) (loc SourceLocation) {
+	currentPath := ctx.GetCurrentFilename()
+	if currentPath == "" {
 		return
 	}
-	*items = append(*items, LocItem{line, name})
+	loc.File = currentPath
+	if entry := engine.sources[currentPath]; entry != nil && entry.VirtualPath != "" {
+		loc.File = entry.VirtualPath
+	}
+	if line := currentSourceLine(ctx, currentPath); line != -1 {
+		loc.Line = line
+	}
+	return
 }
 
 func (engine *ESEngine) ListSourceFiles() (entries []LocFileEntry, err error) {
@@ -784,7 +1085,16 @@ func (engine *ESEngine) loadScript(path string, loadIfUnchanged bool) (bool, err
 	newLocalCtx := engine.prepareNewContext(path)
 	currentSource.Context = newLocalCtx
 
-	return true, engine.trackESError(path, newLocalCtx.LoadScenario(path))
+	err = engine.trackESError(path, newLocalCtx.LoadScenario(path))
+
+	// the persistent timers started by the script itself
+	// while loading take precedence over the stored ones
+	script := engine.currentSourceLocation(newLocalCtx).File
+	for _, timerId := range engine.RestorePersistentTimers(script) {
+		engine.handleTimerCleanup(newLocalCtx, timerId)
+	}
+
+	return true, err
 }
 
 func (engine *ESEngine) trackESError(path string, err error) error {
@@ -820,11 +1130,16 @@ func (engine *ESEngine) maybePublishUpdate(subtopic, physicalPath string) {
 		wbgong.Error.Printf("checkSourcePath() failed for %s: %s", physicalPath, err)
 	}
 	if underSourceRoot {
-		engine.Publish("/wbrules/updates/"+subtopic, virtualPath, 1, false)
+		engine.publish("/wbrules/updates/"+subtopic, virtualPath, 1, false)
 	}
 }
 
 func (engine *ESEngine) runCleanups(path string) {
+	// the hooks run while the rules and devices of the script exist
+	if localCtx, ok := engine.localCtxs[path]; ok {
+		engine.runUnloadHooks(localCtx)
+	}
+
 	// run rules cleanups
 	engine.cleanup.RunCleanups(path)
 
@@ -912,9 +1227,15 @@ func (engine *ESEngine) LiveRemoveFile(path string) error {
 		return err
 	}
 
+	script := virtualPath
+	if script == "" {
+		script = path
+	}
+
 	engine.WhenEngineReady(func() {
 		engine.tracker.Untrack(virtualPath)
 		engine.runCleanups(path)
+		engine.ForgetPersistentTimers(script)
 		engine.Refresh()
 		engine.maybePublishUpdate("removed", path)
 	})
@@ -1088,6 +1409,16 @@ func (engine *ESEngine) esDefineVirtualDevice(ctx *ESContext) int {
 	name := ctx.GetString(0)
 	obj := ctx.GetJSObject(1).(objx.Map)
 
+	for _, prop := range []string{VDEV_DESCR_PROP_CELLS, VDEV_DESCR_PROP_CONTROLS} {
+		if controls, ok := obj[prop].(map[string]interface{}); ok {
+			for ctrlId, ctrlDef := range controls {
+				if def, ok := ctrlDef.(map[string]interface{}); ok {
+					engine.fixDeprecatedWriteable(ctx, name, ctrlId, def)
+				}
+			}
+		}
+	}
+
 	if err := engine.DefineVirtualDevice(name, obj); err != nil {
 		wbgong.Error.Printf("device definition error: %s", err)
 		ctx.PushErrorObject(duktape.DUK_ERR_ERROR, err.Error())
@@ -1129,6 +1460,23 @@ func (engine *ESEngine) esDefineVirtualDevice(ctx *ESContext) int {
 	return 1
 }
 
+// fixDeprecatedWriteable replaces deprecated 'writeable' flag
+// of the control definition with 'readonly' one
+func (engine *ESEngine) fixDeprecatedWriteable(ctx *ESContext, devId, ctrlId string, ctrlDef map[string]interface{}) {
+	writeable, found := ctrlDef[VDEV_CONTROL_DESCR_PROP_WRITEABLE]
+	if !found {
+		return
+	}
+	engine.scriptWarning(ctx, "%s/%s: writeable flag is deprecated, use readonly instead: "+
+		"https://github.com/contactless/wb-rules/blob/master/README-readonly.md", devId, ctrlId)
+	delete(ctrlDef, VDEV_CONTROL_DESCR_PROP_WRITEABLE)
+	if _, hasReadonly := ctrlDef[VDEV_CONTROL_DESCR_PROP_READONLY]; !hasReadonly {
+		if w, ok := writeable.(bool); ok {
+			ctrlDef[VDEV_CONTROL_DESCR_PROP_READONLY] = !w
+		}
+	}
+}
+
 func (engine *ESEngine) esVdevIsVirtual(ctx *ESContext) int {
 	// push this
 	ctx.PushThis()
@@ -1411,6 +1759,7 @@ func (engine *ESEngine) esVdevAddControl(ctx *ESContext) int {
 
 	ctx.Pop()
 
+	engine.fixDeprecatedWriteable(ctx, devId, ctrlId, ctrlDef)
 	errControl := engine.AddControl(devId, ctrlId, ctrlDef)
 	if errControl != nil {
 		wbgong.Error.Printf("Error in creating control %s on device %s: %s", ctrlId, devId, errControl)
@@ -1699,6 +2048,45 @@ func (engine *ESEngine) esPublish(ctx *ESContext) int {
 	return 0
 }
 
+// maybeDryRun logs the action instead of executing it if the
+// dry-run mode is enabled for the script being executed
+func (engine *ESEngine) maybeDryRun(ctx *ESContext, format string, v ...interface{}) bool {
+	where, dryRun := engine.dryRunScope(ctx)
+	if dryRun {
+		engine.LogDryRun(where, format, v...)
+	}
+	return dryRun
+}
+
+// activeDryRunScope is the dry-run scope of the script
+// which calls into the engine, if any
+func (engine *ESEngine) activeDryRunScope() (where string, dryRun bool) {
+	if ctx := engine.ctxFactory.activeCtx; ctx != nil {
+		return engine.dryRunScope(ctx)
+	}
+	return "", false
+}
+
+// dryRunScope returns the description of the script and the rule
+// being executed in the context if the script runs in dry-run mode
+func (engine *ESEngine) dryRunScope(ctx *ESContext) (where string, dryRun bool) {
+	filename := ctx.GetCurrentFilename()
+	if !engine.IsDryRun(filename) {
+		return "", false
+	}
+
+	where = filename
+	if engine.sourceRoot != "" && wbgong.IsSubpath(engine.sourceRoot, filename) {
+		if rel, err := filepath.Rel(engine.sourceRoot, filename); err == nil {
+			where = rel
+		}
+	}
+	if ctx.currentRule != "" {
+		where = fmt.Sprintf("%s, rule %s", where, ctx.currentRule)
+	}
+	return where, true
+}
+
 func (engine *ESEngine) esWbDevObject(ctx *ESContext) int {
 	if wbgong.DebuggingEnabled() {
 		wbgong.Debug.Printf("esWbDevObject(): top=%d isString=%v", ctx.GetTop(), ctx.IsString(-1))
@@ -1848,6 +2236,7 @@ func (engine *ESEngine) esWbStartTimer(ctx *ESContext) int {
 
 	// get timer id
 	timerId := engine.StartTimer(name, callback, interval, periodic)
+	engine.SetTimerScript(timerId, engine.currentSourceLocation(ctx).File)
 
 	// add timer to script cleanup
 	engine.handleTimerCleanup(ctx, timerId)
@@ -1856,6 +2245,40 @@ func (engine *ESEngine) esWbStartTimer(ctx *ESContext) int {
 	return 1
 }
 
+func (engine *ESEngine) esWbPersistentTimer(ctx *ESContext) int {
+	if ctx.GetTop() != 2 || !ctx.IsString(0) || !ctx.IsNumber(1) {
+		wbgong.Error.Println("bad _wbPersistentTimer call")
+		return duktape.DUK_RET_ERROR
+	}
+
+	name := ctx.ToString(0)
+	if name == "" {
+		wbgong.Error.Println("empty timer name")
+		return duktape.DUK_RET_ERROR
+	}
+
+	ms := ctx.GetNumber(1)
+	if ms < MIN_INTERVAL_MS {
+		ms = MIN_INTERVAL_MS
+	}
+	interval := time.Duration(ms * float64(time.Millisecond))
+
+	timerId := engine.StartPersistentTimer(name, engine.currentSourceLocation(ctx).File, interval)
+
+	// the timer is stopped along with other script timers,
+	// but its state is kept to restore it when the script
+	// is loaded again
+	engine.handleTimerCleanup(ctx, timerId)
+
+	ctx.PushNumber(float64(timerId))
+	return 1
+}
+
+func (engine *ESEngine) esScheduled(ctx *ESContext) int {
+	ctx.PushJSObject(engine.Schedule().jsObject())
+	return 1
+}
+
 func (engine *ESEngine) esWbStopTimer(ctx *ESContext) int {
 	if ctx.GetTop() != 1 {
 		return duktape.DUK_RET_ERROR
@@ -1884,6 +2307,63 @@ func (engine *ESEngine) esWbCheckCurrentTimer(ctx *ESContext) int {
 	return 1
 }
 
+func (engine *ESEngine) esWbCheckLateTimer(ctx *ESContext) int {
+	if ctx.GetTop() != 1 || !ctx.IsString(0) {
+		return duktape.DUK_RET_ERROR
+	}
+	ctx.PushBoolean(engine.CheckTimerLate(ctx.ToString(0)))
+	return 1
+}
+
+func (engine *ESEngine) esWbTimerRemaining(ctx *ESContext) int {
+	if ctx.GetTop() != 1 || !ctx.IsString(0) {
+		return duktape.DUK_RET_ERROR
+	}
+	var remaining time.Duration
+	if n, found := engine.FindTimerByName(ctx.ToString(0)); found {
+		remaining, _ = engine.TimerRemaining(n)
+	}
+	ctx.PushNumber(durationToMs(remaining))
+	return 1
+}
+
+func (engine *ESEngine) esWbPauseTimer(ctx *ESContext) int {
+	if ctx.GetTop() != 1 || !ctx.IsString(0) {
+		return duktape.DUK_RET_ERROR
+	}
+	n, found := engine.FindTimerByName(ctx.ToString(0))
+	ctx.PushBoolean(found && engine.PauseTimer(n))
+	return 1
+}
+
+func (engine *ESEngine) esWbResumeTimer(ctx *ESContext) int {
+	if ctx.GetTop() != 1 || !ctx.IsString(0) {
+		return duktape.DUK_RET_ERROR
+	}
+	n, found := engine.FindTimerByName(ctx.ToString(0))
+	ctx.PushBoolean(found && engine.ResumeTimer(n))
+	return 1
+}
+
+func (engine *ESEngine) esWbRestartTimer(ctx *ESContext) int {
+	if ctx.GetTop() != 2 || !ctx.IsString(0) || !ctx.IsNumber(1) {
+		return duktape.DUK_RET_ERROR
+	}
+
+	// zero interval keeps the interval of the timer
+	var interval time.Duration
+	if ms := ctx.GetNumber(1); ms > 0 {
+		if ms < MIN_INTERVAL_MS {
+			ms = MIN_INTERVAL_MS
+		}
+		interval = time.Duration(ms * float64(time.Millisecond))
+	}
+
+	n, found := engine.FindTimerByName(ctx.ToString(0))
+	ctx.PushBoolean(found && engine.RestartTimer(n, interval))
+	return 1
+}
+
 func (engine *ESEngine) esWbSpawn(ctx *ESContext) int {
 	if ctx.GetTop() != 5 || !ctx.IsArray(0) || !ctx.IsBoolean(2) ||
 		!ctx.IsBoolean(3) {
@@ -1913,8 +2393,19 @@ func (engine *ESEngine) esWbSpawn(ctx *ESContext) int {
 
 	captureOutput := ctx.GetBoolean(2)
 	captureErrorOutput := ctx.GetBoolean(3)
+	dryRun := engine.maybeDryRun(ctx, "spawn %s", strings.Join(args, " "))
+	engine.processes.wg.Add(1)
 	go func() {
-		r, err := Spawn(args[0], args[1:], captureOutput, captureErrorOutput, input)
+		defer engine.processes.wg.Done()
+		var r *CommandResult
+		var err error
+		if dryRun {
+			// pretend the command succeeded so the callback
+			// logic can be checked, too
+			r = &CommandResult{}
+		} else {
+			r, err = spawnTracked(engine.processes, args[0], args[1:], captureOutput, captureErrorOutput, input)
+		}
 		if err != nil {
 			wbgong.Error.Printf("external command failed: %s", err)
 			return
@@ -1945,6 +2436,149 @@ func (engine *ESEngine) esWbSpawn(ctx *ESContext) int {
 	return 0
 }
 
+// esWbRpcCall calls MQTT RPC method of another driver (from JS)
+//
+// Arguments:
+// 0 - driver id
+// 1 - service
+// 2 - method
+// 3 - params as JSON string
+// 4 - timeout in milliseconds, 0 for default
+// 5 - callback receiving {result} with result JSON or {error}, may be null
+func (engine *ESEngine) esWbRpcCall(ctx *ESContext) int {
+	if ctx.GetTop() != 6 || !ctx.IsString(0) || !ctx.IsString(1) ||
+		!ctx.IsString(2) || !ctx.IsString(3) || !ctx.IsNumber(4) {
+		return duktape.DUK_RET_TYPE_ERROR
+	}
+
+	callbackFn := ESCallbackFunc(nil)
+	if ctx.IsFunction(5) {
+		callbackFn = ctx.WrapCallback(5)
+	} else if !ctx.IsNullOrUndefined(5) {
+		return duktape.DUK_RET_TYPE_ERROR
+	}
+
+	driver, service, method := ctx.GetString(0), ctx.GetString(1), ctx.GetString(2)
+	params := ctx.GetString(3)
+	timeout := time.Duration(ctx.GetNumber(4)) * time.Millisecond
+	if engine.maybeDryRun(ctx, "rpcCall %s/%s/%s %s", driver, service, method, params) {
+		return 0
+	}
+
+	err := engine.CallRPC(driver, service, method, json.RawMessage(params), timeout,
+		func(result json.RawMessage, rpcErr *RPCError) {
+			if callbackFn == nil {
+				if rpcErr != nil {
+					wbgong.Error.Printf("rpcCall %s/%s/%s failed: %s", driver, service, method, rpcErr.Message)
+				}
+				return
+			}
+
+			// check that context is still alive
+			// (file is not removed or reloaded)
+			if !ctx.IsValid() {
+				wbgong.Info.Println("ignore rpcCall callback without Duktape context (maybe script is reloaded or removed)")
+				return
+			}
+
+			args := objx.New(map[string]interface{}{})
+			if rpcErr != nil {
+				errObj := map[string]interface{}{
+					"code":    rpcErr.Code,
+					"message": rpcErr.Message,
+					"timeout": rpcErr.Timeout,
+				}
+				if len(rpcErr.Data) != 0 {
+					errObj["data"] = string(rpcErr.Data)
+				}
+				args["error"] = errObj
+			} else {
+				args["result"] = string(result)
+			}
+			callbackFn(args)
+		})
+	if err != nil {
+		ctx.PushErrorObject(duktape.DUK_ERR_ERROR, err.Error())
+		return duktape.DUK_RET_INSTACK_ERROR
+	}
+	return 0
+}
+
+// esWbHttpRequest performs HTTP request in background (from JS)
+//
+// Arguments:
+// 0 - request options as JSON string
+// 1 - callback receiving {response} or {error}, may be null
+func (engine *ESEngine) esWbHttpRequest(ctx *ESContext) int {
+	if ctx.GetTop() != 2 || !ctx.IsString(0) {
+		return duktape.DUK_RET_TYPE_ERROR
+	}
+
+	callbackFn := ESCallbackFunc(nil)
+	if ctx.IsFunction(1) {
+		callbackFn = ctx.WrapCallback(1)
+	} else if !ctx.IsNullOrUndefined(1) {
+		return duktape.DUK_RET_TYPE_ERROR
+	}
+
+	var options httpRequestOptions
+	if err := json.Unmarshal([]byte(ctx.GetString(0)), &options); err != nil {
+		ctx.PushErrorObject(duktape.DUK_ERR_ERROR, fmt.Sprintf("http.request: bad options: %s", err))
+		return duktape.DUK_RET_INSTACK_ERROR
+	}
+	if options.URL == "" {
+		ctx.PushErrorObject(duktape.DUK_ERR_ERROR, "http.request: no url specified")
+		return duktape.DUK_RET_INSTACK_ERROR
+	}
+
+	if engine.maybeDryRun(ctx, "http.request %s %s", options.Method, options.URL) {
+		return 0
+	}
+
+	go func() {
+		resp, err := engine.httpClient.do(&options)
+		if callbackFn == nil {
+			if err != nil {
+				wbgong.Error.Printf("http.request failed: %s", err)
+			}
+			return
+		}
+		engine.CallSync(func() {
+			// check that context is still alive
+			// (file is not removed or reloaded)
+			if !ctx.IsValid() {
+				wbgong.Info.Println("ignore http.request callback without Duktape context (maybe script is reloaded or removed)")
+				return
+			}
+
+			args := objx.New(map[string]interface{}{})
+			if err != nil {
+				args["error"] = err.Error()
+			} else {
+				headers := make(map[string]interface{}, len(resp.Headers))
+				for name, value := range resp.Headers {
+					headers[name] = value
+				}
+				args["response"] = map[string]interface{}{
+					"status":  resp.Status,
+					"headers": headers,
+					"body":    resp.Body,
+				}
+			}
+			callbackFn(args)
+		})
+	}()
+	return 0
+}
+
+func (engine *ESEngine) esOnUnload(ctx *ESContext) int {
+	if ctx.GetTop() != 1 || !ctx.IsFunction(0) {
+		return duktape.DUK_RET_ERROR
+	}
+	engine.unloadHooks[ctx] = append(engine.unloadHooks[ctx], ctx.WrapCallback(0))
+	return 0
+}
+
 func (engine *ESEngine) esWbDefineRule(ctx *ESContext) int {
 	var ok = false
 	var name string
@@ -1987,6 +2621,8 @@ func (engine *ESEngine) esWbDefineRule(ctx *ESContext) int {
 		return duktape.DUK_RET_ERROR
 	}
 
+	rule.location = engine.currentSourceLocation(ctx)
+
 	if ruleId, err = engine.DefineRule(rule, ctx); err != nil {
 		engine.Log(ENGINE_LOG_ERROR,
 			fmt.Sprintf("defineRule error: %s", err))
@@ -2000,21 +2636,56 @@ func (engine *ESEngine) esWbDefineRule(ctx *ESContext) int {
 	return 1
 }
 
+// trackMqtt subscribes to the topic (from JS)
+//
+// Arguments:
+// 1 - topic
+// 2 - callback
+// 3 - options (optional): {json: true} to parse the payloads as JSON
+//
+// Returns the tracker id for untrackMqtt()
 func (engine *ESEngine) trackMqtt(ctx *ESContext) int {
-	if !(ctx.IsString(0) && ctx.IsFunction(1)) {
+	if !(ctx.IsString(0) && ctx.IsFunction(1)) ||
+		(ctx.GetTop() > 2 && !ctx.IsNullOrUndefined(2) && !ctx.IsObject(2)) {
 		engine.Log(ENGINE_LOG_ERROR, fmt.Sprintf("bad track definition"))
 		return duktape.DUK_RET_ERROR
 	}
 	topic := ctx.GetString(0)
 
+	parseJSON := false
+	if ctx.GetTop() > 2 && ctx.IsObject(2) {
+		if options, ok := ctx.GetJSObject(2).(objx.Map); ok {
+			parseJSON, _ = options["json"].(bool)
+		}
+	}
+
 	currentFilename := ctx.GetCurrentFilename()
 	if currentFilename != "" {
 		engine.cleanup.PushCleanupScope(currentFilename)
 		defer engine.cleanup.PopCleanupScope(currentFilename)
 	}
 
-	engine.DefineMqttTracker(topic, ctx)
+	trackerID, err := engine.DefineMqttTracker(topic, ctx.WrapCallback(1), parseJSON)
+	if err != nil {
+		ctx.PushErrorObject(duktape.DUK_ERR_ERROR, err.Error())
+		return duktape.DUK_RET_INSTACK_ERROR
+	}
+
+	ctx.PushNumber(float64(trackerID))
+	return 1
+}
 
+// untrackMqtt removes the tracker created by trackMqtt() (from JS)
+//
+// Arguments:
+// 1 - tracker id
+//
+// Returns false if there's no such tracker
+func (engine *ESEngine) untrackMqtt(ctx *ESContext) int {
+	if ctx.GetTop() != 1 || !ctx.IsNumber(0) {
+		return duktape.DUK_RET_TYPE_ERROR
+	}
+	ctx.PushBoolean(engine.RemoveMqttTracker(uint32(ctx.GetNumber(0))))
 	return 1
 }
 
@@ -2088,7 +2759,7 @@ func (engine *ESEngine) esWbRunRule(ctx *ESContext) int {
 	ruleId := RuleId(ctx.GetInt(0))
 
 	if rule, found := engine.ruleMap[ruleId]; found {
-		rule.then(nil)
+		rule.Fire(nil)
 	} else {
 		engine.Log(ENGINE_LOG_ERROR, fmt.Sprintf("trying to call runRule for undefined rule: %d", ruleId))
 		return duktape.DUK_RET_ERROR
@@ -2178,6 +2849,172 @@ func (engine *ESEngine) ClosePersistentDB() (err error) {
 	return
 }
 
+// LoadRuleTagState reads the state of the rule tag
+// from persistent DB
+func (engine *ESEngine) LoadRuleTagState(name string) (enabled, found bool) {
+	if engine.persistentDB == nil {
+		return
+	}
+	engine.persistentDB.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(RULE_TAGS_DB_BUCKET))
+		if b == nil {
+			return nil
+		}
+		if v := b.Get([]byte(name)); v != nil {
+			enabled, found = string(v) == "true", true
+		}
+		return nil
+	})
+	return
+}
+
+// StoreRuleTagState writes the state of the rule tag
+// down to persistent DB
+func (engine *ESEngine) StoreRuleTagState(name string, enabled bool) {
+	if engine.persistentDB == nil {
+		return
+	}
+	value := "false"
+	if enabled {
+		value = "true"
+	}
+	err := engine.persistentDB.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucketIfNotExists([]byte(RULE_TAGS_DB_BUCKET))
+		if err != nil {
+			return err
+		}
+		return b.Put([]byte(name), []byte(value))
+	})
+	if err != nil {
+		engine.Log(ENGINE_LOG_ERROR, fmt.Sprintf("can't store state of tag '%s': %s", name, err))
+	}
+}
+
+// LoadAstroLocation reads the location set via
+// the settings device from persistent DB
+func (engine *ESEngine) LoadAstroLocation() (loc AstroLocation, found bool) {
+	if engine.persistentDB == nil {
+		return
+	}
+	engine.persistentDB.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(ASTRO_LOCATION_DB_BUCKET))
+		if b == nil {
+			return nil
+		}
+		for _, ctrlId := range []string{RULE_LATITUDE_CELL_NAME, RULE_LONGITUDE_CELL_NAME, RULE_TIMEZONE_CELL_NAME} {
+			v := b.Get([]byte(ctrlId))
+			if v == nil {
+				continue
+			}
+			if err := applyAstroControlValue(&loc, ctrlId, string(v)); err != nil {
+				engine.Log(ENGINE_LOG_WARNING, fmt.Sprintf("ignoring stored %s: %s", ctrlId, err))
+				continue
+			}
+			found = true
+		}
+		// the coordinates are stored only when configured
+		loc.Configured = b.Get([]byte(RULE_LATITUDE_CELL_NAME)) != nil
+		return nil
+	})
+	return
+}
+
+// StoreAstroLocation writes the location set via
+// the settings device down to persistent DB
+func (engine *ESEngine) StoreAstroLocation(loc AstroLocation) {
+	if engine.persistentDB == nil {
+		return
+	}
+	err := engine.persistentDB.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucketIfNotExists([]byte(ASTRO_LOCATION_DB_BUCKET))
+		if err != nil {
+			return err
+		}
+		timezone := ""
+		if loc.Timezone != nil && loc.Timezone != time.Local {
+			timezone = loc.Timezone.String()
+		}
+		values := map[string]string{RULE_TIMEZONE_CELL_NAME: timezone}
+		if loc.Configured {
+			values[RULE_LATITUDE_CELL_NAME] = strconv.FormatFloat(loc.Latitude, 'g', -1, 64)
+			values[RULE_LONGITUDE_CELL_NAME] = strconv.FormatFloat(loc.Longitude, 'g', -1, 64)
+		}
+		for k, v := range values {
+			if err = b.Put([]byte(k), []byte(v)); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		engine.Log(ENGINE_LOG_ERROR, fmt.Sprintf("can't store astronomical schedules location: %s", err))
+	}
+}
+
+// LoadPersistentTimers reads the states of the persistent
+// timers from persistent DB
+func (engine *ESEngine) LoadPersistentTimers() map[string]PersistentTimerState {
+	states := make(map[string]PersistentTimerState)
+	if engine.persistentDB == nil {
+		return states
+	}
+	engine.persistentDB.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(PERSISTENT_TIMERS_DB_BUCKET))
+		if b == nil {
+			return nil
+		}
+		return b.ForEach(func(k, v []byte) error {
+			var state PersistentTimerState
+			if err := json.Unmarshal(v, &state); err != nil {
+				engine.Log(ENGINE_LOG_ERROR, fmt.Sprintf("bad state of timer '%s': %s", k, err))
+				return nil
+			}
+			states[string(k)] = state
+			return nil
+		})
+	})
+	return states
+}
+
+// StorePersistentTimer writes the state of the persistent
+// timer down to persistent DB
+func (engine *ESEngine) StorePersistentTimer(name string, state PersistentTimerState) {
+	if engine.persistentDB == nil {
+		return
+	}
+	value, err := json.Marshal(state)
+	if err == nil {
+		err = engine.persistentDB.Update(func(tx *bolt.Tx) error {
+			b, err := tx.CreateBucketIfNotExists([]byte(PERSISTENT_TIMERS_DB_BUCKET))
+			if err != nil {
+				return err
+			}
+			return b.Put([]byte(name), value)
+		})
+	}
+	if err != nil {
+		engine.Log(ENGINE_LOG_ERROR, fmt.Sprintf("can't store state of timer '%s': %s", name, err))
+	}
+}
+
+// RemovePersistentTimer removes the state of the persistent
+// timer from persistent DB
+func (engine *ESEngine) RemovePersistentTimer(name string) {
+	if engine.persistentDB == nil {
+		return
+	}
+	err := engine.persistentDB.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(PERSISTENT_TIMERS_DB_BUCKET))
+		if b == nil {
+			return nil
+		}
+		return b.Delete([]byte(name))
+	})
+	if err != nil {
+		engine.Log(ENGINE_LOG_ERROR, fmt.Sprintf("can't remove state of timer '%s': %s", name, err))
+	}
+}
+
 // Creates a name for persistent storage bucket.
 // Used in 'PersistentStorage(name, options)'
 func (engine *ESEngine) esPersistentName(ctx *ESContext) int {
@@ -2342,6 +3179,13 @@ func (engine *ESEngine) esPersistentGet(ctx *ESContext) int {
 
 // native modSearch implementation
 func (engine *ESEngine) ModSearch(ctx *duktape.Context) int {
+	_, r := engine.modSearch(ctx)
+	return r
+}
+
+// modSearch returns the path of the module file
+// if the module is found
+func (engine *ESEngine) modSearch(ctx *duktape.Context) (string, int) {
 	// arguments:
 	// 0: id
 	// 1: require
@@ -2352,55 +3196,57 @@ func (engine *ESEngine) ModSearch(ctx *duktape.Context) int {
 	id := ctx.GetString(0)
 	wbgong.Debug.Printf("[modsearch] required module %s", id)
 
-	// try to find this module in directory
-	for _, dir := range engine.modulesDirs {
-		path := dir + "/" + id + ".js"
-		wbgong.Debug.Printf("[modsearch] trying to read file %s", path)
-
-		// TBD: something external to load scripts properly
-		// now just try to read file
-		src, err := ioutil.ReadFile(path)
-
-		if err == nil {
-			wbgong.Debug.Printf("[modsearch] file found!")
-
-			// set module properties
-			// put module.filename
-			ctx.PushString(path)
-			// [ args | path ]
-			ctx.PutPropString(3, MODULE_FILENAME_PROP)
-			// [ args | ]
-
-			// put module.storage
-			ctx.PushHeapStash()
-			// [ args | heapStash ]
-			ctx.GetPropString(-1, MODULES_USER_STORAGE_OBJ_NAME)
-			// [ args | heapStash _esModules ]
-
-			// check if storage for this module is allocated
-			if !ctx.HasPropString(-1, path) {
-				// create storage
-				ctx.PushObject()
-				// [ args | heapStash _esModules newStorage ]
-				ctx.PutPropString(-2, path)
-				// [ args | heapStash _esModules ]
-			}
-			// add this storage to module
-			ctx.GetPropString(-1, path)
-			// [ args | heapStash _esModules storage ]
-			ctx.PutPropString(3, MODULE_STATIC_PROP)
-			// [ args | heapStash _esModules ]
-			ctx.Pop2()
-			// [ args | ]
+	path, isPackage, tried := engine.resolveModule(id)
+	if path == "" {
+		msg := fmt.Sprintf("cannot find module '%s', tried: %s", id, strings.Join(tried, ", "))
+		wbgong.Error.Printf("error requiring module: %s", msg)
+		ctx.PushErrorObject(duktape.DUK_ERR_ERROR, msg)
+		return "", duktape.DUK_RET_INSTACK_ERROR
+	}
 
-			// return module sources
-			ctx.PushString(string(src))
+	var src string
+	var err error
+	if isPackage {
+		src = packageModuleSource(id)
+	} else if src, err = engine.loadModule(path); err != nil {
+		msg := fmt.Sprintf("error loading module '%s': %s", id, err)
+		wbgong.Error.Printf("error requiring module: %s", msg)
+		ctx.PushErrorObject(duktape.DUK_ERR_ERROR, msg)
+		return "", duktape.DUK_RET_INSTACK_ERROR
+	}
+	wbgong.Debug.Printf("[modsearch] module %s found: %s", id, path)
+
+	// set module properties
+	// put module.filename
+	ctx.PushString(path)
+	// [ args | path ]
+	ctx.PutPropString(3, MODULE_FILENAME_PROP)
+	// [ args | ]
 
-			return 1
-		}
-	}
+	// put module.storage
+	ctx.PushHeapStash()
+	// [ args | heapStash ]
+	ctx.GetPropString(-1, MODULES_USER_STORAGE_OBJ_NAME)
+	// [ args | heapStash _esModules ]
+
+	// check if storage for this module is allocated
+	if !ctx.HasPropString(-1, path) {
+		// create storage
+		ctx.PushObject()
+		// [ args | heapStash _esModules newStorage ]
+		ctx.PutPropString(-2, path)
+		// [ args | heapStash _esModules ]
+	}
+	// add this storage to module
+	ctx.GetPropString(-1, path)
+	// [ args | heapStash _esModules storage ]
+	ctx.PutPropString(3, MODULE_STATIC_PROP)
+	// [ args | heapStash _esModules ]
+	ctx.Pop2()
+	// [ args | ]
 
-	wbgong.Error.Printf("error requiring module %s, not found", id)
+	// return module sources
+	ctx.PushString(src)
 
-	return duktape.DUK_RET_ERROR
+	return path, 1
 }
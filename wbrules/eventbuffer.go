@@ -1,25 +1,79 @@
 package wbrules
 
 import (
+	"fmt"
 	"sync"
 )
 
 const (
 	EVENT_BUFFER_CAP    = 16
 	EVENT_OBSERVERS_CAP = 1
+
+	// EVENT_BUFFER_UNLIMITED disables event buffer capacity limit
+	EVENT_BUFFER_UNLIMITED = 0
+)
+
+// EventBufferPolicy defines how the events for the same control
+// are handled while they wait in the buffer
+type EventBufferPolicy int
+
+const (
+	// EVENT_BUFFER_KEEP_ALL keeps every event
+	EVENT_BUFFER_KEEP_ALL EventBufferPolicy = iota
+	// EVENT_BUFFER_COALESCE keeps only the latest event per control
+	// within a batch, pushbutton events are never merged
+	EVENT_BUFFER_COALESCE
 )
 
+var eventBufferPolicyNames = map[EventBufferPolicy]string{
+	EVENT_BUFFER_KEEP_ALL: "keep-all",
+	EVENT_BUFFER_COALESCE: "coalesce",
+}
+
+func (p EventBufferPolicy) String() string {
+	if name, found := eventBufferPolicyNames[p]; found {
+		return name
+	}
+	return fmt.Sprintf("EventBufferPolicy(%d)", int(p))
+}
+
+// ParseEventBufferPolicy converts policy name (as used on the
+// command line) to EventBufferPolicy
+func ParseEventBufferPolicy(name string) (EventBufferPolicy, error) {
+	for p, pName := range eventBufferPolicyNames {
+		if pName == name {
+			return p, nil
+		}
+	}
+	return EVENT_BUFFER_KEEP_ALL, fmt.Errorf("unknown event buffer policy: %s", name)
+}
+
 type EventBuffer struct {
 	sync.Mutex
 
+	capacity int
+	policy   EventBufferPolicy
+
 	currentBuffer []*ControlChangeEvent
 	observer      chan struct{}
+
+	// positions of the latest coalescable events in currentBuffer,
+	// counted from the start of the batch, so dropping events from
+	// the head of the buffer doesn't require reindexing
+	latest   map[ControlSpec]int
+	headSkip int
+
+	droppedCount   uint64
+	coalescedCount uint64
 }
 
-func NewEventBuffer() *EventBuffer {
+func NewEventBuffer(capacity int, policy EventBufferPolicy) *EventBuffer {
 	return &EventBuffer{
+		capacity:      capacity,
+		policy:        policy,
 		currentBuffer: make([]*ControlChangeEvent, 0, EVENT_BUFFER_CAP),
 		observer:      make(chan struct{}, 1),
+		latest:        make(map[ControlSpec]int),
 	}
 }
 
@@ -31,7 +85,15 @@ func (eb *EventBuffer) PushEvent(e *ControlChangeEvent) {
 	eb.Lock()
 	defer eb.Unlock()
 
-	eb.currentBuffer = append(eb.currentBuffer, e)
+	if !eb.tryCoalesce(e) {
+		if eb.capacity != EVENT_BUFFER_UNLIMITED && len(eb.currentBuffer) >= eb.capacity {
+			eb.dropOldest()
+		}
+		if eb.policy == EVENT_BUFFER_COALESCE && !e.IsPushbutton {
+			eb.latest[e.Spec] = eb.headSkip + len(eb.currentBuffer)
+		}
+		eb.currentBuffer = append(eb.currentBuffer, e)
+	}
 
 	// try to notify user if he's not notified already
 	select {
@@ -40,12 +102,47 @@ func (eb *EventBuffer) PushEvent(e *ControlChangeEvent) {
 	}
 }
 
+// tryCoalesce replaces pending event for the same control with
+// the new one. Must be called with the buffer locked
+func (eb *EventBuffer) tryCoalesce(e *ControlChangeEvent) bool {
+	if eb.policy != EVENT_BUFFER_COALESCE || e.IsPushbutton {
+		return false
+	}
+	pos, found := eb.latest[e.Spec]
+	if !found {
+		return false
+	}
+	// the merged event represents the change
+	// from the value before the whole batch
+	e.OldValue = eb.currentBuffer[pos-eb.headSkip].OldValue
+	eb.currentBuffer[pos-eb.headSkip] = e
+	eb.coalescedCount++
+	return true
+}
+
+// dropOldest removes the first event from the buffer.
+// Must be called with the buffer locked
+func (eb *EventBuffer) dropOldest() {
+	dropped := eb.currentBuffer[0]
+	if pos, found := eb.latest[dropped.Spec]; found && pos == eb.headSkip {
+		delete(eb.latest, dropped.Spec)
+	}
+	eb.currentBuffer[0] = nil
+	eb.currentBuffer = eb.currentBuffer[1:]
+	eb.headSkip++
+	eb.droppedCount++
+}
+
 func (eb *EventBuffer) Retrieve() (e []*ControlChangeEvent) {
 	eb.Lock()
 	defer eb.Unlock()
 
 	e = eb.currentBuffer
 	eb.currentBuffer = make([]*ControlChangeEvent, 0, EVENT_BUFFER_CAP)
+	if len(eb.latest) != 0 {
+		eb.latest = make(map[ControlSpec]int)
+	}
+	eb.headSkip = 0
 	return
 }
 
@@ -56,6 +153,14 @@ func (eb *EventBuffer) length() int {
 	return len(eb.currentBuffer)
 }
 
+// counters returns total numbers of dropped and coalesced events
+func (eb *EventBuffer) counters() (dropped, coalesced uint64) {
+	eb.Lock()
+	defer eb.Unlock()
+
+	return eb.droppedCount, eb.coalescedCount
+}
+
 func (eb *EventBuffer) Close() {
 	close(eb.observer)
 }
@@ -0,0 +1,72 @@
+package wbrules
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func eventValues(events []*ControlChangeEvent) []interface{} {
+	r := make([]interface{}, len(events))
+	for i, e := range events {
+		r[i] = e.Value
+	}
+	return r
+}
+
+func TestEventBufferKeepAll(t *testing.T) {
+	eb := NewEventBuffer(EVENT_BUFFER_UNLIMITED, EVENT_BUFFER_KEEP_ALL)
+	spec := ControlSpec{"somedev", "temp"}
+	for i := 0; i < 3; i++ {
+		eb.PushEvent(&ControlChangeEvent{Spec: spec, Value: i})
+	}
+	assert.Equal(t, []interface{}{0, 1, 2}, eventValues(eb.Retrieve()))
+	assert.Equal(t, 0, eb.length())
+}
+
+func TestEventBufferCoalesce(t *testing.T) {
+	eb := NewEventBuffer(EVENT_BUFFER_UNLIMITED, EVENT_BUFFER_COALESCE)
+	temp := ControlSpec{"somedev", "temp"}
+	button := ControlSpec{"somedev", "button"}
+	eb.PushEvent(&ControlChangeEvent{Spec: temp, Value: 1})
+	eb.PushEvent(&ControlChangeEvent{Spec: button, Value: "b1", IsPushbutton: true})
+	eb.PushEvent(&ControlChangeEvent{Spec: temp, Value: 2})
+	eb.PushEvent(&ControlChangeEvent{Spec: button, Value: "b2", IsPushbutton: true})
+	eb.PushEvent(&ControlChangeEvent{Spec: temp, Value: 3})
+	assert.Equal(t, []interface{}{3, "b1", "b2"}, eventValues(eb.Retrieve()))
+
+	// coalescing is done only within a batch
+	eb.PushEvent(&ControlChangeEvent{Spec: temp, Value: 4})
+	assert.Equal(t, []interface{}{4}, eventValues(eb.Retrieve()))
+
+	dropped, coalesced := eb.counters()
+	assert.Equal(t, uint64(0), dropped)
+	assert.Equal(t, uint64(2), coalesced)
+}
+
+func TestEventBufferOverflow(t *testing.T) {
+	eb := NewEventBuffer(2, EVENT_BUFFER_COALESCE)
+	a := ControlSpec{"somedev", "a"}
+	b := ControlSpec{"somedev", "b"}
+	c := ControlSpec{"somedev", "c"}
+	eb.PushEvent(&ControlChangeEvent{Spec: a, Value: "a1"})
+	eb.PushEvent(&ControlChangeEvent{Spec: b, Value: "b1"})
+	eb.PushEvent(&ControlChangeEvent{Spec: c, Value: "c1"}) // drops a1
+	eb.PushEvent(&ControlChangeEvent{Spec: b, Value: "b2"}) // coalesced
+	eb.PushEvent(&ControlChangeEvent{Spec: a, Value: "a2"}) // drops b2
+	assert.Equal(t, []interface{}{"c1", "a2"}, eventValues(eb.Retrieve()))
+
+	dropped, coalesced := eb.counters()
+	assert.Equal(t, uint64(2), dropped)
+	assert.Equal(t, uint64(1), coalesced)
+}
+
+func TestParseEventBufferPolicy(t *testing.T) {
+	for _, p := range []EventBufferPolicy{EVENT_BUFFER_KEEP_ALL, EVENT_BUFFER_COALESCE} {
+		parsed, err := ParseEventBufferPolicy(p.String())
+		assert.NoError(t, err)
+		assert.Equal(t, p, parsed)
+	}
+	_, err := ParseEventBufferPolicy("nosuchpolicy")
+	assert.Error(t, err)
+}
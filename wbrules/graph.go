@@ -0,0 +1,130 @@
+package wbrules
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+)
+
+// RuleGraphRule describes a single rule in the dependency graph
+type RuleGraphRule struct {
+	Id       RuleId         `json:"id"`
+	Name     string         `json:"name"`
+	Location SourceLocation `json:"location"`
+	// WithoutControls is set for the rules which don't read
+	// any controls in their conditions, so they're checked
+	// on every event
+	WithoutControls bool `json:"withoutControls"`
+}
+
+// RuleGraphEdges lists the rules triggered by a control or a timer
+type RuleGraphEdges struct {
+	Source string   `json:"source"`
+	Rules  []RuleId `json:"rules"`
+}
+
+// RuleGraph represents the dependencies between controls,
+// timers and rules collected by the engine
+type RuleGraph struct {
+	Rules    []RuleGraphRule  `json:"rules"`
+	Controls []RuleGraphEdges `json:"controls"`
+	Timers   []RuleGraphEdges `json:"timers"`
+}
+
+// DependencyGraph returns a snapshot of the current rule dependencies
+func (engine *RuleEngine) DependencyGraph() *RuleGraph {
+	engine.rulesMutex.Lock()
+	defer engine.rulesMutex.Unlock()
+
+	graph := &RuleGraph{
+		Rules:    make([]RuleGraphRule, 0, len(engine.ruleList)),
+		Controls: make([]RuleGraphEdges, 0, len(engine.controlToRulesListMap)),
+		Timers:   make([]RuleGraphEdges, 0, len(engine.timerRules)),
+	}
+
+	for _, ruleId := range engine.ruleList {
+		rule := engine.ruleMap[ruleId]
+		graph.Rules = append(graph.Rules, RuleGraphRule{
+			Id:              rule.id,
+			Name:            rule.name,
+			Location:        rule.location,
+			WithoutControls: engine.rulesWithoutControls[rule],
+		})
+	}
+
+	for spec, list := range engine.controlToRulesListMap {
+		if ids := engine.liveRuleIds(list); len(ids) > 0 {
+			graph.Controls = append(graph.Controls, RuleGraphEdges{spec.String(), ids})
+		}
+	}
+	sort.Slice(graph.Controls, func(i, j int) bool {
+		return graph.Controls[i].Source < graph.Controls[j].Source
+	})
+
+	for timerName, list := range engine.timerRules {
+		if ids := engine.liveRuleIds(list); len(ids) > 0 {
+			graph.Timers = append(graph.Timers, RuleGraphEdges{timerName, ids})
+		}
+	}
+	sort.Slice(graph.Timers, func(i, j int) bool {
+		return graph.Timers[i].Source < graph.Timers[j].Source
+	})
+
+	return graph
+}
+
+// liveRuleIds returns ids of the rules from the list which
+// are still defined. Must be called with rulesMutex locked
+func (engine *RuleEngine) liveRuleIds(list []*Rule) []RuleId {
+	ids := make([]RuleId, 0, len(list))
+	for _, rule := range list {
+		if engine.ruleMap[rule.id] == rule {
+			ids = append(ids, rule.id)
+		}
+	}
+	return ids
+}
+
+func ruleGraphNodeLabel(rule RuleGraphRule) string {
+	name := rule.Name
+	if name == "" {
+		name = fmt.Sprintf("<rule %d>", rule.Id)
+	}
+	if rule.Location.File != "" {
+		name += "\n" + rule.Location.String()
+	}
+	return name
+}
+
+// WriteDot writes the graph in Graphviz DOT format
+func (graph *RuleGraph) WriteDot(w io.Writer) error {
+	bw := bufio.NewWriter(w)
+	fmt.Fprintln(bw, "digraph wbrules {")
+	fmt.Fprintln(bw, "\trankdir=LR;")
+
+	for _, rule := range graph.Rules {
+		attrs := "shape=box"
+		if rule.WithoutControls {
+			attrs += ", style=filled, fillcolor=orange"
+		}
+		fmt.Fprintf(bw, "\t\"rule:%d\" [label=%s, %s];\n",
+			rule.Id, strconv.Quote(ruleGraphNodeLabel(rule)), attrs)
+	}
+
+	writeEdges := func(kind, shape string, edges []RuleGraphEdges) {
+		for _, e := range edges {
+			node := strconv.Quote(kind + ":" + e.Source)
+			fmt.Fprintf(bw, "\t%s [label=%s, shape=%s];\n", node, strconv.Quote(e.Source), shape)
+			for _, ruleId := range e.Rules {
+				fmt.Fprintf(bw, "\t%s -> \"rule:%d\";\n", node, ruleId)
+			}
+		}
+	}
+	writeEdges("control", "ellipse", graph.Controls)
+	writeEdges("timer", "diamond", graph.Timers)
+
+	fmt.Fprintln(bw, "}")
+	return bw.Flush()
+}
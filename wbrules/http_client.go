@@ -0,0 +1,171 @@
+package wbrules
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const (
+	HTTP_DEFAULT_MAX_REQUESTS = 8
+	HTTP_DEFAULT_TIMEOUT      = 30 * time.Second
+	HTTP_MAX_RESPONSE_SIZE    = 1 << 20
+)
+
+// httpTLSOptions are TLS options of http.request(),
+// the files are in PEM format
+type httpTLSOptions struct {
+	InsecureSkipVerify bool   `json:"insecureSkipVerify"`
+	CAFile             string `json:"ca"`
+	CertFile           string `json:"cert"`
+	KeyFile            string `json:"key"`
+}
+
+// httpRequestOptions are the options of http.request() call.
+// Timeout is in milliseconds
+type httpRequestOptions struct {
+	URL     string            `json:"url"`
+	Method  string            `json:"method"`
+	Headers map[string]string `json:"headers"`
+	Body    string            `json:"body"`
+	Timeout float64           `json:"timeout"`
+	TLS     *httpTLSOptions   `json:"tls"`
+}
+
+type httpResponse struct {
+	Status  int
+	Headers map[string]string
+	Body    string
+}
+
+// httpClient performs HTTP requests for scripts limiting
+// the number of the requests running at the same time
+type httpClient struct {
+	client *http.Client
+	sem    chan struct{}
+}
+
+func newHTTPClient(maxRequests int) *httpClient {
+	if maxRequests <= 0 {
+		maxRequests = HTTP_DEFAULT_MAX_REQUESTS
+	}
+	return &httpClient{
+		client: &http.Client{},
+		sem:    make(chan struct{}, maxRequests),
+	}
+}
+
+func (o *httpTLSOptions) config() (*tls.Config, error) {
+	config := &tls.Config{InsecureSkipVerify: o.InsecureSkipVerify}
+	if o.CAFile != "" {
+		data, err := ioutil.ReadFile(o.CAFile)
+		if err != nil {
+			return nil, err
+		}
+		config.RootCAs = x509.NewCertPool()
+		if !config.RootCAs.AppendCertsFromPEM(data) {
+			return nil, fmt.Errorf("no certificates found in %s", o.CAFile)
+		}
+	}
+	if o.CertFile != "" || o.KeyFile != "" {
+		cert, err := tls.LoadX509KeyPair(o.CertFile, o.KeyFile)
+		if err != nil {
+			return nil, err
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+	return config, nil
+}
+
+// clientFor returns the client to use for the request. The requests
+// with TLS options get their own client without keep-alive
+func (c *httpClient) clientFor(options *httpRequestOptions) (*http.Client, error) {
+	if options.TLS == nil {
+		return c.client, nil
+	}
+	config, err := options.TLS.config()
+	if err != nil {
+		return nil, err
+	}
+	return &http.Client{
+		Transport: &http.Transport{
+			Proxy:             http.ProxyFromEnvironment,
+			TLSClientConfig:   config,
+			DisableKeepAlives: true,
+		},
+	}, nil
+}
+
+// do performs the request. The timeout includes the time
+// spent waiting for other requests to finish
+func (c *httpClient) do(options *httpRequestOptions) (*httpResponse, error) {
+	if options.URL == "" {
+		return nil, errors.New("no url specified")
+	}
+	method := strings.ToUpper(options.Method)
+	if method == "" {
+		method = http.MethodGet
+	}
+	timeout := time.Duration(options.Timeout * float64(time.Millisecond))
+	if timeout <= 0 {
+		timeout = HTTP_DEFAULT_TIMEOUT
+	}
+
+	client, err := c.clientFor(options)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	select {
+	case c.sem <- struct{}{}:
+		defer func() { <-c.sem }()
+	case <-ctx.Done():
+		return nil, fmt.Errorf("%s %s: too many requests running, timed out after %s", method, options.URL, timeout)
+	}
+
+	var body io.Reader
+	if options.Body != "" {
+		body = strings.NewReader(options.Body)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, options.URL, body)
+	if err != nil {
+		return nil, err
+	}
+	for name, value := range options.Headers {
+		req.Header.Set(name, value)
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	data, err := ioutil.ReadAll(io.LimitReader(resp.Body, HTTP_MAX_RESPONSE_SIZE+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(data) > HTTP_MAX_RESPONSE_SIZE {
+		return nil, fmt.Errorf("%s %s: response body is larger than %d bytes", method, options.URL, HTTP_MAX_RESPONSE_SIZE)
+	}
+
+	headers := make(map[string]string, len(resp.Header))
+	for name, values := range resp.Header {
+		headers[name] = strings.Join(values, ", ")
+	}
+	return &httpResponse{
+		Status:  resp.StatusCode,
+		Headers: headers,
+		Body:    string(data),
+	}, nil
+}
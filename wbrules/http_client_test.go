@@ -0,0 +1,56 @@
+package wbrules
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHTTPClientLimit(t *testing.T) {
+	var running, maxRunning int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := atomic.AddInt32(&running, 1)
+		defer atomic.AddInt32(&running, -1)
+		for {
+			max := atomic.LoadInt32(&maxRunning)
+			if n <= max || atomic.CompareAndSwapInt32(&maxRunning, max, n) {
+				break
+			}
+		}
+		time.Sleep(30 * time.Millisecond)
+	}))
+	defer server.Close()
+
+	c := newHTTPClient(2)
+	var wg sync.WaitGroup
+	for i := 0; i < 6; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			resp, err := c.do(&httpRequestOptions{URL: server.URL})
+			if assert.NoError(t, err) {
+				assert.Equal(t, http.StatusOK, resp.Status)
+			}
+		}()
+	}
+	wg.Wait()
+	assert.Equal(t, int32(2), atomic.LoadInt32(&maxRunning))
+}
+
+func TestHTTPClientResponseSize(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(strings.Repeat("x", HTTP_MAX_RESPONSE_SIZE+1)))
+	}))
+	defer server.Close()
+
+	_, err := newHTTPClient(0).do(&httpRequestOptions{URL: server.URL})
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "response body is larger")
+}
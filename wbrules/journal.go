@@ -0,0 +1,152 @@
+package wbrules
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/contactless/wbgong"
+)
+
+const (
+	// journal entry kinds
+	JOURNAL_CONTROL = "control"
+	JOURNAL_TIMER   = "timer"
+	JOURNAL_MQTT    = "mqtt"
+
+	JOURNAL_FILE_MODE      = 0640
+	JOURNAL_MAX_LINE_BYTES = 1024 * 1024
+)
+
+// JournalEntry is a single record of the event journal
+type JournalEntry struct {
+	Time time.Time `json:"time"`
+	Kind string    `json:"kind"`
+
+	// control change events
+	Device     string      `json:"device,omitempty"`
+	Control    string      `json:"control,omitempty"`
+	Value      interface{} `json:"value"`
+	Retained   bool        `json:"retained,omitempty"`
+	Pushbutton bool        `json:"pushbutton,omitempty"`
+	// Self is set for the changes caused by the scripts
+	// themselves, e.g. the device confirming a control write.
+	// Such entries are not injected on replay
+	Self bool `json:"self,omitempty"`
+
+	// timer fires, Timer is empty for unnamed timers
+	Timer   string  `json:"timer,omitempty"`
+	TimerId TimerId `json:"timerId,omitempty"`
+
+	// MQTT messages received by trackMqtt() subscriptions
+	Topic   string `json:"topic,omitempty"`
+	Payload string `json:"payload,omitempty"`
+}
+
+// Journal records the events that drive the rules, one JSON
+// object per line, so the rules can be replayed later
+type Journal struct {
+	mutex  sync.Mutex
+	enc    *json.Encoder
+	closer io.Closer
+	failed bool
+}
+
+func NewJournal(w io.Writer) *Journal {
+	j := &Journal{enc: json.NewEncoder(w)}
+	if closer, ok := w.(io.Closer); ok {
+		j.closer = closer
+	}
+	return j
+}
+
+// OpenJournal opens journal file for appending
+func OpenJournal(path string) (*Journal, error) {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, JOURNAL_FILE_MODE)
+	if err != nil {
+		return nil, err
+	}
+	return NewJournal(f), nil
+}
+
+// Record appends the entry to the journal, setting
+// its time if it's not set yet
+func (j *Journal) Record(entry JournalEntry) {
+	if entry.Time.IsZero() {
+		entry.Time = time.Now()
+	}
+
+	j.mutex.Lock()
+	defer j.mutex.Unlock()
+
+	if err := j.enc.Encode(entry); err != nil && !j.failed {
+		// don't flood the log if the disk is full
+		j.failed = true
+		wbgong.Error.Printf("failed to write event journal: %s", err)
+	}
+}
+
+func (j *Journal) Close() error {
+	j.mutex.Lock()
+	defer j.mutex.Unlock()
+
+	if j.closer == nil {
+		return nil
+	}
+	return j.closer.Close()
+}
+
+// ReadJournal reads journal entries written by Journal
+func ReadJournal(r io.Reader) (entries []JournalEntry, err error) {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 0, 64*1024), JOURNAL_MAX_LINE_BYTES)
+	for lineNum := 1; scanner.Scan(); lineNum++ {
+		line := scanner.Bytes()
+		if len(line) == 0 {
+			continue
+		}
+		var entry JournalEntry
+		if err = json.Unmarshal(line, &entry); err != nil {
+			return nil, fmt.Errorf("journal line %d: %s", lineNum, err)
+		}
+		entries = append(entries, entry)
+	}
+	return entries, scanner.Err()
+}
+
+// recordJournal appends the entry to the event journal
+// if the journal is enabled
+func (engine *RuleEngine) recordJournal(entry JournalEntry) {
+	if engine.journal != nil {
+		engine.journal.Record(entry)
+	}
+}
+
+// noteJournalWrite remembers the control write made by the scripts
+// so the resulting control change event is marked in the journal
+func (engine *RuleEngine) noteJournalWrite(spec ControlSpec) {
+	if engine.journal == nil {
+		return
+	}
+	engine.journalWritesMutex.Lock()
+	defer engine.journalWritesMutex.Unlock()
+	engine.journalWrites[spec] = time.Now()
+}
+
+// takeJournalWrite returns true if the change of the specified
+// control is caused by a recent write made by the scripts
+func (engine *RuleEngine) takeJournalWrite(spec ControlSpec) bool {
+	engine.journalWritesMutex.Lock()
+	defer engine.journalWritesMutex.Unlock()
+
+	ts, found := engine.journalWrites[spec]
+	if !found {
+		return false
+	}
+	delete(engine.journalWrites, spec)
+	return time.Since(ts) <= CASCADE_PENDING_TTL
+}
@@ -0,0 +1,129 @@
+package wbrules
+
+import (
+	"bytes"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/contactless/wbgong/testutils"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestJournalRoundTrip(t *testing.T) {
+	var buf bytes.Buffer
+	j := NewJournal(&buf)
+	ts := time.Date(2017, 7, 14, 2, 40, 0, 0, time.UTC)
+	j.Record(JournalEntry{Time: ts, Kind: JOURNAL_CONTROL, Device: "somedev", Control: "sw", Value: false, Retained: true})
+	j.Record(JournalEntry{Time: ts.Add(time.Second), Kind: JOURNAL_TIMER, Timer: "t1", TimerId: 3})
+	j.Record(JournalEntry{Time: ts.Add(2 * time.Second), Kind: JOURNAL_MQTT, Topic: "/some/topic", Payload: "abc"})
+	j.Record(JournalEntry{Time: ts.Add(3 * time.Second), Kind: JOURNAL_CONTROL, Device: "somedev", Control: "sw", Value: true, Self: true})
+
+	entries, err := ReadJournal(strings.NewReader(buf.String() + "\n"))
+	assert.NoError(t, err)
+	assert.Equal(t, 4, len(entries))
+	assert.True(t, ts.Equal(entries[0].Time))
+	assert.Equal(t, false, entries[0].Value)
+	assert.True(t, entries[0].Retained)
+	assert.Equal(t, "t1", entries[1].Timer)
+	assert.Equal(t, TimerId(3), entries[1].TimerId)
+	assert.Equal(t, "abc", entries[2].Payload)
+	assert.False(t, entries[0].Self)
+	assert.True(t, entries[3].Self)
+
+	_, err = ReadJournal(strings.NewReader("{\"kind\": \"control\"}\nbroken\n"))
+	assert.EqualError(t, err, "journal line 2: invalid character 'b' looking for beginning of value")
+}
+
+// lockedBuffer allows reading the journal while the engine writes it
+type lockedBuffer struct {
+	sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *lockedBuffer) Write(p []byte) (int, error) {
+	b.Lock()
+	defer b.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *lockedBuffer) String() string {
+	b.Lock()
+	defer b.Unlock()
+	return b.buf.String()
+}
+
+type JournalSuite struct {
+	RuleSuiteBase
+	journal lockedBuffer
+}
+
+func (s *JournalSuite) SetupTest() {
+	s.journal = lockedBuffer{}
+	s.EngineOptions = NewESEngineOptions()
+	s.EngineOptions.SetJournal(NewJournal(&s.journal))
+	s.SetupSkippingDefs("testrules_timers.js", "testrules_replay.js")
+}
+
+func (s *JournalSuite) findEntry(kind, name string) *JournalEntry {
+	entries, err := ReadJournal(strings.NewReader(s.journal.String()))
+	s.Ck("ReadJournal()", err)
+	for i := range entries {
+		e := &entries[i]
+		if e.Kind == kind && (e.Device+"/"+e.Control == name || e.Timer == name) {
+			return e
+		}
+	}
+	return nil
+}
+
+func (s *JournalSuite) TestRecording() {
+	s.publish("/devices/somedev/controls/foo/meta/type", "text", "somedev/foo")
+	s.publish("/devices/somedev/controls/foo", "t", "somedev/foo")
+	s.Verify(
+		"tst -> /devices/somedev/controls/foo/meta/type: [text] (QoS 1, retained)",
+		"tst -> /devices/somedev/controls/foo: [t] (QoS 1, retained)",
+		"new fake timer: 1, 500",
+		"new fake timer: 2, 500",
+	)
+	ts := s.AdvanceTime(500 * time.Millisecond)
+	s.FireTimer(1, ts)
+	s.FireTimer(2, ts)
+	s.VerifyUnordered(
+		"timer.fire(): 1",
+		"timer.fire(): 2",
+		"[info] timer fired",
+		"[info] timer1 fired",
+	)
+
+	if e := s.findEntry(JOURNAL_CONTROL, "somedev/foo"); s.NotNil(e) {
+		s.Equal("t", e.Value)
+		s.True(e.Retained)
+	}
+	s.NotNil(s.findEntry(JOURNAL_TIMER, "sometimer"))
+}
+
+func (s *JournalSuite) TestRulesWrites() {
+	s.publish("/devices/room/controls/button/meta/type", "switch", "room/button")
+	s.publish("/devices/room/controls/relay/meta/type", "switch", "room/relay")
+	s.publish("/devices/room/controls/button", "1", "room/button")
+	s.SkipTill("driver -> /devices/room/controls/relay/on: [1] (QoS 1)")
+	// the relay confirms the write
+	s.publish("/devices/room/controls/relay", "1", "room/relay")
+	s.SkipTill("[info] relay: true")
+
+	if e := s.findEntry(JOURNAL_CONTROL, "room/button"); s.NotNil(e) {
+		s.False(e.Self)
+	}
+	if e := s.findEntry(JOURNAL_CONTROL, "room/relay"); s.NotNil(e) {
+		s.Equal(true, e.Value)
+		s.True(e.Self)
+	}
+}
+
+func TestJournalSuite(t *testing.T) {
+	testutils.RunSuites(t,
+		new(JournalSuite),
+	)
+}
@@ -6,14 +6,23 @@ type LocItem struct {
 	Name string `json:"name"`
 }
 
+// ScriptWarning denotes a problem found in the script
+// which doesn't prevent it from being loaded
+type ScriptWarning struct {
+	Line    int    `json:"line"`
+	Message string `json:"message"`
+}
+
 // LocFileEntry represents a source file
 type LocFileEntry struct {
-	Enabled     bool         `json:"enabled"`
-	Error       *ScriptError `json:"error,omitempty"`
-	VirtualPath string       `json:"virtualPath"`
-	Rules       []LocItem    `json:"rules"`
-	Devices     []LocItem    `json:"devices"`
-	Timers      []LocItem    `json:"timers"`
+	Enabled     bool            `json:"enabled"`
+	Error       *ScriptError    `json:"error,omitempty"`
+	Warnings    []ScriptWarning `json:"warnings,omitempty"`
+	VirtualPath string          `json:"virtualPath"`
+	Rules       []LocItem       `json:"rules"`
+	Devices     []LocItem       `json:"devices"`
+	Timers      []LocItem       `json:"timers"`
+	Modules     []string        `json:"modules,omitempty"` // files of the required modules
 
 	PhysicalPath string     `json:"-"`
 	Context      *ESContext `json:"-"`
@@ -0,0 +1,217 @@
+package wbrules
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	wbgong "github.com/contactless/wbgong"
+)
+
+const (
+	// SCRIPT_RELATIVE_MODULE_PREFIX starts the ids of the modules
+	// which are resolved relative to the requiring script. Such ids
+	// are made by require() in lib.js for "./" and "../" ids
+	SCRIPT_RELATIVE_MODULE_PREFIX = "~/"
+)
+
+// cachedModule is the source of a module file, it's valid
+// while the file is not changed
+type cachedModule struct {
+	modTime time.Time
+	size    int64
+	src     string
+}
+
+// moduleCandidate is a file which may hold the module
+type moduleCandidate struct {
+	path      string
+	isPackage bool // index.js of the package directory
+}
+
+// moduleCandidates returns the files which may hold the module,
+// in the order they're tried
+func (engine *ESEngine) moduleCandidates(id string) (candidates []moduleCandidate) {
+	var bases []string
+	if strings.HasPrefix(id, SCRIPT_RELATIVE_MODULE_PREFIX) {
+		bases = []string{id[len(SCRIPT_RELATIVE_MODULE_PREFIX)-1:]}
+	} else {
+		for _, dir := range engine.modulesDirs {
+			if dir != "" {
+				bases = append(bases, filepath.Join(dir, id))
+			}
+		}
+	}
+
+	for _, base := range bases {
+		switch filepath.Ext(base) {
+		case ".js", ".json":
+			candidates = append(candidates, moduleCandidate{base, false})
+		}
+		candidates = append(candidates,
+			moduleCandidate{base + ".js", false},
+			moduleCandidate{base + ".json", false},
+			moduleCandidate{filepath.Join(base, "index.js"), true},
+		)
+	}
+	return
+}
+
+// resolveModule returns the absolute path of the module file
+// or an empty string with the list of the paths tried
+func (engine *ESEngine) resolveModule(id string) (path string, isPackage bool, tried []string) {
+	for _, candidate := range engine.moduleCandidates(id) {
+		fi, err := os.Stat(candidate.path)
+		if err == nil && fi.Mode().IsRegular() {
+			if path, err = filepath.Abs(candidate.path); err == nil {
+				return path, candidate.isPackage, nil
+			}
+		}
+		tried = append(tried, candidate.path)
+	}
+	return "", false, tried
+}
+
+// packageModuleSource returns the source of the module which
+// exports the index module of the package. This way the ids
+// required by index.js are resolved relative to the package
+// directory and not to its parent
+func packageModuleSource(id string) string {
+	name := id[strings.LastIndex(id, "/")+1:]
+	return fmt.Sprintf("module.exports = require(%q);", "./"+name+"/index")
+}
+
+// loadModule returns the source of the module file. JSON files
+// become modules exporting their content. The sources are cached
+// till the files are changed. Must be called from the sync loop
+func (engine *ESEngine) loadModule(path string) (string, error) {
+	fi, err := os.Stat(path)
+	if err != nil {
+		return "", err
+	}
+	if cached, found := engine.moduleCache[path]; found &&
+		cached.modTime.Equal(fi.ModTime()) && cached.size == fi.Size() {
+		return cached.src, nil
+	}
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	src := string(data)
+	if filepath.Ext(path) == ".json" {
+		if !json.Valid(data) {
+			return "", fmt.Errorf("invalid JSON in %s", path)
+		}
+		src = "module.exports = " + src + ";"
+	}
+
+	engine.moduleCache[path] = &cachedModule{
+		modTime: fi.ModTime(),
+		size:    fi.Size(),
+		src:     src,
+	}
+	return src, nil
+}
+
+// addModuleDependency records that the script of the context
+// required the module file
+func (engine *ESEngine) addModuleDependency(ctx *ESContext, modulePath string) {
+	modulePath, err := filepath.Abs(modulePath)
+	if err != nil {
+		return
+	}
+
+	engine.sourcesMtx.Lock()
+	defer engine.sourcesMtx.Unlock()
+
+	entry, found := engine.sources[ctx.GetCurrentFilename()]
+	if !found {
+		// not a script, e.g. the global context
+		return
+	}
+	for _, p := range entry.Modules {
+		if p == modulePath {
+			return
+		}
+	}
+	entry.Modules = append(entry.Modules, modulePath)
+}
+
+// ModuleDependents returns the paths of the scripts
+// which required the module file
+func (engine *ESEngine) ModuleDependents(modulePath string) (scripts []string) {
+	modulePath, err := filepath.Abs(modulePath)
+	if err != nil {
+		return
+	}
+
+	engine.sourcesMtx.Lock()
+	defer engine.sourcesMtx.Unlock()
+
+	for path, entry := range engine.sources {
+		for _, p := range entry.Modules {
+			if p == modulePath {
+				scripts = append(scripts, path)
+				break
+			}
+		}
+	}
+	sort.Strings(scripts)
+	return
+}
+
+// ReloadModuleDependents reloads the scripts which required
+// the changed or removed module file. Returns the first error
+// of reloading the scripts
+func (engine *ESEngine) ReloadModuleDependents(modulePath string) error {
+	r := make(chan error)
+	engine.WhenEngineReady(func() {
+		if path, err := filepath.Abs(modulePath); err == nil {
+			delete(engine.moduleCache, path)
+		}
+
+		var firstErr error
+		for _, script := range engine.ModuleDependents(modulePath) {
+			wbgong.Info.Printf("module %s changed, reloading %s", modulePath, script)
+			if err := engine.loadScriptAndRefresh(script, true); err != nil {
+				wbgong.Error.Printf("error reloading %s: %s", script, err)
+				if firstErr == nil {
+					firstErr = err
+				}
+			}
+		}
+		r <- firstErr
+	})
+	return <-r
+}
+
+// ModuleWatcherClient handles the changes of the files
+// in the module directories watched by DirWatcher
+type ModuleWatcherClient struct {
+	engine *ESEngine
+}
+
+func NewModuleWatcherClient(engine *ESEngine) *ModuleWatcherClient {
+	return &ModuleWatcherClient{engine}
+}
+
+// LoadFile does nothing as the modules are
+// loaded when they're required
+func (c *ModuleWatcherClient) LoadFile(path string) error {
+	return nil
+}
+
+func (c *ModuleWatcherClient) LiveLoadFile(path string) error {
+	return c.engine.ReloadModuleDependents(path)
+}
+
+func (c *ModuleWatcherClient) LiveRemoveFile(path string) error {
+	// the dependent scripts fail to load now
+	return c.engine.ReloadModuleDependents(path)
+}
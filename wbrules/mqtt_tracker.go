@@ -3,9 +3,10 @@ package wbrules
 type MqttTrackerMap map[uint32]MqttTracker
 
 type MqttTracker struct {
-	ID       uint32
-	Topic    string
-	Callback ESCallbackFunc
+	ID        uint32
+	Topic     string
+	Callback  ESCallbackFunc
+	ParseJSON bool // pass the payload parsed as JSON to the callback
 }
 
 // NewMqttTracker returns new mqtt tracker instance
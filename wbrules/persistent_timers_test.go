@@ -0,0 +1,195 @@
+package wbrules
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/contactless/wbgong/testutils"
+)
+
+type PersistentTimersSuite struct {
+	RuleSuiteBase
+	tmpDir string
+	now    time.Time
+}
+
+func (s *PersistentTimersSuite) SetupFixture() {
+	var err error
+
+	// persistent DB file must be kept between tests
+	// to check that the timers are restored
+	s.tmpDir, err = ioutil.TempDir(os.TempDir(), "wbrulestest")
+	if err != nil {
+		s.FailNow("can't create temp directory")
+	}
+	s.now = time.Date(2026, 1, 10, 12, 0, 0, 0, time.UTC)
+}
+
+func (s *PersistentTimersSuite) TearDownFixture() {
+	os.RemoveAll(s.tmpDir)
+}
+
+func (s *PersistentTimersSuite) SetupTest() {
+	s.PersistentDBFile = s.tmpDir + "/test_persistent.db"
+	s.SetupSkippingDefs()
+	s.publish("/devices/somedev/controls/foo/meta/type", "text", "somedev/foo")
+	s.Verify("tst -> /devices/somedev/controls/foo/meta/type: [text] (QoS 1, retained)")
+
+	now := s.now
+	s.engine.SetNowFunc(func() time.Time { return now })
+	s.Ck("LiveLoadScript()", s.LiveLoadScript("testrules_persistent_timers.js"))
+}
+
+// restart simulates restarting the engine after the specified
+// time, the next test checks the restored timers
+func (s *PersistentTimersSuite) restart(d time.Duration) {
+	s.now = s.now.Add(d)
+}
+
+func (s *PersistentTimersSuite) TestPersistentTimers() {
+	s.Verify("[changed] testrules_persistent_timers.js")
+
+	s.publish("/devices/somedev/controls/foo", "start", "somedev/foo")
+	s.Verify(
+		"tst -> /devices/somedev/controls/foo: [start] (QoS 1, retained)",
+		"new fake timer: 1, 3600000",
+	)
+
+	states := s.engine.LoadPersistentTimers()
+	s.Require().Contains(states, "ventilation")
+	s.Equal("testrules_persistent_timers.js", states["ventilation"].Script)
+	s.True(states["ventilation"].Deadline.Equal(s.now.Add(time.Hour)))
+
+	timers := s.engine.Schedule().Timers
+	s.Require().Len(timers, 1)
+	s.True(timers[0].Persistent)
+
+	s.restart(30 * time.Minute)
+}
+
+// the timer is restarted with the remaining time
+func (s *PersistentTimersSuite) TestPersistentTimers2() {
+	s.VerifyUnordered(
+		"new fake timer: 1, 1800000",
+		"[changed] testrules_persistent_timers.js",
+	)
+
+	s.FireTimer(1, s.AdvanceTime(30*time.Minute))
+	s.Verify(
+		"timer.fire(): 1",
+		"[info] ventilation off, late: false",
+	)
+	s.Empty(s.engine.LoadPersistentTimers())
+
+	s.publish("/devices/somedev/controls/foo", "startTimeout", "somedev/foo")
+	s.Verify(
+		"tst -> /devices/somedev/controls/foo: [startTimeout] (QoS 1, retained)",
+		"new fake timer: 2, 60000",
+	)
+
+	s.restart(time.Hour)
+}
+
+// the timer which expired while the engine was down fires at once
+func (s *PersistentTimersSuite) TestPersistentTimers3() {
+	s.VerifyUnordered(
+		"new fake timer: 1, 0",
+		"[changed] testrules_persistent_timers.js",
+	)
+
+	s.FireTimer(1, s.AdvanceTime(0))
+	s.Verify(
+		"timer.fire(): 1",
+		"[info] ventilation off, late: true",
+	)
+	s.Empty(s.engine.LoadPersistentTimers())
+
+	s.publish("/devices/somedev/controls/foo", "start", "somedev/foo")
+	s.Verify(
+		"tst -> /devices/somedev/controls/foo: [start] (QoS 1, retained)",
+		"new fake timer: 2, 3600000",
+	)
+	s.Len(s.engine.LoadPersistentTimers(), 1)
+
+	s.publish("/devices/somedev/controls/foo", "stop", "somedev/foo")
+	s.Verify(
+		"tst -> /devices/somedev/controls/foo: [stop] (QoS 1, retained)",
+		"timer.Stop(): 2",
+	)
+	s.Empty(s.engine.LoadPersistentTimers())
+}
+
+// the timers are forgotten when the script is removed
+func (s *PersistentTimersSuite) TestPersistentTimers4() {
+	s.Verify("[changed] testrules_persistent_timers.js")
+
+	s.publish("/devices/somedev/controls/foo", "start", "somedev/foo")
+	s.Verify(
+		"tst -> /devices/somedev/controls/foo: [start] (QoS 1, retained)",
+		"new fake timer: 1, 3600000",
+	)
+
+	s.RemoveScript("testrules_persistent_timers.js")
+	s.Verify(
+		"timer.Stop(): 1",
+		"[removed] testrules_persistent_timers.js",
+	)
+	s.Empty(s.engine.LoadPersistentTimers())
+}
+
+// the paused timer keeps the time left instead of the deadline
+func (s *PersistentTimersSuite) TestPersistentTimers5() {
+	s.Verify("[changed] testrules_persistent_timers.js")
+
+	s.publish("/devices/somedev/controls/foo", "start", "somedev/foo")
+	s.Verify(
+		"tst -> /devices/somedev/controls/foo: [start] (QoS 1, retained)",
+		"new fake timer: 1, 3600000",
+	)
+	s.publish("/devices/somedev/controls/foo", "pause", "somedev/foo")
+	s.Verify(
+		"tst -> /devices/somedev/controls/foo: [pause] (QoS 1, retained)",
+		"timer.Stop(): 1",
+	)
+
+	states := s.engine.LoadPersistentTimers()
+	s.Require().Contains(states, "ventilation")
+	s.True(states["ventilation"].Paused)
+	s.Equal(time.Hour, states["ventilation"].Remaining)
+	s.True(states["ventilation"].Deadline.IsZero())
+
+	s.restart(2 * time.Hour)
+}
+
+// the paused timer is restored paused and
+// counts down the time left after resume
+func (s *PersistentTimersSuite) TestPersistentTimers6() {
+	s.Verify("[changed] testrules_persistent_timers.js")
+
+	s.publish("/devices/somedev/controls/foo", "resume", "somedev/foo")
+	s.Verify(
+		"tst -> /devices/somedev/controls/foo: [resume] (QoS 1, retained)",
+		"new fake timer: 1, 3600000",
+	)
+
+	states := s.engine.LoadPersistentTimers()
+	s.Require().Contains(states, "ventilation")
+	s.False(states["ventilation"].Paused)
+	s.True(states["ventilation"].Deadline.Equal(s.now.Add(time.Hour)))
+
+	s.FireTimer(1, s.AdvanceTime(time.Hour))
+	s.Verify(
+		"timer.fire(): 1",
+		"[info] ventilation off, late: false",
+	)
+	s.Empty(s.engine.LoadPersistentTimers())
+}
+
+func TestPersistentTimersSuite(t *testing.T) {
+	s := new(PersistentTimersSuite)
+	s.SetupFixture()
+	defer s.TearDownFixture()
+	testutils.RunSuites(t, s)
+}
@@ -0,0 +1,184 @@
+package wbrules
+
+import (
+	"sort"
+	"time"
+)
+
+const (
+	// PERSISTENT_TIMERS_DB_BUCKET is the persistent DB bucket
+	// holding the states of the persistent timers
+	PERSISTENT_TIMERS_DB_BUCKET = "_wbrules_timers"
+)
+
+// PersistentTimerState is the stored state of a persistent timer
+type PersistentTimerState struct {
+	Deadline time.Time `json:"deadline"`
+	Script   string    `json:"script"`
+	// Remaining is the time left till a paused timer
+	// fires, Deadline is zero for the paused timers
+	Paused    bool          `json:"paused,omitempty"`
+	Remaining time.Duration `json:"remaining,omitempty"`
+}
+
+// PersistentTimerStorage keeps the states of persistent timers
+// across restarts
+type PersistentTimerStorage interface {
+	LoadPersistentTimers() map[string]PersistentTimerState
+	StorePersistentTimer(name string, state PersistentTimerState)
+	RemovePersistentTimer(name string)
+}
+
+func (engine *RuleEngine) SetPersistentTimerStorage(storage PersistentTimerStorage) {
+	engine.persistentTimerStorage = storage
+}
+
+// persistentTimerStates returns the states of the persistent
+// timers loading them from the storage on the first call.
+// Must be called with persistentTimersMutex locked
+func (engine *RuleEngine) persistentTimerStates() map[string]PersistentTimerState {
+	if engine.persistentTimers == nil {
+		engine.persistentTimers = make(map[string]PersistentTimerState)
+		if engine.persistentTimerStorage != nil {
+			for name, state := range engine.persistentTimerStorage.LoadPersistentTimers() {
+				engine.persistentTimers[name] = state
+			}
+		}
+	}
+	return engine.persistentTimers
+}
+
+// StartPersistentTimer starts a named one-shot timer whose deadline
+// is kept in the persistent storage, so it can be restored by
+// RestorePersistentTimers after the engine is restarted
+func (engine *RuleEngine) StartPersistentTimer(name, script string, interval time.Duration) TimerId {
+	engine.stopTimerByName(name)
+
+	state := PersistentTimerState{
+		Deadline: engine.nowFunc().Add(interval),
+		Script:   script,
+	}
+	engine.storePersistentTimer(name, state)
+	return engine.startPersistentTimer(name, script, interval, false, false)
+}
+
+// startPersistentTimer starts the timer entry of a persistent timer.
+// Paused timers keep interval as the remaining time and aren't armed
+func (engine *RuleEngine) startPersistentTimer(name, script string, interval time.Duration, late, paused bool) TimerId {
+	entry := &TimerEntry{
+		interval:   interval,
+		name:       name,
+		script:     script,
+		persistent: true,
+		late:       late,
+		active:     true,
+	}
+	if paused {
+		entry.paused = true
+		entry.remaining = interval
+	}
+	return engine.startTimerEntry(entry)
+}
+
+// RestorePersistentTimers starts the stored persistent timers
+// of the script which aren't running. The timers that expired
+// while the engine was down fire as soon as possible and are
+// marked as late. The paused timers stay paused keeping the
+// time left
+func (engine *RuleEngine) RestorePersistentTimers(script string) (ids []TimerId) {
+	states := make(map[string]PersistentTimerState)
+	names := make([]string, 0)
+	engine.persistentTimersMutex.Lock()
+	for name, state := range engine.persistentTimerStates() {
+		if state.Script == script {
+			states[name] = state
+			names = append(names, name)
+		}
+	}
+	engine.persistentTimersMutex.Unlock()
+	sort.Strings(names)
+
+	now := engine.nowFunc()
+	for _, name := range names {
+		if _, found := engine.FindTimerByName(name); found {
+			continue
+		}
+		state := states[name]
+		if state.Paused {
+			ids = append(ids, engine.startPersistentTimer(name, script, state.Remaining, false, true))
+			continue
+		}
+		interval := state.Deadline.Sub(now)
+		late := interval <= 0
+		if late {
+			interval = 0
+		}
+		ids = append(ids, engine.startPersistentTimer(name, script, interval, late, false))
+	}
+	return
+}
+
+// ForgetPersistentTimers removes the stored states of
+// the persistent timers of the script, e.g. when the
+// script is removed
+func (engine *RuleEngine) ForgetPersistentTimers(script string) {
+	engine.persistentTimersMutex.Lock()
+	defer engine.persistentTimersMutex.Unlock()
+	for name, state := range engine.persistentTimerStates() {
+		if state.Script == script {
+			engine.removePersistentTimerState(name)
+		}
+	}
+}
+
+func (engine *RuleEngine) forgetPersistentTimer(name string) {
+	engine.persistentTimersMutex.Lock()
+	defer engine.persistentTimersMutex.Unlock()
+	if _, found := engine.persistentTimerStates()[name]; found {
+		engine.removePersistentTimerState(name)
+	}
+}
+
+// removePersistentTimerState must be called
+// with persistentTimersMutex locked
+func (engine *RuleEngine) removePersistentTimerState(name string) {
+	delete(engine.persistentTimers, name)
+	if engine.persistentTimerStorage != nil {
+		engine.persistentTimerStorage.RemovePersistentTimer(name)
+	}
+}
+
+func (engine *RuleEngine) storePersistentTimer(name string, state PersistentTimerState) {
+	engine.persistentTimersMutex.Lock()
+	defer engine.persistentTimersMutex.Unlock()
+	engine.persistentTimerStates()[name] = state
+	if engine.persistentTimerStorage != nil {
+		engine.persistentTimerStorage.StorePersistentTimer(name, state)
+	}
+}
+
+// maybeUpdatePersistentTimer stores the new deadline of
+// the rescheduled persistent timer or the time left till
+// the paused one fires
+func (engine *RuleEngine) maybeUpdatePersistentTimer(entry *TimerEntry) {
+	entry.Lock()
+	persistent, name := entry.persistent, entry.name
+	state := PersistentTimerState{Script: entry.script}
+	if entry.paused {
+		state.Paused = true
+		state.Remaining = entry.remaining
+	} else {
+		state.Deadline = entry.deadline
+	}
+	entry.Unlock()
+
+	if persistent {
+		engine.storePersistentTimer(name, state)
+	}
+}
+
+// CheckTimerLate returns true if the persistent timer being
+// fired expired while the engine was down
+func (engine *RuleEngine) CheckTimerLate(timerName string) bool {
+	return engine.lateTimer && engine.CheckTimer(timerName)
+}
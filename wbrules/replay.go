@@ -0,0 +1,131 @@
+package wbrules
+
+import (
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/contactless/wbgong"
+)
+
+// Replayer runs the scripts against the events recorded
+// in the journal using the sandbox. Everything the scripts
+// publish is written to the output
+type Replayer struct {
+	out      io.Writer
+	outMutex sync.Mutex
+
+	start time.Time
+	clock *VirtualClock
+	sb    *sandbox
+}
+
+// NewReplayer creates the replay environment with the clock
+// starting at the specified time. The scripts must be loaded
+// into Engine() before Run() is called
+func NewReplayer(start time.Time, out io.Writer, options *ESEngineOptions) (r *Replayer, err error) {
+	r = &Replayer{
+		out:   out,
+		start: start,
+		clock: NewVirtualClock(start),
+	}
+	if r.sb, err = newSandbox(r.clock, r.printMessage, options); err != nil {
+		return nil, err
+	}
+	// the recorded confirmations of the control writes made
+	// by the scripts are skipped, so the sandbox must play
+	// the part of the external devices
+	r.sb.confirmExternalWrites()
+	return r, nil
+}
+
+func (r *Replayer) Engine() *ESEngine {
+	return r.sb.engine
+}
+
+// Run replays the journal entries and then keeps the clock
+// running for the specified time so the timers started
+// by the last events can fire
+func (r *Replayer) Run(entries []JournalEntry, tail time.Duration) error {
+	if err := r.sb.waitReady(); err != nil {
+		return err
+	}
+
+	end := r.clock.Now()
+	for _, entry := range entries {
+		r.clock.AdvanceTo(entry.Time, r.sb.settle)
+		r.inject(entry)
+		r.sb.settle()
+		end = entry.Time
+	}
+	r.clock.AdvanceTo(end.Add(tail), r.sb.settle)
+	return nil
+}
+
+func (r *Replayer) Close() {
+	r.sb.Close()
+}
+
+func (r *Replayer) printf(format string, args ...interface{}) {
+	r.outMutex.Lock()
+	defer r.outMutex.Unlock()
+	fmt.Fprintf(r.out, "+%s ", r.clock.Now().Sub(r.start))
+	fmt.Fprintf(r.out, format, args...)
+	fmt.Fprintln(r.out)
+}
+
+func (r *Replayer) printMessage(clientId string, msg wbgong.MQTTMessage) {
+	if clientId == SANDBOX_INJECTOR_CLIENT || strings.Contains(msg.Topic, "/meta/") {
+		return
+	}
+	suffix := ""
+	if msg.Retained {
+		suffix = " (retained)"
+	}
+	r.printf("%s -> %s: [%s]%s", clientId, msg.Topic, msg.Payload, suffix)
+}
+
+func (r *Replayer) inject(entry JournalEntry) {
+	switch entry.Kind {
+	case JOURNAL_CONTROL:
+		r.injectControl(entry)
+	case JOURNAL_MQTT:
+		r.printf("## mqtt %s: [%s]", entry.Topic, entry.Payload)
+		r.sb.publish(entry.Topic, entry.Payload, false)
+	case JOURNAL_TIMER:
+		// timers are fired by the virtual clock,
+		// the recorded ones are only shown for reference
+		name := entry.Timer
+		if name == "" {
+			name = fmt.Sprintf("#%d", entry.TimerId)
+		}
+		r.printf("## recorded timer %s", name)
+	default:
+		wbgong.Warn.Printf("replay: unknown journal entry kind: %s", entry.Kind)
+	}
+}
+
+func (r *Replayer) injectControl(entry JournalEntry) {
+	payload := formatControlValue(entry.Value)
+
+	// meta changes are passed as 'control#meta' pseudo controls
+	if i := strings.IndexByte(entry.Control, '#'); i >= 0 {
+		r.sb.publish(fmt.Sprintf("/devices/%s/controls/%s/meta/%s",
+			entry.Device, entry.Control[:i], entry.Control[i+1:]), payload, true)
+		return
+	}
+
+	if entry.Self {
+		// the change is reproduced by the scripts themselves,
+		// injecting it would make the rules fire twice
+		r.printf("## recorded write %s/%s = %s", entry.Device, entry.Control, payload)
+		return
+	}
+
+	r.printf("## control %s/%s = %s", entry.Device, entry.Control, payload)
+	// the value of a virtual device control may be already
+	// set by the scripts themselves
+	r.sb.setControl(entry.Device, entry.Control, payload, entry.Pushbutton)
+}
@@ -0,0 +1,114 @@
+package wbrules
+
+import (
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/contactless/wbgong"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMqttTopicMatch(t *testing.T) {
+	assert.True(t, mqttTopicMatch("/devices/+/controls/+", "/devices/dev/controls/foo"))
+	assert.False(t, mqttTopicMatch("/devices/+/controls/+", "/devices/dev/controls/foo/on"))
+	assert.True(t, mqttTopicMatch("/devices/dev/#", "/devices/dev/controls/foo/meta/type"))
+	assert.True(t, mqttTopicMatch("/a/b", "/a/b"))
+	assert.False(t, mqttTopicMatch("/a/b/c", "/a/b"))
+}
+
+func TestFormatControlValue(t *testing.T) {
+	assert.Equal(t, "1", formatControlValue(true))
+	assert.Equal(t, "0", formatControlValue(false))
+	assert.Equal(t, "21.5", formatControlValue(21.5))
+	assert.Equal(t, "42", formatControlValue(42.0))
+	assert.Equal(t, "abc", formatControlValue("abc"))
+	assert.Equal(t, "", formatControlValue(nil))
+}
+
+func TestVirtualClock(t *testing.T) {
+	start := time.Date(2017, 7, 14, 2, 40, 0, 0, time.UTC)
+	clock := NewVirtualClock(start)
+
+	timer := clock.NewTimer(1, 3*time.Second, false)
+	ticker := clock.NewTimer(2, 2*time.Second, true)
+	stopped := clock.NewTimer(3, time.Second, false)
+	stopped.Stop()
+
+	cron := clock.NewCron()
+	cronFired := 0
+	assert.NoError(t, cron.AddFunc("@every 4s", func() { cronFired++ }))
+	cron.Start()
+
+	var fired []time.Duration
+	settle := func() {
+		select {
+		case ts := <-timer.GetChannel():
+			fired = append(fired, ts.Sub(start))
+		case ts := <-ticker.GetChannel():
+			fired = append(fired, ts.Sub(start))
+		default:
+		}
+	}
+	clock.AdvanceTo(start.Add(5*time.Second), settle)
+
+	assert.Equal(t, []time.Duration{2 * time.Second, 3 * time.Second, 4 * time.Second}, fired)
+	assert.Equal(t, 1, cronFired)
+	assert.Equal(t, start.Add(5*time.Second), clock.Now())
+
+	// the clock never goes back
+	clock.AdvanceTo(start, settle)
+	assert.Equal(t, start.Add(5*time.Second), clock.Now())
+}
+
+func TestSandboxClientWaitForRetained(t *testing.T) {
+	broker := newSandboxBroker(nil)
+	defer broker.stop()
+
+	publisher := broker.newClient("publisher")
+	publisher.Publish(wbgong.MQTTMessage{Topic: "/a/b", Payload: "1", QoS: 1, Retained: true})
+	publisher.Publish(wbgong.MQTTMessage{Topic: "/a/c", Payload: "2", QoS: 1, Retained: true})
+
+	var received []string
+	done := make(chan struct{})
+	client := broker.newClient("client")
+	client.Subscribe(func(msg wbgong.MQTTMessage) {
+		received = append(received, msg.Topic+"="+msg.Payload)
+	}, "/a/+")
+	client.WaitForRetained(func() { close(done) })
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("WaitForRetained callback is not invoked")
+	}
+	sort.Strings(received)
+	assert.Equal(t, []string{"/a/b=1", "/a/c=2"}, received)
+}
+
+func TestReplaySkipsRulesWrites(t *testing.T) {
+	start := time.Date(2017, 7, 14, 2, 40, 0, 0, time.UTC)
+	var out lockedBuffer
+	r, err := NewReplayer(start, &out, NewESEngineOptions())
+	require.NoError(t, err)
+	defer r.Close()
+	require.NoError(t, r.Engine().LoadFile("testrules_replay.js"))
+
+	at := func(ms int) time.Time {
+		return start.Add(time.Duration(ms) * time.Millisecond)
+	}
+	require.NoError(t, r.Run([]JournalEntry{
+		{Time: at(100), Kind: JOURNAL_CONTROL, Device: "room", Control: "button#type", Value: "switch", Retained: true},
+		{Time: at(100), Kind: JOURNAL_CONTROL, Device: "room", Control: "relay#type", Value: "switch", Retained: true},
+		{Time: at(1000), Kind: JOURNAL_CONTROL, Device: "room", Control: "button", Value: true},
+		// the relay confirms the write made by buttonToRelay
+		{Time: at(1100), Kind: JOURNAL_CONTROL, Device: "room", Control: "relay", Value: true, Retained: true, Self: true},
+	}, time.Second))
+
+	output := out.String()
+	assert.Equal(t, 1, strings.Count(output, "/devices/room/controls/relay/on: [1]"), output)
+	assert.Equal(t, 1, strings.Count(output, "relay: true"), output)
+	assert.Contains(t, output, "## recorded write room/relay = 1")
+}
@@ -0,0 +1,195 @@
+package wbrules
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	wbgong "github.com/contactless/wbgong"
+)
+
+const (
+	// RPC_CLIENT_ID_PREFIX starts the client id part of
+	// MQTT RPC request topics used by rpcCall()
+	RPC_CLIENT_ID_PREFIX       = "wb-rules"
+	RPC_CLIENT_DEFAULT_TIMEOUT = 10 * time.Second
+)
+
+// RPCError is an error returned by MQTT RPC service or
+// a client side error such as request timeout
+type RPCError struct {
+	Code    int             `json:"code"`
+	Message string          `json:"message"`
+	Data    json.RawMessage `json:"data,omitempty"`
+	Timeout bool            `json:"-"`
+}
+
+func (e *RPCError) Error() string {
+	return fmt.Sprintf("RPC error %d: %s", e.Code, e.Message)
+}
+
+// RPCCallback receives either the result or the error
+// of MQTT RPC call. It's invoked outside of the sync loop
+type RPCCallback func(result json.RawMessage, err *RPCError)
+
+type rpcClientRequest struct {
+	Id     uint64          `json:"id"`
+	Params json.RawMessage `json:"params"`
+}
+
+type rpcClientResponse struct {
+	Id     uint64          `json:"id"`
+	Result json.RawMessage `json:"result"`
+	Error  *RPCError       `json:"error"`
+}
+
+type pendingRPCCall struct {
+	callback RPCCallback
+	timer    *time.Timer
+}
+
+// rpcClient performs MQTT RPC calls to other services.
+// The reply topics are subscribed to on the first call
+// of the method and stay subscribed
+type rpcClient struct {
+	mutex      sync.Mutex
+	mqttClient wbgong.MQTTClient
+	clientId   string
+	nextId     uint64
+	pending    map[uint64]*pendingRPCCall
+	subscribed map[string]bool
+}
+
+func newRPCClient(mqttClient wbgong.MQTTClient) *rpcClient {
+	return &rpcClient{
+		mqttClient: mqttClient,
+		clientId:   newRPCClientId(),
+		nextId:     1,
+		pending:    make(map[uint64]*pendingRPCCall),
+		subscribed: make(map[string]bool),
+	}
+}
+
+// newRPCClientId returns the client id unique for the engine
+// instance, so the replies to the requests made by another
+// wb-rules process or before the restart aren't taken for
+// the replies to the requests of this one
+func newRPCClientId() string {
+	var suffix [4]byte
+	rand.Read(suffix[:])
+	return fmt.Sprintf("%s-%d-%s", RPC_CLIENT_ID_PREFIX, os.Getpid(), hex.EncodeToString(suffix[:]))
+}
+
+func validRPCTopicPart(s string) bool {
+	return s != "" && !strings.ContainsAny(s, "/+#")
+}
+
+func (c *rpcClient) call(driver, service, method string, params json.RawMessage, timeout time.Duration, callback RPCCallback) error {
+	if !validRPCTopicPart(driver) || !validRPCTopicPart(service) || !validRPCTopicPart(method) {
+		return fmt.Errorf("invalid RPC method %s/%s/%s", driver, service, method)
+	}
+	if len(params) == 0 {
+		params = json.RawMessage("null")
+	}
+	if timeout <= 0 {
+		timeout = RPC_CLIENT_DEFAULT_TIMEOUT
+	}
+
+	topic := fmt.Sprintf("/rpc/v1/%s/%s/%s/%s", driver, service, method, c.clientId)
+
+	c.mutex.Lock()
+	id := c.nextId
+	c.nextId++
+	payload, err := json.Marshal(rpcClientRequest{id, params})
+	if err != nil {
+		c.mutex.Unlock()
+		return err
+	}
+	if !c.subscribed[topic] {
+		c.subscribed[topic] = true
+		c.mqttClient.Subscribe(c.handleReply, topic+"/reply")
+	}
+	c.pending[id] = &pendingRPCCall{
+		callback: callback,
+		timer: time.AfterFunc(timeout, func() {
+			if call := c.takePending(id); call != nil {
+				call.callback(nil, &RPCError{
+					Message: fmt.Sprintf("request timed out after %s", timeout),
+					Timeout: true,
+				})
+			}
+		}),
+	}
+	c.mutex.Unlock()
+
+	c.mqttClient.Start()
+	c.mqttClient.Publish(wbgong.MQTTMessage{
+		Topic:   topic,
+		Payload: string(payload),
+		QoS:     1,
+	})
+	return nil
+}
+
+// takePending removes the pending call stopping its timer.
+// Returns nil if the call is already done
+func (c *rpcClient) takePending(id uint64) *pendingRPCCall {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	call, found := c.pending[id]
+	if !found {
+		return nil
+	}
+	delete(c.pending, id)
+	call.timer.Stop()
+	return call
+}
+
+func (c *rpcClient) handleReply(msg wbgong.MQTTMessage) {
+	var resp rpcClientResponse
+	if err := json.Unmarshal([]byte(msg.Payload), &resp); err != nil {
+		wbgong.Error.Printf("bad RPC reply in %s: %s", msg.Topic, err)
+		return
+	}
+	call := c.takePending(resp.Id)
+	if call == nil {
+		// timed out or not ours
+		wbgong.Debug.Printf("ignoring RPC reply with unknown id %d in %s", resp.Id, msg.Topic)
+		return
+	}
+	switch {
+	case resp.Error != nil:
+		call.callback(nil, resp.Error)
+	case len(resp.Result) == 0:
+		call.callback(json.RawMessage("null"), nil)
+	default:
+		call.callback(resp.Result, nil)
+	}
+}
+
+// cancelAll drops the pending calls without
+// invoking their callbacks
+func (c *rpcClient) cancelAll() {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	for id, call := range c.pending {
+		call.timer.Stop()
+		delete(c.pending, id)
+	}
+}
+
+// CallRPC calls the method of MQTT RPC service of another driver.
+// The callback is invoked in the sync loop unless the engine is
+// stopped before the reply comes or the call times out
+func (engine *RuleEngine) CallRPC(driver, service, method string, params json.RawMessage, timeout time.Duration, callback RPCCallback) error {
+	return engine.rpc.call(driver, service, method, params, timeout, func(result json.RawMessage, err *RPCError) {
+		engine.CallSync(func() {
+			callback(result, err)
+		})
+	})
+}
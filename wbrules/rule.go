@@ -1,6 +1,10 @@
 package wbrules
 
 import (
+	"fmt"
+	"sync"
+	"time"
+
 	wbgong "github.com/contactless/wbgong"
 	"github.com/stretchr/objx"
 )
@@ -14,6 +18,8 @@ type DepTracker interface {
 	StoreRuleControlSpec(rule *Rule, ctrlSpec ControlSpec)
 	StoreRuleDeps(rule *Rule)
 	SetUninitializedRule(rule *Rule)
+	EnterRule(rule *Rule)
+	LeaveRule(rule *Rule)
 }
 
 type Cron interface {
@@ -225,6 +231,84 @@ func (ruleCond *OrRuleCondition) Check(e *ControlChangeEvent) (bool, interface{}
 	return res, newValue
 }
 
+// RuleTimerFunc starts a one-shot timer which invokes
+// the callback in the engine's sync loop
+type RuleTimerFunc func(interval time.Duration, callback func()) TimerId
+
+// DurationRuleCondition wraps 'when' or 'asSoonAs' condition
+// making it fire only after the condition holds for
+// the specified time
+type DurationRuleCondition struct {
+	RuleConditionBase
+	cond           func() bool
+	levelTriggered bool
+	interval       time.Duration
+
+	startTimer RuleTimerFunc
+	stopTimer  func(id TimerId)
+	onElapsed  func()
+
+	timer   TimerId // 0 if there's no active timer
+	elapsed bool
+	fired   bool
+}
+
+func NewDurationRuleCondition(cond func() bool, levelTriggered bool, interval time.Duration,
+	startTimer RuleTimerFunc, stopTimer func(id TimerId)) *DurationRuleCondition {
+	return &DurationRuleCondition{
+		cond:           cond,
+		levelTriggered: levelTriggered,
+		interval:       interval,
+		startTimer:     startTimer,
+		stopTimer:      stopTimer,
+	}
+}
+
+// SetOnElapsed sets the function which is invoked when the condition
+// has held for the specified time, it must make the rule checked
+func (ruleCond *DurationRuleCondition) SetOnElapsed(onElapsed func()) {
+	ruleCond.onElapsed = onElapsed
+}
+
+func (ruleCond *DurationRuleCondition) Check(e *ControlChangeEvent) (bool, interface{}) {
+	if !ruleCond.cond() {
+		ruleCond.reset()
+		return false, nil
+	}
+
+	if !ruleCond.elapsed {
+		if ruleCond.timer == 0 {
+			ruleCond.timer = ruleCond.startTimer(ruleCond.interval, ruleCond.expire)
+		}
+		return false, nil
+	}
+
+	if ruleCond.levelTriggered {
+		return true, nil
+	}
+	// edge-triggered rule fires once per holding period
+	shouldFire := !ruleCond.fired
+	ruleCond.fired = true
+	return shouldFire, nil
+}
+
+func (ruleCond *DurationRuleCondition) reset() {
+	if ruleCond.timer != 0 {
+		ruleCond.stopTimer(ruleCond.timer)
+		ruleCond.timer = 0
+	}
+	ruleCond.elapsed = false
+	ruleCond.fired = false
+}
+
+func (ruleCond *DurationRuleCondition) expire() {
+	ruleCond.timer = 0
+	ruleCond.elapsed = true
+	if ruleCond.onElapsed != nil {
+		ruleCond.onElapsed()
+	}
+}
+
 type CronRuleCondition struct {
 	RuleConditionBase
 	spec string
@@ -243,6 +327,70 @@ func (ruleCond *CronRuleCondition) MaybeAddToCron(cron Cron, thunk func()) (adde
 // RuleId is returned from defineRule to control rule
 type RuleId uint32
 
+// RuleStats holds execution statistics of a rule.
+// It's updated from the engine's sync loop and may be read
+// from any goroutine.
+type RuleStats struct {
+	sync.Mutex
+	FireCount     uint64
+	LastFired     time.Time
+	LastDuration  time.Duration
+	MaxDuration   time.Duration
+	LastError     string
+	SkippedChecks uint64
+}
+
+func (stats *RuleStats) recordFire(start time.Time, d time.Duration, err *ESError) {
+	stats.Lock()
+	defer stats.Unlock()
+
+	stats.FireCount++
+	stats.LastFired = start
+	stats.LastDuration = d
+	if d > stats.MaxDuration {
+		stats.MaxDuration = d
+	}
+	if err != nil {
+		stats.LastError = err.Error()
+	}
+}
+
+func (stats *RuleStats) recordSkip() {
+	stats.Lock()
+	defer stats.Unlock()
+
+	stats.SkippedChecks++
+}
+
+// RuleStatsEntry is a snapshot of rule statistics
+// suitable for JSON encoding
+type RuleStatsEntry struct {
+	Id            RuleId   `json:"id"`
+	Name          string   `json:"name"`
+	Priority      int      `json:"priority"`
+	Tags          []string `json:"tags,omitempty"`
+	Order         int      `json:"order"` // position in the rule checking order
+	FireCount     uint64   `json:"fireCount"`
+	LastFired     int64    `json:"lastFired"`    // unix time in ms, 0 if never fired
+	LastDuration  float64  `json:"lastDuration"` // ms
+	MaxDuration   float64  `json:"maxDuration"`  // ms
+	LastError     string   `json:"lastError,omitempty"`
+	SkippedChecks uint64   `json:"skippedChecks"`
+}
+
+// SourceLocation points to a place in the script source
+type SourceLocation struct {
+	File string `json:"file,omitempty"`
+	Line int    `json:"line,omitempty"`
+}
+
+func (loc SourceLocation) String() string {
+	if loc.File == "" {
+		return "<unknown>"
+	}
+	return fmt.Sprintf("%s:%d", loc.File, loc.Line)
+}
+
 type Rule struct {
 	tracker       DepTracker
 	id            RuleId
@@ -254,6 +402,11 @@ type Rule struct {
 	isIndependent bool
 	hasDeps       bool
 	enabled       bool
+	location      SourceLocation
+	priority      int // rules with higher priority are checked first
+	tags          []*RuleTag
+	limiter       *RuleLimiter // debounce/throttle, optional
+	stats         RuleStats
 }
 
 func NewRule(tracker DepTracker, id RuleId, name string, cond RuleCondition, then ESCallbackFunc) *Rule {
@@ -292,6 +445,7 @@ func (rule *Rule) Check(e *ControlChangeEvent) {
 		// condition callback changed. If rules are run
 		// not due to a cell being changed, still need
 		// to call JS though.
+		rule.stats.recordSkip()
 		return
 	}
 	rule.tracker.StartTrackingDeps()
@@ -300,7 +454,7 @@ func (rule *Rule) Check(e *ControlChangeEvent) {
 	rule.tracker.StoreRuleDeps(rule)
 	rule.shouldCheck = false
 
-	if rule.enabled {
+	if rule.isActive() {
 		switch {
 		case !shouldFire:
 			return
@@ -313,19 +467,131 @@ func (rule *Rule) Check(e *ControlChangeEvent) {
 				"device":   e.Spec.DeviceId,
 				"cell":     e.Spec.ControlId,
 				"newValue": e.Value,
+				"oldValue": e.OldValue,
+				"meta": map[string]interface{}{
+					"timestamp": e.Timestamp.UnixNano() / int64(time.Millisecond),
+					"retained":  e.IsRetained,
+				},
 			})
 		}
 		if wbgong.DebuggingEnabled() {
 			wbgong.Debug.Printf("[rule] firing Rule ruleId=%d", rule.id)
 		}
-		rule.then(args)
+		if rule.limiter != nil {
+			rule.limiter.Trigger(rule, args)
+		} else {
+			rule.Fire(args)
+		}
 	}
 }
 
+// SetTags sets the tags of the rule
+func (rule *Rule) SetTags(tags []*RuleTag) {
+	rule.tags = tags
+}
+
+// isActive returns true if the rule is enabled
+// and all of its tags are enabled
+func (rule *Rule) isActive() bool {
+	return rule.enabled && rule.tagsEnabled()
+}
+
+// tagsEnabled returns true if all of the rule tags are enabled
+func (rule *Rule) tagsEnabled() bool {
+	for _, tag := range rule.tags {
+		if !tag.Enabled() {
+			return false
+		}
+	}
+	return true
+}
+
+// SetPriority sets rule priority. Must be called before
+// the rule is defined in the engine
+func (rule *Rule) SetPriority(priority int) {
+	rule.priority = priority
+}
+
+// checkedBefore returns true if the rule must be checked before
+// the other one. The rules are ordered by priority (higher first),
+// then by file name and then by definition order, so the order
+// doesn't depend on the order of file loading
+func (rule *Rule) checkedBefore(other *Rule) bool {
+	switch {
+	case rule.priority != other.priority:
+		return rule.priority > other.priority
+	case rule.location.File != other.location.File:
+		return rule.location.File < other.location.File
+	default:
+		return rule.id < other.id
+	}
+}
+
+// SetLimiter makes the rule fire through the specified
+// debounce/throttle limiter
+func (rule *Rule) SetLimiter(limiter *RuleLimiter) {
+	rule.limiter = limiter
+}
+
+// Fire invokes rule's 'then' callback and updates
+// rule statistics
+func (rule *Rule) Fire(args objx.Map) {
+	if rule.context != nil {
+		rule.context.lastCallbackError = nil
+		prevRule := rule.context.currentRule
+		rule.context.currentRule = rule.name
+		defer func() { rule.context.currentRule = prevRule }()
+	}
+
+	rule.tracker.EnterRule(rule)
+	start := time.Now()
+	rule.then(args)
+	d := time.Since(start)
+	rule.tracker.LeaveRule(rule)
+
+	var err *ESError
+	if rule.context != nil {
+		err = rule.context.lastCallbackError
+	}
+	rule.stats.recordFire(start, d, err)
+}
+
+// Stats returns a snapshot of rule execution statistics
+func (rule *Rule) Stats() RuleStatsEntry {
+	rule.stats.Lock()
+	defer rule.stats.Unlock()
+
+	entry := RuleStatsEntry{
+		Id:            rule.id,
+		Name:          rule.name,
+		Priority:      rule.priority,
+		FireCount:     rule.stats.FireCount,
+		LastDuration:  durationToMs(rule.stats.LastDuration),
+		MaxDuration:   durationToMs(rule.stats.MaxDuration),
+		LastError:     rule.stats.LastError,
+		SkippedChecks: rule.stats.SkippedChecks,
+	}
+	if !rule.stats.LastFired.IsZero() {
+		entry.LastFired = rule.stats.LastFired.UnixNano() / int64(time.Millisecond)
+	}
+	for _, tag := range rule.tags {
+		entry.Tags = append(entry.Tags, tag.Name())
+	}
+	return entry
+}
+
+func durationToMs(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
+
 func (rule *Rule) MaybeAddToCron(cron Cron) {
 	var err error
 	rule.isIndependent, err = rule.cond.MaybeAddToCron(cron, func() {
-		rule.then(nil)
+		// disableRule() doesn't affect cron rules,
+		// but disabled tags do
+		if rule.tagsEnabled() {
+			rule.Fire(nil)
+		}
 	})
 	if err != nil {
 		wbgong.Error.Printf("rule %s: invalid cron spec: %s", rule.name, err)
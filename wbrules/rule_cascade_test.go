@@ -0,0 +1,93 @@
+package wbrules
+
+import (
+	"regexp"
+	"testing"
+	"time"
+
+	"github.com/contactless/wbgong/testutils"
+)
+
+type RuleCascadeSuite struct {
+	RuleSuiteBase
+}
+
+func (s *RuleCascadeSuite) SetupTest() {
+	s.EngineOptions = NewESEngineOptions()
+	s.EngineOptions.SetMaxCascadeDepth(3)
+	s.EngineOptions.SetDisableCascadingRules(true)
+	s.SetupSkippingDefs("testrules_cascade.js")
+}
+
+func (s *RuleCascadeSuite) TestCascadeLimit() {
+	s.publish("/devices/cascade/controls/a/on", "1",
+		"cascade/a", "cascade/b", "cascade/a", "cascade/b", "cascade/a")
+	s.VerifyUnordered(
+		"tst -> /devices/cascade/controls/a/on: [1] (QoS 1)",
+		"driver -> /devices/cascade/controls/a: [1] (QoS 1, retained)",
+		"[info] pingA: 1",
+		"[info] watchA: 1",
+		"driver -> /devices/cascade/controls/b: [2] (QoS 1, retained)",
+		"[info] pingB: 2",
+		"driver -> /devices/cascade/controls/a: [3] (QoS 1, retained)",
+		"[info] pingA: 3",
+		"[info] watchA: 3",
+		"driver -> /devices/cascade/controls/b: [4] (QoS 1, retained)",
+		"[info] pingB: 4",
+		"driver -> /devices/cascade/controls/a: [5] (QoS 1, retained)",
+		// the rules which aren't in the cascade still run
+		"[info] watchA: 5",
+		regexp.MustCompile(`rule cascade depth limit \(3\) exceeded on cascade/a change: `+
+			`pingA \(.*testrules_cascade\.js:\d+\) -> pingB \(.*\) -> pingA \(.*\) -> pingB \(.*\)`),
+		regexp.MustCompile(`disabling rules involved in the cascade: `+
+			`pingA \(.*testrules_cascade\.js:\d+\), pingB \(.*testrules_cascade\.js:\d+\)\]`),
+	)
+	s.EnsureGotErrors()
+
+	// the rules are disabled now
+	s.publish("/devices/cascade/controls/a/on", "10", "cascade/a")
+	s.Verify(
+		"tst -> /devices/cascade/controls/a/on: [10] (QoS 1)",
+		"driver -> /devices/cascade/controls/a: [10] (QoS 1, retained)",
+		"[info] watchA: 10",
+	)
+}
+
+func (s *RuleCascadeSuite) TestTimerCascade() {
+	s.publish("/devices/cascade/controls/c/on", "1", "cascade/c")
+	s.Verify(
+		"tst -> /devices/cascade/controls/c/on: [1] (QoS 1)",
+		"driver -> /devices/cascade/controls/c: [1] (QoS 1, retained)",
+		"new fake timer: 1, 100",
+	)
+
+	// the writes made by the timer continue the cascade
+	// of the rule which started it
+	s.FireTimer(1, s.AdvanceTime(100*time.Millisecond))
+	s.VerifyUnordered(
+		"timer.fire(): 1",
+		"driver -> /devices/cascade/controls/d: [2] (QoS 1, retained)",
+		"[info] pongD: 2",
+		"driver -> /devices/cascade/controls/c: [3] (QoS 1, retained)",
+		"new fake timer: 2, 100",
+	)
+
+	s.FireTimer(2, s.AdvanceTime(100*time.Millisecond))
+	s.VerifyUnordered(
+		"timer.fire(): 2",
+		"driver -> /devices/cascade/controls/d: [4] (QoS 1, retained)",
+		"[info] pongD: 4",
+		"driver -> /devices/cascade/controls/c: [5] (QoS 1, retained)",
+		regexp.MustCompile(`rule cascade depth limit \(3\) exceeded on cascade/c change: `+
+			`delayedC \(.*\) -> pongD \(.*\) -> delayedC \(.*\) -> pongD \(.*\)`),
+		regexp.MustCompile(`disabling rules involved in the cascade: `+
+			`delayedC \(.*testrules_cascade\.js:\d+\), pongD \(.*testrules_cascade\.js:\d+\)\]`),
+	)
+	s.EnsureGotErrors()
+}
+
+func TestRuleCascadeSuite(t *testing.T) {
+	testutils.RunSuites(t,
+		new(RuleCascadeSuite),
+	)
+}
@@ -0,0 +1,112 @@
+package wbrules
+
+import (
+	"testing"
+	"time"
+
+	"github.com/contactless/wbgong/testutils"
+)
+
+type RuleDebounceSuite struct {
+	RuleSuiteBase
+}
+
+func (s *RuleDebounceSuite) SetupTest() {
+	s.SetupSkippingDefs("testrules_debounce.js")
+}
+
+func (s *RuleDebounceSuite) publishTextControl(name string) {
+	s.publish("/devices/somedev/controls/"+name+"/meta/type", "text", "somedev/"+name)
+	s.Verify("tst -> /devices/somedev/controls/" + name + "/meta/type: [text] (QoS 1, retained)")
+}
+
+func (s *RuleDebounceSuite) TestDebounce() {
+	s.publishTextControl("foo")
+
+	s.publish("/devices/somedev/controls/foo", "a", "somedev/foo")
+	s.Verify(
+		"tst -> /devices/somedev/controls/foo: [a] (QoS 1, retained)",
+		"new fake timer: 1, 500",
+	)
+
+	s.publish("/devices/somedev/controls/foo", "b", "somedev/foo")
+	s.Verify(
+		"tst -> /devices/somedev/controls/foo: [b] (QoS 1, retained)",
+		"timer.Stop(): 1",
+		"new fake timer: 2, 500",
+	)
+
+	s.FireTimer(2, s.AdvanceTime(500*time.Millisecond))
+	s.Verify(
+		"timer.fire(): 2",
+		"[info] debounced: b",
+	)
+}
+
+func (s *RuleDebounceSuite) TestThrottle() {
+	s.publishTextControl("bar")
+
+	s.publish("/devices/somedev/controls/bar", "1", "somedev/bar")
+	s.VerifyUnordered(
+		"tst -> /devices/somedev/controls/bar: [1] (QoS 1, retained)",
+		"[info] throttled: 1",
+		"new fake timer: 1, 500",
+	)
+
+	s.publish("/devices/somedev/controls/bar", "2", "somedev/bar")
+	s.publish("/devices/somedev/controls/bar", "3", "somedev/bar")
+	s.Verify(
+		"tst -> /devices/somedev/controls/bar: [2] (QoS 1, retained)",
+		"tst -> /devices/somedev/controls/bar: [3] (QoS 1, retained)",
+	)
+
+	// the latest value is delivered at the end of the interval,
+	// starting a new one
+	s.FireTimer(1, s.AdvanceTime(500*time.Millisecond))
+	s.VerifyUnordered(
+		"timer.fire(): 1",
+		"new fake timer: 2, 500",
+		"[info] throttled: 3",
+	)
+
+	// nothing happened during the second interval
+	s.FireTimer(2, s.AdvanceTime(1000*time.Millisecond))
+	s.Verify("timer.fire(): 2")
+
+	s.publish("/devices/somedev/controls/bar", "4", "somedev/bar")
+	s.VerifyUnordered(
+		"tst -> /devices/somedev/controls/bar: [4] (QoS 1, retained)",
+		"[info] throttled: 4",
+		"new fake timer: 3, 500",
+	)
+}
+
+func (s *RuleDebounceSuite) TestDebounceLeading() {
+	s.publishTextControl("baz")
+
+	s.publish("/devices/somedev/controls/baz", "on", "somedev/baz")
+	s.VerifyUnordered(
+		"tst -> /devices/somedev/controls/baz: [on] (QoS 1, retained)",
+		"[info] debouncedLeading fired",
+		"new fake timer: 1, 300",
+	)
+
+	// bouncing within the interval is suppressed
+	s.publish("/devices/somedev/controls/baz", "off", "somedev/baz")
+	s.publish("/devices/somedev/controls/baz", "on", "somedev/baz")
+	s.Verify(
+		"tst -> /devices/somedev/controls/baz: [off] (QoS 1, retained)",
+		"tst -> /devices/somedev/controls/baz: [on] (QoS 1, retained)",
+		"timer.Stop(): 1",
+		"new fake timer: 2, 300",
+	)
+
+	s.FireTimer(2, s.AdvanceTime(300*time.Millisecond))
+	s.Verify("timer.fire(): 2")
+}
+
+func TestRuleDebounceSuite(t *testing.T) {
+	testutils.RunSuites(t,
+		new(RuleDebounceSuite),
+	)
+}
@@ -0,0 +1,92 @@
+package wbrules
+
+import (
+	"testing"
+	"time"
+
+	"github.com/contactless/wbgong/testutils"
+)
+
+type RuleForSuite struct {
+	RuleSuiteBase
+}
+
+func (s *RuleForSuite) SetupTest() {
+	s.SetupSkippingDefs("testrules_for.js")
+}
+
+func (s *RuleForSuite) publishControl(name, controlType string) {
+	s.publish("/devices/somedev/controls/"+name+"/meta/type", controlType, "somedev/"+name)
+	s.Verify("tst -> /devices/somedev/controls/" + name + "/meta/type: [" + controlType + "] (QoS 1, retained)")
+}
+
+func (s *RuleForSuite) TestAsSoonAsFor() {
+	s.publishControl("door", "text")
+
+	s.publish("/devices/somedev/controls/door", "open", "somedev/door")
+	s.Verify(
+		"tst -> /devices/somedev/controls/door: [open] (QoS 1, retained)",
+		"new fake timer: 1, 5000",
+	)
+
+	s.FireTimer(1, s.AdvanceTime(5000*time.Millisecond))
+	s.Verify(
+		"timer.fire(): 1",
+		"[info] door open for 5s",
+	)
+
+	// the rule fires only once while the condition holds
+	s.publish("/devices/somedev/controls/door", "open", "somedev/door")
+	s.Verify("tst -> /devices/somedev/controls/door: [open] (QoS 1, retained)")
+
+	// the condition must hold for the whole interval
+	s.publish("/devices/somedev/controls/door", "closed", "somedev/door")
+	s.publish("/devices/somedev/controls/door", "open", "somedev/door")
+	s.Verify(
+		"tst -> /devices/somedev/controls/door: [closed] (QoS 1, retained)",
+		"tst -> /devices/somedev/controls/door: [open] (QoS 1, retained)",
+		"new fake timer: 2, 5000",
+	)
+	s.publish("/devices/somedev/controls/door", "closed", "somedev/door")
+	s.Verify(
+		"tst -> /devices/somedev/controls/door: [closed] (QoS 1, retained)",
+		"timer.Stop(): 2",
+	)
+}
+
+func (s *RuleForSuite) TestWhenFor() {
+	s.publishControl("temp", "temperature")
+
+	s.publish("/devices/somedev/controls/temp", "31", "somedev/temp")
+	s.Verify(
+		"tst -> /devices/somedev/controls/temp: [31] (QoS 1, retained)",
+		"new fake timer: 1, 1000",
+	)
+
+	s.FireTimer(1, s.AdvanceTime(1000*time.Millisecond))
+	s.Verify(
+		"timer.fire(): 1",
+		"[info] still hot: 31",
+	)
+
+	// 'when' rule keeps firing while the condition holds
+	s.publish("/devices/somedev/controls/temp", "32", "somedev/temp")
+	s.Verify(
+		"tst -> /devices/somedev/controls/temp: [32] (QoS 1, retained)",
+		"[info] still hot: 32",
+	)
+
+	s.publish("/devices/somedev/controls/temp", "25", "somedev/temp")
+	s.publish("/devices/somedev/controls/temp", "33", "somedev/temp")
+	s.Verify(
+		"tst -> /devices/somedev/controls/temp: [25] (QoS 1, retained)",
+		"tst -> /devices/somedev/controls/temp: [33] (QoS 1, retained)",
+		"new fake timer: 2, 1000",
+	)
+}
+
+func TestRuleForSuite(t *testing.T) {
+	testutils.RunSuites(t,
+		new(RuleForSuite),
+	)
+}
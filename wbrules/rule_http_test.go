@@ -0,0 +1,86 @@
+package wbrules
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"testing"
+	"time"
+
+	"github.com/contactless/wbgong"
+	"github.com/contactless/wbgong/testutils"
+)
+
+func httpTestHandler(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path == "/slow" {
+		time.Sleep(300 * time.Millisecond)
+	}
+	body, _ := ioutil.ReadAll(r.Body)
+	w.Header().Set("X-Test", r.Header.Get("X-Req"))
+	if r.Method == http.MethodPost {
+		w.WriteHeader(http.StatusCreated)
+	}
+	fmt.Fprintf(w, "%s %s %s", r.Method, r.URL.Path, body)
+}
+
+type RuleHttpSuite struct {
+	RuleSuiteBase
+	server *httptest.Server
+}
+
+func (s *RuleHttpSuite) SetupTest() {
+	s.server = httptest.NewServer(http.HandlerFunc(httpTestHandler))
+	s.SetupSkippingDefs("testrules_http.js")
+}
+
+func (s *RuleHttpSuite) TearDownTest() {
+	s.RuleSuiteBase.TearDownTest()
+	s.server.Close()
+}
+
+func (s *RuleHttpSuite) request(format string, v ...interface{}) {
+	options := fmt.Sprintf(format, v...)
+	s.client.Publish(wbgong.MQTTMessage{Topic: "/http-test/request", Payload: options, QoS: 1, Retained: false})
+	s.Verify("tst -> /http-test/request: [" + options + "] (QoS 1)")
+}
+
+func (s *RuleHttpSuite) TestGet() {
+	s.request(`{"url": "%s/get", "headers": {"X-Req": "foo"}}`, s.server.URL)
+	s.Verify("[info] http response: 200 foo [GET /get ]")
+}
+
+func (s *RuleHttpSuite) TestPost() {
+	s.request(`{"url": "%s/post", "method": "POST", "headers": {"X-Req": 42}, "body": {"a": 1}}`, s.server.URL)
+	s.Verify(`[info] http response: 201 42 [POST /post {"a":1}]`)
+}
+
+func (s *RuleHttpSuite) TestTimeout() {
+	s.request(`{"url": "%s/slow", "timeout": 50}`, s.server.URL)
+	s.Verify(regexp.MustCompile(`http error: .*context deadline exceeded`))
+}
+
+func (s *RuleHttpSuite) TestConnectionError() {
+	url := s.server.URL
+	s.server.Close()
+	s.request(`{"url": "%s/get"}`, url)
+	s.Verify(regexp.MustCompile(`http error: .*connection refused`))
+}
+
+func (s *RuleHttpSuite) TestTLS() {
+	server := httptest.NewTLSServer(http.HandlerFunc(httpTestHandler))
+	defer server.Close()
+
+	s.request(`{"url": "%s/get"}`, server.URL)
+	s.Verify(regexp.MustCompile(`http error: .*certificate`))
+
+	s.request(`{"url": "%s/get", "tls": {"insecureSkipVerify": true}}`, server.URL)
+	s.Verify("[info] http response: 200  [GET /get ]")
+}
+
+func TestRuleHttpSuite(t *testing.T) {
+	testutils.RunSuites(t,
+		new(RuleHttpSuite),
+	)
+}
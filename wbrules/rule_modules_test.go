@@ -1,8 +1,11 @@
 package wbrules
 
 import (
+	"fmt"
 	"github.com/contactless/wbgong/testutils"
+	"io/ioutil"
 	"os"
+	"path/filepath"
 	"regexp"
 	"testing"
 )
@@ -103,8 +106,92 @@ func (s *TestModulesSuite) TestModulesCache() {
 
 }
 
+func (s *TestModulesSuite) TestResolve() {
+	s.CopyDataFileToTempDir("testrules_modules_helper.js", "testrules_modules_helper.js")
+	s.publish("/devices/test/controls/resolve/on", "1", "test/resolve")
+
+	s.Verify(
+		"tst -> /devices/test/controls/resolve/on: [1] (QoS 1)",
+		"driver -> /devices/test/controls/resolve: [1] (QoS 1, retained)",
+		"[info] package: pkg, setpoint: 21",
+		"[info] json: 21",
+		"[info] relative: helper",
+		regexp.MustCompile("/log/info: \\[cannot find module 'test/nosuchmodule', tried: "+
+			".*/test/nosuchmodule\\.js, .*/test/nosuchmodule\\.json, .*/test/nosuchmodule/index\\.js\\]"),
+	)
+
+	s.EnsureGotErrors()
+}
+
+type ModuleReloadSuite struct {
+	RuleSuiteBase
+	modulePath   string
+	settingsPath string
+}
+
+func (s *ModuleReloadSuite) SetupTest() {
+	dir, err := ioutil.TempDir(os.TempDir(), "wbrulesmodules")
+	if err != nil {
+		s.FailNow("can't create temp directory")
+	}
+	s.ModulesPath = dir
+	s.modulePath = filepath.Join(dir, "reloadable.js")
+	s.settingsPath = filepath.Join(dir, "reloadable_settings.json")
+	s.writeModule(1)
+	s.writeSettings(21)
+	s.SetupSkippingDefs("testrules_module_reload.js")
+}
+
+func (s *ModuleReloadSuite) TearDownTest() {
+	s.RuleSuiteBase.TearDownTest()
+	os.RemoveAll(s.ModulesPath)
+}
+
+func (s *ModuleReloadSuite) writeModule(value int) {
+	content := fmt.Sprintf("exports.value = %d;\n", value)
+	s.Ck("WriteFile()", ioutil.WriteFile(s.modulePath, []byte(content), 0644))
+}
+
+func (s *ModuleReloadSuite) writeSettings(setpoint int) {
+	content := fmt.Sprintf("{\"setpoint\": %d}\n", setpoint)
+	s.Ck("WriteFile()", ioutil.WriteFile(s.settingsPath, []byte(content), 0644))
+}
+
+func (s *ModuleReloadSuite) TestReload() {
+	files, err := s.engine.ListSourceFiles()
+	s.Ck("ListSourceFiles()", err)
+	s.Require().Len(files, 1)
+	s.Equal([]string{s.modulePath, s.settingsPath}, files[0].Modules)
+	s.Len(s.engine.ModuleDependents(s.modulePath), 1)
+	s.Empty(s.engine.ModuleDependents(filepath.Join(s.ModulesPath, "other.js")))
+
+	s.writeModule(2)
+	s.Ck("ReloadModuleDependents()", s.engine.ReloadModuleDependents(s.modulePath))
+	s.Verify(
+		"[info] reloadable value: 2",
+		"[info] reloadable setpoint: 21",
+		"[changed] testrules_module_reload.js",
+	)
+
+	// the dependency is recorded again after reloading
+	s.Len(s.engine.ModuleDependents(s.modulePath), 1)
+}
+
+func (s *ModuleReloadSuite) TestReloadJSON() {
+	s.Len(s.engine.ModuleDependents(s.settingsPath), 1)
+
+	s.writeSettings(23)
+	s.Ck("ReloadModuleDependents()", s.engine.ReloadModuleDependents(s.settingsPath))
+	s.Verify(
+		"[info] reloadable value: 1",
+		"[info] reloadable setpoint: 23",
+		"[changed] testrules_module_reload.js",
+	)
+}
+
 func TestModules(t *testing.T) {
 	testutils.RunSuites(t,
 		new(TestModulesSuite),
+		new(ModuleReloadSuite),
 	)
 }
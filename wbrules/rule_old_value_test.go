@@ -0,0 +1,47 @@
+package wbrules
+
+import (
+	"testing"
+
+	"github.com/contactless/wbgong/testutils"
+)
+
+type RuleOldValueSuite struct {
+	RuleSuiteBase
+}
+
+func (s *RuleOldValueSuite) SetupTest() {
+	s.SetupSkippingDefs("testrules_oldvalue.js")
+}
+
+func (s *RuleOldValueSuite) TestOldValue() {
+	s.publish("/devices/somedev/controls/counter/meta/type", "value", "somedev/counter")
+	s.publish("/devices/somedev/controls/counter", "1", "somedev/counter")
+	s.Verify(
+		"tst -> /devices/somedev/controls/counter/meta/type: [value] (QoS 1, retained)",
+		"tst -> /devices/somedev/controls/counter: [1] (QoS 1, retained)",
+		"[info] somedev/counter: none -> 1, retained: true, has timestamp: true",
+	)
+
+	s.publish("/devices/somedev/controls/counter", "5", "somedev/counter")
+	s.Verify(
+		"tst -> /devices/somedev/controls/counter: [5] (QoS 1, retained)",
+		"[info] somedev/counter: 1 -> 5, retained: true, has timestamp: true",
+	)
+
+	// meta change doesn't change the value
+	s.publish("/devices/somedev/controls/counter/meta/error", "r", "somedev/counter")
+	s.Verify("tst -> /devices/somedev/controls/counter/meta/error: [r] (QoS 1, retained)")
+
+	s.publish("/devices/somedev/controls/counter", "7", "somedev/counter")
+	s.Verify(
+		"tst -> /devices/somedev/controls/counter: [7] (QoS 1, retained)",
+		"[info] somedev/counter: 5 -> 7, retained: true, has timestamp: true",
+	)
+}
+
+func TestRuleOldValueSuite(t *testing.T) {
+	testutils.RunSuites(t,
+		new(RuleOldValueSuite),
+	)
+}
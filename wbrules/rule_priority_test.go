@@ -0,0 +1,52 @@
+package wbrules
+
+import (
+	"testing"
+
+	"github.com/contactless/wbgong/testutils"
+)
+
+type RulePrioritySuite struct {
+	RuleSuiteBase
+}
+
+func (s *RulePrioritySuite) SetupTest() {
+	s.SetupSkippingDefs("testrules_priority_2.js", "testrules_priority_1.js")
+}
+
+func (s *RulePrioritySuite) verifyOrder(value string) {
+	s.publish("/devices/somedev/controls/foo", value, "somedev/foo")
+	s.Verify(
+		"tst -> /devices/somedev/controls/foo: ["+value+"] (QoS 1, retained)",
+		"[info] interlock: "+value,
+		"[info] comfort: "+value,
+		"[info] lighting: "+value,
+	)
+}
+
+func (s *RulePrioritySuite) ruleOrder() (names []string) {
+	for _, entry := range s.engine.RuleStats() {
+		names = append(names, entry.Name)
+	}
+	return
+}
+
+func (s *RulePrioritySuite) TestOrder() {
+	s.publish("/devices/somedev/controls/foo/meta/type", "text", "somedev/foo")
+	s.Verify("tst -> /devices/somedev/controls/foo/meta/type: [text] (QoS 1, retained)")
+
+	s.verifyOrder("a")
+	s.Equal([]string{"interlock", "comfort", "lighting"}, s.ruleOrder())
+
+	// reloading the file doesn't move its rules to the end
+	s.ReplaceScript("testrules_priority_1.js", "testrules_priority_1.js")
+	s.Verify("[changed] testrules_priority_1.js")
+	s.verifyOrder("b")
+	s.Equal([]string{"interlock", "comfort", "lighting"}, s.ruleOrder())
+}
+
+func TestRulePrioritySuite(t *testing.T) {
+	testutils.RunSuites(t,
+		new(RulePrioritySuite),
+	)
+}
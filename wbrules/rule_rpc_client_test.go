@@ -0,0 +1,76 @@
+package wbrules
+
+import (
+	"fmt"
+	"os"
+	"regexp"
+	"testing"
+
+	"github.com/contactless/wbgong"
+	"github.com/contactless/wbgong/testutils"
+	"github.com/stretchr/testify/assert"
+)
+
+type RuleRpcClientSuite struct {
+	RuleSuiteBase
+}
+
+func (s *RuleRpcClientSuite) SetupTest() {
+	s.SetupSkippingDefs("testrules_rpc_client.js")
+}
+
+func (s *RuleRpcClientSuite) topic() string {
+	return "/rpc/v1/wb-mqtt-serial/port/Load/" + s.engine.rpc.clientId
+}
+
+func (s *RuleRpcClientSuite) call() {
+	s.client.Publish(wbgong.MQTTMessage{Topic: "/rpc-test/call", Payload: "1", QoS: 1, Retained: false})
+	s.Verify(
+		"tst -> /rpc-test/call: [1] (QoS 1)",
+		`wbrules-log -> `+s.topic()+`: [{"id":1,"params":{"path":"/dev/ttyRS485-1","msg":"1"}}] (QoS 1)`,
+	)
+}
+
+func (s *RuleRpcClientSuite) reply(payload string) {
+	s.client.Publish(wbgong.MQTTMessage{Topic: s.topic() + "/reply", Payload: payload, QoS: 1, Retained: false})
+}
+
+func (s *RuleRpcClientSuite) TestResult() {
+	s.call()
+	s.reply(`{"id":1,"result":{"response":"ok"},"error":null}`)
+	s.Verify(
+		`tst -> `+s.topic()+`/reply: [{"id":1,"result":{"response":"ok"},"error":null}] (QoS 1)`,
+		`[info] rpc result: {"response":"ok"}`,
+	)
+}
+
+func (s *RuleRpcClientSuite) TestError() {
+	s.call()
+	s.reply(`{"id":1,"result":null,"error":{"code":-32000,"message":"port not found"}}`)
+	s.Verify(
+		`tst -> `+s.topic()+`/reply: [{"id":1,"result":null,"error":{"code":-32000,"message":"port not found"}}] (QoS 1)`,
+		"[info] rpc error: -32000 port not found timeout=false",
+	)
+}
+
+func (s *RuleRpcClientSuite) TestTimeout() {
+	s.call()
+	s.Verify("[info] rpc error: 0 request timed out after 200ms timeout=true")
+
+	// the late reply is ignored
+	s.reply(`{"id":1,"result":{"response":"ok"},"error":null}`)
+	s.Verify(`tst -> ` + s.topic() + `/reply: [{"id":1,"result":{"response":"ok"},"error":null}] (QoS 1)`)
+}
+
+func TestRPCClientId(t *testing.T) {
+	id1, id2 := newRPCClient(nil).clientId, newRPCClient(nil).clientId
+	assert.Regexp(t, regexp.MustCompile(fmt.Sprintf("^wb-rules-%d-[0-9a-f]{8}$", os.Getpid())), id1)
+	assert.NotEqual(t, id1, id2)
+	assert.True(t, validRPCTopicPart(id1))
+}
+
+func TestRuleRpcClientSuite(t *testing.T) {
+	testutils.RunSuites(t,
+		new(RuleRpcClientSuite),
+	)
+}
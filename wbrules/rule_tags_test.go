@@ -0,0 +1,109 @@
+package wbrules
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/contactless/wbgong/testutils"
+)
+
+type RuleTagsSuite struct {
+	RuleSuiteBase
+	tmpDir string
+}
+
+func (s *RuleTagsSuite) SetupFixture() {
+	var err error
+
+	// persistent DB file must be kept between tests
+	// to check that tag states are restored
+	s.tmpDir, err = ioutil.TempDir(os.TempDir(), "wbrulestest")
+	if err != nil {
+		s.FailNow("can't create temp directory")
+	}
+}
+
+func (s *RuleTagsSuite) TearDownFixture() {
+	os.RemoveAll(s.tmpDir)
+}
+
+func (s *RuleTagsSuite) SetupTest() {
+	s.PersistentDBFile = s.tmpDir + "/test_persistent.db"
+	s.SetupSkippingDefs("testrules_tags.js")
+	s.publish("/devices/somedev/controls/foo/meta/type", "text", "somedev/foo")
+	s.Verify("tst -> /devices/somedev/controls/foo/meta/type: [text] (QoS 1, retained)")
+}
+
+func (s *RuleTagsSuite) switchTag(name, value string) {
+	topic := "/devices/wbrules/controls/Tag " + name
+	s.publish(topic+"/on", value, "wbrules/Tag "+name)
+	s.Verify(
+		"tst -> "+topic+"/on: ["+value+"] (QoS 1)",
+		"driver -> "+topic+": ["+value+"] (QoS 1, retained)",
+	)
+}
+
+func (s *RuleTagsSuite) TestTags() {
+	s.publish("/devices/somedev/controls/foo", "a", "somedev/foo")
+	s.VerifyUnordered(
+		"tst -> /devices/somedev/controls/foo: [a] (QoS 1, retained)",
+		"[info] heatingOnVacation: a",
+		"[info] untagged: a",
+	)
+
+	// disabling any of the tags disables the rule
+	s.switchTag("vacation", "0")
+	s.publish("/devices/somedev/controls/foo", "b", "somedev/foo")
+	s.Verify(
+		"tst -> /devices/somedev/controls/foo: [b] (QoS 1, retained)",
+		"[info] untagged: b",
+	)
+	s.Equal([]string{"heating", "vacation"}, s.engine.RuleStats()[0].Tags)
+}
+
+// the tag state is restored after restart
+func (s *RuleTagsSuite) TestTags2() {
+	s.publish("/devices/somedev/controls/foo", "c", "somedev/foo")
+	s.Verify(
+		"tst -> /devices/somedev/controls/foo: [c] (QoS 1, retained)",
+		"[info] untagged: c",
+	)
+
+	s.switchTag("vacation", "1")
+	s.publish("/devices/somedev/controls/foo", "d", "somedev/foo")
+	s.VerifyUnordered(
+		"tst -> /devices/somedev/controls/foo: [d] (QoS 1, retained)",
+		"[info] heatingOnVacation: d",
+		"[info] untagged: d",
+	)
+}
+
+// disabled tags also apply to cron rules
+func (s *RuleTagsSuite) TestCronTags() {
+	s.WaitFor(func() bool {
+		c := make(chan bool)
+		s.engine.CallSync(func() {
+			c <- s.cron != nil && s.cron.started
+		})
+		return <-c
+	})
+
+	s.cron.invokeEntries("@hourly")
+	s.Verify("[info] vacationCron fired")
+
+	s.switchTag("vacation", "0")
+	s.cron.invokeEntries("@hourly")
+	s.VerifyEmpty()
+
+	s.switchTag("vacation", "1")
+	s.cron.invokeEntries("@hourly")
+	s.Verify("[info] vacationCron fired")
+}
+
+func TestRuleTagsSuite(t *testing.T) {
+	s := new(RuleTagsSuite)
+	s.SetupFixture()
+	defer s.TearDownFixture()
+	testutils.RunSuites(t, s)
+}
@@ -81,9 +81,13 @@ type RuleSuiteBase struct {
 	VdevStorageFile  string
 	ModulesPath      string /* ':'-separated list */
 	CleanUp          func()
+
+	// EngineOptions may be set by the suite before
+	// SetupTest() to tune the engine
+	EngineOptions *ESEngineOptions
 }
 
-var logVerifyRx = regexp.MustCompile(`^\[(info|debug|warning|error)\] (.*)`)
+var logVerifyRx = regexp.MustCompile(`^\[(info|debug|warning|error|dryrun)\] (.*)`)
 var updatesVerifyRx = regexp.MustCompile(`^\[(changed|removed)\] (.*)`)
 
 // creates necessary file paths if some are not defined already
@@ -245,7 +249,10 @@ func (s *RuleSuiteBase) SetupTest(waitForRetained bool, ruleFiles ...string) {
 
 	s.cron = nil
 
-	engineOptions := NewESEngineOptions()
+	engineOptions := s.EngineOptions
+	if engineOptions == nil {
+		engineOptions = NewESEngineOptions()
+	}
 	engineOptions.SetPersistentDBFile(s.PersistentDBFile)
 	engineOptions.SetModulesDirs(strings.Split(s.ModulesPath, ":"))
 	s.logClient = s.Broker.MakeClient("wbrules-log")
@@ -333,7 +340,7 @@ func (s *RuleSuiteBase) newFakeTimer(id TimerId, d time.Duration, periodic bool)
 func (s *RuleSuiteBase) publish(topic, value string, expectedCellNames ...string) {
 	retained := !strings.HasSuffix(topic, "/on")
 	wbgong.Debug.Printf("publishing %s to %s, expecting change of %v", value, topic, expectedCellNames)
-	s.client.Publish(wbgong.MQTTMessage{topic, value, 1, retained})
+	s.client.Publish(wbgong.MQTTMessage{Topic: topic, Payload: value, QoS: 1, Retained: retained})
 	s.expectControlChange(expectedCellNames...)
 }
 
@@ -0,0 +1,121 @@
+package wbrules
+
+import (
+	"testing"
+	"time"
+
+	"github.com/contactless/wbgong/testutils"
+)
+
+type RuleTimerControlSuite struct {
+	RuleSuiteBase
+	now time.Time
+}
+
+func (s *RuleTimerControlSuite) SetupTest() {
+	s.SetupSkippingDefs("testrules_timer_control.js")
+	s.now = time.Date(2026, 1, 10, 12, 0, 0, 0, time.UTC)
+	s.engine.SetNowFunc(func() time.Time { return s.now })
+	s.publish("/devices/somedev/controls/foo/meta/type", "text", "somedev/foo")
+	s.Verify("tst -> /devices/somedev/controls/foo/meta/type: [text] (QoS 1, retained)")
+}
+
+func (s *RuleTimerControlSuite) command(cmd string, items ...interface{}) {
+	s.publish("/devices/somedev/controls/foo", cmd, "somedev/foo")
+	s.Verify(append([]interface{}{
+		"tst -> /devices/somedev/controls/foo: [" + cmd + "] (QoS 1, retained)",
+	}, items...)...)
+}
+
+func (s *RuleTimerControlSuite) TestRestart() {
+	s.command("motion stairs", "new fake timer: 1, 60000")
+
+	s.now = s.now.Add(20 * time.Second)
+	s.command("show stairs",
+		"[info] remaining: 40000",
+		"[info] timer: stairs 40000 false",
+	)
+
+	// the timer keeps its id
+	s.command("motion stairs",
+		"timer.Stop(): 1",
+		"new fake timer: 1, 60000",
+	)
+	s.command("motion stairs 120000",
+		"timer.Stop(): 1",
+		"new fake timer: 1, 120000",
+	)
+
+	s.FireTimer(1, s.AdvanceTime(120*time.Second))
+	s.Verify(
+		"timer.fire(): 1",
+		"[info] stairs off",
+	)
+
+	s.command("show stairs", "[info] remaining: 0")
+}
+
+func (s *RuleTimerControlSuite) TestPauseResume() {
+	s.command("motion stairs", "new fake timer: 1, 60000")
+
+	s.now = s.now.Add(15 * time.Second)
+	s.command("pause stairs",
+		"timer.Stop(): 1",
+		"[info] pause: true",
+	)
+
+	// the paused timer doesn't count down
+	s.now = s.now.Add(time.Hour)
+	s.command("pause stairs", "[info] pause: false")
+	s.command("show stairs",
+		"[info] remaining: 45000",
+		"[info] timer: stairs 45000 true",
+	)
+
+	s.command("resume stairs",
+		"new fake timer: 1, 45000",
+		"[info] resume: true",
+	)
+	s.command("resume stairs", "[info] resume: false")
+
+	s.FireTimer(1, s.AdvanceTime(45*time.Second))
+	s.Verify(
+		"timer.fire(): 1",
+		"[info] stairs off",
+	)
+}
+
+func (s *RuleTimerControlSuite) TestPauseResumeTicker() {
+	s.command("tick blink", "new fake ticker: 1, 1000")
+
+	s.now = s.now.Add(400 * time.Millisecond)
+	s.command("pause blink",
+		"timer.Stop(): 1",
+		"[info] pause: true",
+	)
+
+	// the first tick after resume fires after the remaining
+	// time, the ticker continues with its interval after that
+	s.command("resume blink",
+		"new fake timer: 1, 600",
+		"[info] resume: true",
+	)
+	s.FireTimer(1, s.AdvanceTime(600*time.Millisecond))
+	s.Verify(
+		"timer.fire(): 1",
+		"[info] blink",
+		"new fake ticker: 1, 1000",
+	)
+
+	s.FireTimer(1, s.AdvanceTime(time.Second))
+	s.Verify(
+		"timer.fire(): 1",
+		"[info] blink",
+	)
+}
+
+func TestRuleTimerControlSuite(t *testing.T) {
+	testutils.RunSuites(t,
+		new(RuleTimerControlSuite),
+	)
+}
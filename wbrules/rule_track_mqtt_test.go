@@ -3,6 +3,7 @@ package wbrules
 import (
 	"testing"
 
+	"github.com/contactless/wbgong"
 	"github.com/contactless/wbgong/testutils"
 )
 
@@ -60,6 +61,40 @@ func (s *RuleTrackMqttSuite) TestTracker() {
 	s.VerifyEmpty()
 }
 
+func (s *RuleTrackMqttSuite) TestJSON() {
+	s.client.Publish(wbgong.MQTTMessage{Topic: "/json/a", Payload: `{"name": "foo"}`, QoS: 1, Retained: false})
+	s.Verify(
+		`tst -> /json/a: [{"name": "foo"}] (QoS 1)`,
+		"[info] json: /json/a foo qos=1 retained=false",
+	)
+
+	s.client.Publish(wbgong.MQTTMessage{Topic: "/json/b", Payload: "{", QoS: 1, Retained: false})
+	s.Verify(
+		"tst -> /json/b: [{] (QoS 1)",
+		"[error] trackMqtt: invalid JSON payload in /json/b: unexpected end of JSON input",
+		"[info] json error: /json/b",
+	)
+	s.EnsureGotErrors()
+}
+
+func (s *RuleTrackMqttSuite) TestUntrack() {
+	s.client.Publish(wbgong.MQTTMessage{Topic: "/untrack", Payload: "1", QoS: 1, Retained: false})
+	s.Verify(
+		"tst -> /untrack: [1] (QoS 1)",
+		"[info] untrack: true",
+	)
+
+	// the tracker doesn't get the messages anymore
+	s.client.Publish(wbgong.MQTTMessage{Topic: "/json/a", Payload: `{"name": "foo"}`, QoS: 1, Retained: false})
+	s.Verify(`tst -> /json/a: [{"name": "foo"}] (QoS 1)`)
+
+	s.client.Publish(wbgong.MQTTMessage{Topic: "/untrack", Payload: "1", QoS: 1, Retained: false})
+	s.Verify(
+		"tst -> /untrack: [1] (QoS 1)",
+		"[info] untrack: false",
+	)
+}
+
 func TestTrackMqtt(t *testing.T) {
 	testutils.RunSuites(t, new(RuleTrackMqttSuite))
 }
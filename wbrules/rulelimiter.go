@@ -0,0 +1,90 @@
+package wbrules
+
+import (
+	"time"
+
+	"github.com/stretchr/objx"
+)
+
+type RuleLimiterKind int
+
+const (
+	// RULE_LIMIT_DEBOUNCE postpones rule firing until its
+	// condition stops triggering for the specified interval
+	RULE_LIMIT_DEBOUNCE RuleLimiterKind = iota
+	// RULE_LIMIT_THROTTLE makes the rule fire at most once
+	// per the specified interval
+	RULE_LIMIT_THROTTLE
+)
+
+// RuleLimiter implements debouncing and throttling of rule firing.
+// It's used only from the engine's sync loop, so no locking is needed
+type RuleLimiter struct {
+	kind     RuleLimiterKind
+	interval time.Duration
+	leading  bool
+	trailing bool
+
+	startTimer RuleTimerFunc
+	stopTimer  func(id TimerId)
+
+	timer       TimerId // 0 if there's no active timer
+	pending     bool
+	pendingArgs objx.Map
+}
+
+func NewRuleLimiter(kind RuleLimiterKind, interval time.Duration, leading, trailing bool,
+	startTimer RuleTimerFunc, stopTimer func(id TimerId)) *RuleLimiter {
+	return &RuleLimiter{
+		kind:       kind,
+		interval:   interval,
+		leading:    leading,
+		trailing:   trailing,
+		startTimer: startTimer,
+		stopTimer:  stopTimer,
+	}
+}
+
+// Trigger is called instead of firing the rule directly
+func (l *RuleLimiter) Trigger(rule *Rule, args objx.Map) {
+	idle := l.timer == 0
+	switch {
+	case idle && l.leading:
+		l.pending, l.pendingArgs = false, nil
+		rule.Fire(args)
+	case l.trailing:
+		l.pending, l.pendingArgs = true, args
+	}
+
+	if idle {
+		l.schedule(rule)
+	} else if l.kind == RULE_LIMIT_DEBOUNCE {
+		l.stopTimer(l.timer)
+		l.schedule(rule)
+	}
+}
+
+func (l *RuleLimiter) schedule(rule *Rule) {
+	l.timer = l.startTimer(l.interval, func() {
+		l.expire(rule)
+	})
+}
+
+func (l *RuleLimiter) expire(rule *Rule) {
+	l.timer = 0
+	if !l.pending {
+		return
+	}
+	args := l.pendingArgs
+	l.pending, l.pendingArgs = false, nil
+
+	if rule.then == nil || !rule.isActive() {
+		// the rule is destroyed or disabled meanwhile
+		return
+	}
+	if l.kind == RULE_LIMIT_THROTTLE {
+		// the trailing call starts a new interval
+		l.schedule(rule)
+	}
+	rule.Fire(args)
+}
@@ -0,0 +1,49 @@
+package wbrules
+
+import (
+	"bytes"
+)
+
+// RuleManager interface provides a way to inspect
+// the rules defined in the engine
+type RuleManager interface {
+	RuleStats() []RuleStatsEntry
+	DependencyGraph() *RuleGraph
+	Schedule() *Schedule
+}
+
+// Rules is an RPC service which exposes information
+// about the rules to external clients
+type Rules struct {
+	ruleManager RuleManager
+}
+
+func NewRules(ruleManager RuleManager) *Rules {
+	return &Rules{ruleManager}
+}
+
+func (rules *Rules) Stats(args *struct{}, reply *[]RuleStatsEntry) error {
+	*reply = rules.ruleManager.RuleStats()
+	return nil
+}
+
+func (rules *Rules) Graph(args *struct{}, reply *RuleGraph) error {
+	*reply = *rules.ruleManager.DependencyGraph()
+	return nil
+}
+
+// GraphDot returns the dependency graph in Graphviz DOT format
+func (rules *Rules) GraphDot(args *struct{}, reply *string) error {
+	var buf bytes.Buffer
+	if err := rules.ruleManager.DependencyGraph().WriteDot(&buf); err != nil {
+		return err
+	}
+	*reply = buf.String()
+	return nil
+}
+
+// Schedule lists upcoming cron rule runs and active timers
+func (rules *Rules) Schedule(args *struct{}, reply *Schedule) error {
+	*reply = *rules.ruleManager.Schedule()
+	return nil
+}
@@ -0,0 +1,303 @@
+package wbrules
+
+import (
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/contactless/wbgong/testutils"
+	"github.com/stretchr/objx"
+)
+
+type RulesRpcSuite struct {
+	testutils.Suite
+	*testutils.RpcFixture
+}
+
+func (s *RulesRpcSuite) T() *testing.T {
+	return s.Suite.T()
+}
+
+func (s *RulesRpcSuite) SetupTest() {
+	s.Suite.SetupTest()
+	s.RpcFixture = testutils.NewRpcFixture(
+		s.T(), "wbrules", "Rules", "wbrules",
+		NewRules(s),
+		"Stats", "Graph", "GraphDot", "Schedule")
+}
+
+func (s *RulesRpcSuite) TearDownTest() {
+	s.TearDownRPC()
+	s.Suite.TearDownTest()
+}
+
+func (s *RulesRpcSuite) RuleStats() []RuleStatsEntry {
+	return []RuleStatsEntry{
+		{
+			Id:            1,
+			Name:          "foo",
+			Priority:      10,
+			FireCount:     3,
+			LastFired:     1500000000000,
+			LastDuration:  1.5,
+			MaxDuration:   4,
+			SkippedChecks: 10,
+		},
+		{
+			Id:        2,
+			Name:      "bar",
+			Order:     1,
+			LastError: "Error: oops",
+		},
+	}
+}
+
+func (s *RulesRpcSuite) DependencyGraph() *RuleGraph {
+	return &RuleGraph{
+		Rules: []RuleGraphRule{
+			{
+				Id:       1,
+				Name:     "foo",
+				Location: SourceLocation{"rules.js", 3},
+			},
+			{
+				Id:              2,
+				WithoutControls: true,
+			},
+		},
+		Controls: []RuleGraphEdges{
+			{"somedev/temp", []RuleId{1}},
+		},
+		Timers: []RuleGraphEdges{
+			{"t1", []RuleId{1, 2}},
+		},
+	}
+}
+
+func (s *RulesRpcSuite) Schedule() *Schedule {
+	return &Schedule{
+		Cron: []ScheduledCronRule{
+			{
+				Id:     1,
+				Name:   "heating",
+				Spec:   "0 30 6 * * *",
+				Script: "heating.js",
+				Next:   []int64{1500010200000, 1500096600000},
+			},
+		},
+		Timers: []ScheduledTimer{
+			{
+				Id:        3,
+				Name:      "tick",
+				Interval:  5000,
+				Periodic:  true,
+				Remaining: 1500,
+				Script:    "heating.js",
+			},
+			{
+				Id:        4,
+				Interval:  1000,
+				Remaining: 250,
+			},
+		},
+	}
+}
+
+func (s *RulesRpcSuite) TestSchedule() {
+	s.VerifyRpc("Schedule", objx.Map{}, objx.Map{
+		"cron": []objx.Map{
+			{
+				"id":     1,
+				"name":   "heating",
+				"spec":   "0 30 6 * * *",
+				"script": "heating.js",
+				"next":   []int64{1500010200000, 1500096600000},
+			},
+		},
+		"timers": []objx.Map{
+			{
+				"id":        3,
+				"name":      "tick",
+				"interval":  5000,
+				"periodic":  true,
+				"remaining": 1500,
+				"script":    "heating.js",
+			},
+			{
+				"id":        4,
+				"interval":  1000,
+				"periodic":  false,
+				"remaining": 250,
+			},
+		},
+	})
+}
+
+func (s *RulesRpcSuite) TestGraph() {
+	s.VerifyRpc("Graph", objx.Map{}, objx.Map{
+		"rules": []objx.Map{
+			{
+				"id":              1,
+				"name":            "foo",
+				"location":        objx.Map{"file": "rules.js", "line": 3},
+				"withoutControls": false,
+			},
+			{
+				"id":              2,
+				"name":            "",
+				"location":        objx.Map{},
+				"withoutControls": true,
+			},
+		},
+		"controls": []objx.Map{
+			{"source": "somedev/temp", "rules": []int{1}},
+		},
+		"timers": []objx.Map{
+			{"source": "t1", "rules": []int{1, 2}},
+		},
+	})
+}
+
+func (s *RulesRpcSuite) TestGraphDot() {
+	s.VerifyRpc("GraphDot", objx.Map{}, `digraph wbrules {
+	rankdir=LR;
+	"rule:1" [label="foo\nrules.js:3", shape=box];
+	"rule:2" [label="<rule 2>", shape=box, style=filled, fillcolor=orange];
+	"control:somedev/temp" [label="somedev/temp", shape=ellipse];
+	"control:somedev/temp" -> "rule:1";
+	"timer:t1" [label="t1", shape=diamond];
+	"timer:t1" -> "rule:1";
+	"timer:t1" -> "rule:2";
+}
+`)
+}
+
+func (s *RulesRpcSuite) TestStats() {
+	s.VerifyRpc("Stats", objx.Map{}, []objx.Map{
+		{
+			"id":            1,
+			"name":          "foo",
+			"priority":      10,
+			"order":         0,
+			"fireCount":     3,
+			"lastFired":     1500000000000,
+			"lastDuration":  1.5,
+			"maxDuration":   4,
+			"skippedChecks": 10,
+		},
+		{
+			"id":            2,
+			"name":          "bar",
+			"priority":      0,
+			"order":         1,
+			"fireCount":     0,
+			"lastFired":     0,
+			"lastDuration":  0,
+			"maxDuration":   0,
+			"lastError":     "Error: oops",
+			"skippedChecks": 0,
+		},
+	})
+}
+
+type RuleStatsSuite struct {
+	RuleSuiteBase
+}
+
+func (s *RuleStatsSuite) SetupTest() {
+	s.SetupSkippingDefs("testrules_stats.js")
+}
+
+func (s *RuleStatsSuite) findStats(name string) RuleStatsEntry {
+	for _, entry := range s.engine.RuleStats() {
+		if entry.Name == name {
+			return entry
+		}
+	}
+	s.Require().Fail("rule not found", "%s", name)
+	return RuleStatsEntry{}
+}
+
+func (s *RuleStatsSuite) TestStats() {
+	s.Equal(uint64(0), s.findStats("statsOk").FireCount)
+
+	s.publish("/devices/somedev/controls/foo/meta/type", "text", "somedev/foo")
+	s.publish("/devices/somedev/controls/foo", "abc", "somedev/foo")
+	s.Verify(
+		"tst -> /devices/somedev/controls/foo/meta/type: [text] (QoS 1, retained)",
+		"tst -> /devices/somedev/controls/foo: [abc] (QoS 1, retained)",
+		"[info] statsOk fired: abc",
+		regexp.MustCompile(`(?s:ECMAScript error:.*broken rule.*)`),
+	)
+	s.EnsureGotErrors()
+
+	okStats := s.findStats("statsOk")
+	s.Equal(uint64(1), okStats.FireCount)
+	s.NotZero(okStats.LastFired)
+	s.True(okStats.MaxDuration >= okStats.LastDuration)
+	s.Equal("", okStats.LastError)
+
+	brokenStats := s.findStats("statsBroken")
+	s.Equal(uint64(1), brokenStats.FireCount)
+	s.Contains(brokenStats.LastError, "broken rule")
+
+	// unrelated control change doesn't cause the rules to be checked
+	s.publish("/devices/somedev/controls/temp", "20", "somedev/temp")
+	s.Verify("tst -> /devices/somedev/controls/temp: [20] (QoS 1, retained)")
+	s.True(s.findStats("statsOk").SkippedChecks > okStats.SkippedChecks)
+	s.Equal(uint64(1), s.findStats("statsOk").FireCount)
+}
+
+type RuleGraphSuite struct {
+	RuleSuiteBase
+}
+
+func (s *RuleGraphSuite) SetupTest() {
+	s.SetupSkippingDefs("testrules_graph.js")
+}
+
+func (s *RuleGraphSuite) findRule(graph *RuleGraph, name string) RuleGraphRule {
+	for _, rule := range graph.Rules {
+		if rule.Name == name {
+			return rule
+		}
+	}
+	s.Require().Fail("rule not found", "%s", name)
+	return RuleGraphRule{}
+}
+
+func (s *RuleGraphSuite) TestGraph() {
+	// the conditions are evaluated (and their dependencies
+	// are discovered) upon the first event
+	s.publish("/devices/somedev/controls/foo", "1", "somedev/foo")
+	s.Verify("tst -> /devices/somedev/controls/foo: [1] (QoS 1, retained)")
+
+	graph := s.engine.DependencyGraph()
+
+	ctrlRule := s.findRule(graph, "graphCtrl")
+	s.True(strings.HasSuffix(ctrlRule.Location.File, "testrules_graph.js"))
+	s.True(ctrlRule.Location.Line > 0)
+	s.False(ctrlRule.WithoutControls)
+
+	timerRule := s.findRule(graph, "graphTimer")
+	s.False(timerRule.WithoutControls)
+
+	noControlsRule := s.findRule(graph, "graphNoControls")
+	s.True(noControlsRule.WithoutControls)
+	s.True(noControlsRule.Location.Line > ctrlRule.Location.Line)
+
+	s.Contains(graph.Controls, RuleGraphEdges{"somedev/foo", []RuleId{ctrlRule.Id}})
+	s.Equal([]RuleGraphEdges{{"graphTimer", []RuleId{timerRule.Id}}}, graph.Timers)
+
+	// a warning about the rule without controls is issued
+	// because the tests are run with debugging enabled
+	s.EnsureGotWarnings()
+}
+
+func TestRulesRpcSuite(t *testing.T) {
+	testutils.RunSuites(t,
+		new(RulesRpcSuite),
+		new(RuleStatsSuite),
+		new(RuleGraphSuite),
+	)
+}
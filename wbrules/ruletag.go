@@ -0,0 +1,131 @@
+package wbrules
+
+import (
+	"strings"
+	"sync/atomic"
+
+	"github.com/contactless/wbgong"
+	"github.com/stretchr/objx"
+)
+
+const (
+	// RULE_TAG_CELL_PREFIX is the prefix of the switches on
+	// the rule engine settings device that enable or disable
+	// the rules by tag
+	RULE_TAG_CELL_PREFIX = "Tag "
+
+	// RULE_TAGS_DB_BUCKET is the persistent DB bucket
+	// holding the states of the tags
+	RULE_TAGS_DB_BUCKET = "_wbrules_rule_tags"
+)
+
+// RuleTag is a named group of rules which can be enabled or
+// disabled at once using a switch on the rule engine settings
+// device. A rule runs only if all of its tags are enabled
+type RuleTag struct {
+	name    string
+	enabled uint32 // atomic
+}
+
+func (tag *RuleTag) Name() string {
+	return tag.name
+}
+
+func (tag *RuleTag) Enabled() bool {
+	return atomic.LoadUint32(&tag.enabled) == ATOMIC_TRUE
+}
+
+// setEnabled changes the state of the tag and returns
+// true if the state was actually changed
+func (tag *RuleTag) setEnabled(enabled bool) bool {
+	var v uint32 = ATOMIC_FALSE
+	if enabled {
+		v = ATOMIC_TRUE
+	}
+	return atomic.SwapUint32(&tag.enabled, v) != v
+}
+
+// RuleTagStateStorage keeps the state of rule tags across restarts
+type RuleTagStateStorage interface {
+	LoadRuleTagState(name string) (enabled, found bool)
+	StoreRuleTagState(name string, enabled bool)
+}
+
+func (engine *RuleEngine) SetRuleTagStateStorage(storage RuleTagStateStorage) {
+	engine.ruleTagStorage = storage
+}
+
+func ruleTagControlId(name string) string {
+	return RULE_TAG_CELL_PREFIX + name
+}
+
+// RuleTag returns the tag with the specified name, creating it
+// along with its switch if necessary. The switch isn't removed
+// when all the rules having the tag are removed, so the tag
+// state is kept while the script is being edited
+func (engine *RuleEngine) RuleTag(name string) (*RuleTag, error) {
+	engine.ruleTagsMutex.Lock()
+	defer engine.ruleTagsMutex.Unlock()
+
+	if tag, found := engine.ruleTags[name]; found {
+		return tag, nil
+	}
+
+	enabled := true
+	if engine.ruleTagStorage != nil {
+		if stored, found := engine.ruleTagStorage.LoadRuleTagState(name); found {
+			enabled = stored
+		}
+	}
+
+	err := engine.AddControl(RULE_ENGINE_SETTINGS_DEV_NAME, ruleTagControlId(name), objx.Map{
+		VDEV_CONTROL_DESCR_PROP_TYPE:         "switch",
+		VDEV_CONTROL_DESCR_PROP_VALUE:        enabled,
+		VDEV_CONTROL_DESCR_PROP_READONLY:     false,
+		VDEV_CONTROL_DESCR_PROP_FORCEDEFAULT: true, // the state is kept in the persistent DB
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	tag := &RuleTag{name: name}
+	tag.setEnabled(enabled)
+	engine.ruleTags[name] = tag
+	return tag, nil
+}
+
+// ruleTagByControl returns the tag which is switched by
+// the specified control, or nil if there's no such tag
+func (engine *RuleEngine) ruleTagByControl(spec ControlSpec) *RuleTag {
+	if spec.DeviceId != RULE_ENGINE_SETTINGS_DEV_NAME ||
+		!strings.HasPrefix(spec.ControlId, RULE_TAG_CELL_PREFIX) {
+		return nil
+	}
+
+	engine.ruleTagsMutex.Lock()
+	defer engine.ruleTagsMutex.Unlock()
+
+	return engine.ruleTags[strings.TrimPrefix(spec.ControlId, RULE_TAG_CELL_PREFIX)]
+}
+
+// maybeUpdateRuleTag applies the change of a tag switch
+func (engine *RuleEngine) maybeUpdateRuleTag(event *ControlChangeEvent) {
+	tag := engine.ruleTagByControl(event.Spec)
+	if tag == nil {
+		return
+	}
+
+	enabled, ok := event.Value.(bool)
+	if !ok || !tag.setEnabled(enabled) {
+		return
+	}
+
+	if enabled {
+		wbgong.Info.Printf("enabling rules tagged '%s'", tag.name)
+	} else {
+		wbgong.Info.Printf("disabling rules tagged '%s'", tag.name)
+	}
+	if engine.ruleTagStorage != nil {
+		engine.ruleTagStorage.StoreRuleTagState(tag.name, enabled)
+	}
+}
@@ -0,0 +1,585 @@
+package wbrules
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/contactless/wbgong"
+	cron "gopkg.in/robfig/cron.v1"
+)
+
+const (
+	SANDBOX_DRIVER_ID       = "wb-rules"
+	SANDBOX_DRIVER_CLIENT   = "driver"
+	SANDBOX_ENGINE_CLIENT   = "engine"
+	SANDBOX_INJECTOR_CLIENT = "injector"
+
+	SANDBOX_READY_TIMEOUT = 10 * time.Second
+	// the engine is considered idle when nothing happens
+	// during this (real) time
+	SANDBOX_SETTLE_TIME       = 20 * time.Millisecond
+	SANDBOX_SETTLE_MAX_ROUNDS = 100
+)
+
+// VirtualClock drives engine timers and cron entries
+// in the sandbox, so the scripts see the simulated
+// timing without waiting for real time to pass
+type VirtualClock struct {
+	mutex  sync.Mutex
+	now    time.Time
+	timers []*virtualTimer
+	crons  []*virtualCron
+}
+
+func NewVirtualClock(start time.Time) *VirtualClock {
+	return &VirtualClock{now: start}
+}
+
+func (clock *VirtualClock) Now() time.Time {
+	clock.mutex.Lock()
+	defer clock.mutex.Unlock()
+	return clock.now
+}
+
+// NewTimer is a TimerFunc creating timers driven by the clock
+func (clock *VirtualClock) NewTimer(id TimerId, d time.Duration, periodic bool) wbgong.Timer {
+	clock.mutex.Lock()
+	defer clock.mutex.Unlock()
+
+	timer := &virtualTimer{
+		clock:    clock,
+		c:        make(chan time.Time, 1),
+		deadline: clock.now.Add(d),
+	}
+	if periodic {
+		timer.period = d
+	}
+	clock.timers = append(clock.timers, timer)
+	return timer
+}
+
+// NewCron creates Cron driven by the clock
+func (clock *VirtualClock) NewCron() Cron {
+	return clock.NewCronWithParser(cron.Parse)
+}
+
+// NewCronWithParser creates Cron driven by the clock
+// which uses parse to convert cron specs to schedules
+func (clock *VirtualClock) NewCronWithParser(parse func(spec string) (cron.Schedule, error)) Cron {
+	clock.mutex.Lock()
+	defer clock.mutex.Unlock()
+
+	c := &virtualCron{clock: clock, parse: parse}
+	clock.crons = append(clock.crons, c)
+	return c
+}
+
+// AdvanceTo moves the clock to the specified time firing
+// timers and cron entries that are due in order.
+// settle is invoked after each firing
+func (clock *VirtualClock) AdvanceTo(t time.Time, settle func()) {
+	for {
+		clock.mutex.Lock()
+		fire := clock.takeDue(t)
+		if fire == nil {
+			if t.After(clock.now) {
+				clock.now = t
+			}
+			clock.mutex.Unlock()
+			return
+		}
+		clock.mutex.Unlock()
+
+		fire()
+		settle()
+	}
+}
+
+// takeDue finds the earliest timer or cron entry due not later
+// than t, moves the clock to its time and reschedules it.
+// Must be called with the clock locked
+func (clock *VirtualClock) takeDue(t time.Time) func() {
+	var timer *virtualTimer
+	for _, candidate := range clock.timers {
+		if !candidate.deadline.After(t) && (timer == nil || candidate.deadline.Before(timer.deadline)) {
+			timer = candidate
+		}
+	}
+
+	var entry *virtualCronEntry
+	for _, c := range clock.crons {
+		if !c.started {
+			continue
+		}
+		for _, candidate := range c.entries {
+			if !candidate.next.IsZero() && !candidate.next.After(t) &&
+				(entry == nil || candidate.next.Before(entry.next)) {
+				entry = candidate
+			}
+		}
+	}
+
+	switch {
+	case timer != nil && (entry == nil || !entry.next.Before(timer.deadline)):
+		at := timer.deadline
+		clock.now = at
+		if timer.period > 0 {
+			timer.deadline = at.Add(timer.period)
+		} else {
+			clock.removeTimer(timer)
+		}
+		return func() {
+			select {
+			case timer.c <- at:
+			default:
+			}
+		}
+	case entry != nil:
+		clock.now = entry.next
+		entry.next = entry.schedule.Next(entry.next)
+		return entry.cmd
+	default:
+		return nil
+	}
+}
+
+// removeTimer must be called with the clock locked
+func (clock *VirtualClock) removeTimer(timer *virtualTimer) {
+	for i, t := range clock.timers {
+		if t == timer {
+			clock.timers = append(clock.timers[:i], clock.timers[i+1:]...)
+			return
+		}
+	}
+}
+
+type virtualTimer struct {
+	clock    *VirtualClock
+	c        chan time.Time
+	deadline time.Time
+	period   time.Duration // 0 for one-shot timers
+}
+
+func (timer *virtualTimer) GetChannel() <-chan time.Time {
+	return timer.c
+}
+
+func (timer *virtualTimer) Stop() {
+	timer.clock.mutex.Lock()
+	defer timer.clock.mutex.Unlock()
+	timer.clock.removeTimer(timer)
+}
+
+type virtualCronEntry struct {
+	schedule cron.Schedule
+	next     time.Time
+	cmd      func()
+}
+
+type virtualCron struct {
+	clock   *VirtualClock
+	parse   func(spec string) (cron.Schedule, error)
+	entries []*virtualCronEntry
+	started bool
+}
+
+func (c *virtualCron) AddFunc(spec string, cmd func()) error {
+	schedule, err := c.parse(spec)
+	if err != nil {
+		return err
+	}
+
+	c.clock.mutex.Lock()
+	defer c.clock.mutex.Unlock()
+	c.entries = append(c.entries, &virtualCronEntry{schedule, schedule.Next(c.clock.now), cmd})
+	return nil
+}
+
+func (c *virtualCron) Start() {
+	c.clock.mutex.Lock()
+	defer c.clock.mutex.Unlock()
+	c.started = true
+}
+
+func (c *virtualCron) Stop() {
+	c.clock.mutex.Lock()
+	defer c.clock.mutex.Unlock()
+	c.started = false
+}
+
+// mqttTopicMatch checks whether the topic matches
+// MQTT subscription filter
+func mqttTopicMatch(filter, topic string) bool {
+	filterItems := strings.Split(filter, "/")
+	topicItems := strings.Split(topic, "/")
+	for i, item := range filterItems {
+		if item == "#" {
+			return true
+		}
+		if i >= len(topicItems) || (item != "+" && item != topicItems[i]) {
+			return false
+		}
+	}
+	return len(filterItems) == len(topicItems)
+}
+
+type sandboxSubscription struct {
+	client  *sandboxClient
+	filter  string
+	handler wbgong.MQTTMessageHandler
+}
+
+// sandboxBroker is a minimal in-process MQTT broker.
+// Messages are delivered by a single goroutine in order
+type sandboxBroker struct {
+	mutex    sync.Mutex
+	cond     *sync.Cond
+	subs     []sandboxSubscription
+	retained map[string]wbgong.MQTTMessage
+	pending  []func()
+	busy     bool
+	stopped  bool
+
+	published uint64 // atomic
+	onPublish func(clientId string, msg wbgong.MQTTMessage)
+}
+
+func newSandboxBroker(onPublish func(clientId string, msg wbgong.MQTTMessage)) *sandboxBroker {
+	b := &sandboxBroker{
+		retained:  make(map[string]wbgong.MQTTMessage),
+		onPublish: onPublish,
+	}
+	b.cond = sync.NewCond(&b.mutex)
+	go b.dispatch()
+	return b
+}
+
+func (b *sandboxBroker) dispatch() {
+	for {
+		b.mutex.Lock()
+		for len(b.pending) == 0 && !b.stopped {
+			b.cond.Wait()
+		}
+		if b.stopped {
+			b.mutex.Unlock()
+			return
+		}
+		deliver := b.pending[0]
+		b.pending = b.pending[1:]
+		b.busy = true
+		b.mutex.Unlock()
+
+		deliver()
+
+		b.mutex.Lock()
+		b.busy = false
+		b.mutex.Unlock()
+	}
+}
+
+// enqueue must be called with the broker locked
+func (b *sandboxBroker) enqueue(deliver func()) {
+	b.pending = append(b.pending, deliver)
+	b.cond.Signal()
+}
+
+func (b *sandboxBroker) publish(client *sandboxClient, msg wbgong.MQTTMessage) {
+	atomic.AddUint64(&b.published, 1)
+	if b.onPublish != nil {
+		b.onPublish(client.id, msg)
+	}
+
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	if msg.Retained {
+		if msg.Payload == "" {
+			delete(b.retained, msg.Topic)
+		} else {
+			b.retained[msg.Topic] = msg
+		}
+	}
+
+	// like a real broker, don't set retained flag
+	// for the messages delivered to existing subscribers
+	msg.Retained = false
+	for _, sub := range b.subs {
+		if mqttTopicMatch(sub.filter, msg.Topic) {
+			handler := sub.handler
+			b.enqueue(func() { handler(msg) })
+		}
+	}
+}
+
+func (b *sandboxBroker) subscribe(client *sandboxClient, handler wbgong.MQTTMessageHandler, filter string) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	b.removeSubscription(client, filter)
+	b.subs = append(b.subs, sandboxSubscription{client, filter, handler})
+	for topic, msg := range b.retained {
+		if mqttTopicMatch(filter, topic) {
+			m := msg
+			b.enqueue(func() { handler(m) })
+		}
+	}
+}
+
+func (b *sandboxBroker) unsubscribe(client *sandboxClient, filter string) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	b.removeSubscription(client, filter)
+}
+
+// removeSubscription must be called with the broker locked
+func (b *sandboxBroker) removeSubscription(client *sandboxClient, filter string) {
+	for i, sub := range b.subs {
+		if sub.client == client && sub.filter == filter {
+			b.subs = append(b.subs[:i], b.subs[i+1:]...)
+			return
+		}
+	}
+}
+
+// activity returns the number of published messages and
+// whether there are undelivered ones
+func (b *sandboxBroker) activity() (published uint64, idle bool) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return atomic.LoadUint64(&b.published), len(b.pending) == 0 && !b.busy
+}
+
+func (b *sandboxBroker) stop() {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	b.stopped = true
+	b.cond.Signal()
+}
+
+func (b *sandboxBroker) newClient(id string) *sandboxClient {
+	return &sandboxClient{broker: b, id: id}
+}
+
+// sandboxClient implements wbgong.MQTTClient on top of sandboxBroker
+type sandboxClient struct {
+	broker *sandboxBroker
+	id     string
+}
+
+// WaitForRetained invokes the callback after the retained
+// messages queued for the subscriptions made so far are delivered
+func (c *sandboxClient) WaitForRetained(callback func()) {
+	c.broker.mutex.Lock()
+	defer c.broker.mutex.Unlock()
+	c.broker.enqueue(callback)
+}
+
+func (c *sandboxClient) Start() {}
+
+func (c *sandboxClient) Stop() {}
+
+func (c *sandboxClient) Publish(msg wbgong.MQTTMessage) {
+	c.broker.publish(c, msg)
+}
+
+func (c *sandboxClient) Subscribe(callback wbgong.MQTTMessageHandler, topics ...string) {
+	for _, topic := range topics {
+		c.broker.subscribe(c, callback, topic)
+	}
+}
+
+func (c *sandboxClient) Unsubscribe(topics ...string) {
+	for _, topic := range topics {
+		c.broker.unsubscribe(c, topic)
+	}
+}
+
+// formatControlValue converts control value to MQTT payload
+func formatControlValue(value interface{}) string {
+	switch v := value.(type) {
+	case nil:
+		return ""
+	case bool:
+		if v {
+			return "1"
+		}
+		return "0"
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	case string:
+		return v
+	default:
+		return fmt.Sprint(v)
+	}
+}
+
+// sandbox runs the engine with in-process MQTT broker,
+// wbgong driver and a virtual clock. It's used to run
+// the scripts without a controller
+type sandbox struct {
+	clock    *VirtualClock
+	broker   *sandboxBroker
+	injector *sandboxClient
+	driver   wbgong.Driver
+	engine   *ESEngine
+	tmpDir   string
+}
+
+// newSandbox creates the sandbox using the specified clock.
+// onPublish is invoked for each message published via the broker
+func newSandbox(clock *VirtualClock, onPublish func(clientId string, msg wbgong.MQTTMessage),
+	options *ESEngineOptions) (sb *sandbox, err error) {
+	sb = &sandbox{clock: clock}
+	sb.broker = newSandboxBroker(onPublish)
+	sb.injector = sb.broker.newClient(SANDBOX_INJECTOR_CLIENT)
+
+	driverArgs := wbgong.NewDriverArgs().
+		SetId(SANDBOX_DRIVER_ID).
+		SetMqtt(sb.broker.newClient(SANDBOX_DRIVER_CLIENT)).
+		SetUseStorage(false).
+		SetTesting()
+	if sb.driver, err = wbgong.NewDriverBase(driverArgs); err != nil {
+		sb.broker.stop()
+		return nil, err
+	}
+	if err = sb.driver.StartLoop(); err != nil {
+		sb.broker.stop()
+		return nil, err
+	}
+	sb.driver.WaitForReady()
+	sb.driver.SetFilter(&wbgong.AllDevicesFilter{})
+
+	// don't touch the real persistent storage
+	if sb.tmpDir, err = ioutil.TempDir(os.TempDir(), "wbrules-sandbox"); err != nil {
+		sb.Close()
+		return nil, err
+	}
+	// the options may be shared by several sandboxes
+	options = options.Copy()
+	options.SetPersistentDBFile(filepath.Join(sb.tmpDir, "persistent.db"))
+
+	if sb.engine, err = NewESEngine(sb.driver, sb.broker.newClient(SANDBOX_ENGINE_CLIENT), options); err != nil {
+		sb.Close()
+		return nil, err
+	}
+	sb.engine.SetTimerFunc(sb.clock.NewTimer)
+	sb.engine.SetNowFunc(sb.clock.Now)
+	sb.engine.SetCronMaker(func() Cron {
+		return sb.clock.NewCronWithParser(sb.engine.ParseCronSpec)
+	})
+	sb.engine.Start()
+	return sb, nil
+}
+
+func (sb *sandbox) Close() {
+	if sb.engine != nil {
+		sb.engine.Stop()
+		sb.engine.ClosePersistentDB()
+	}
+	sb.driver.StopLoop()
+	sb.driver.Close()
+	sb.broker.stop()
+	if sb.tmpDir != "" {
+		os.RemoveAll(sb.tmpDir)
+	}
+}
+
+// waitReady waits till the engine is ready and
+// the scripts loaded so far settle down
+func (sb *sandbox) waitReady() error {
+	select {
+	case <-sb.engine.ReadyCh():
+	case <-time.After(SANDBOX_READY_TIMEOUT):
+		return errors.New("the engine is not ready for too long")
+	}
+	sb.settle()
+	return nil
+}
+
+// barrier waits till the engine processes everything
+// that's already in its sync queue
+func (sb *sandbox) barrier() {
+	done := make(chan struct{})
+	sb.engine.CallSync(func() { close(done) })
+	<-done
+}
+
+// settle waits till the engine stops reacting
+// to the events injected so far
+func (sb *sandbox) settle() {
+	for i := 0; i < SANDBOX_SETTLE_MAX_ROUNDS; i++ {
+		before, _ := sb.broker.activity()
+		sb.barrier()
+		time.Sleep(SANDBOX_SETTLE_TIME)
+		sb.barrier()
+		after, idle := sb.broker.activity()
+		if idle && after == before && sb.engine.eventBuffer.length() == 0 {
+			return
+		}
+	}
+	wbgong.Warn.Printf("sandbox: the scripts keep producing events, going on")
+}
+
+// publish sends the message on behalf of the outside world
+func (sb *sandbox) publish(topic, payload string, retained bool) {
+	sb.injector.Publish(wbgong.MQTTMessage{Topic: topic, Payload: payload, QoS: 1, Retained: retained})
+}
+
+// setControl changes the control like the device or the user would do.
+// If force is false, the change of a virtual device control is skipped
+// if the control already has the specified value. Returns false if the
+// change is skipped
+func (sb *sandbox) setControl(devId, ctrlId, payload string, force bool) bool {
+	current, isLocal := sb.localControlValue(devId, ctrlId)
+	if !isLocal {
+		sb.publish(fmt.Sprintf("/devices/%s/controls/%s", devId, ctrlId), payload, true)
+		return true
+	}
+	if current == payload && !force {
+		return false
+	}
+	// the change comes from outside, e.g. from the web UI
+	sb.publish(fmt.Sprintf("/devices/%s/controls/%s/on", devId, ctrlId), payload, false)
+	return true
+}
+
+// confirmExternalWrites makes the sandbox respond to the writes
+// to the controls of external devices like the devices would do,
+// by publishing the new value of the control
+func (sb *sandbox) confirmExternalWrites() {
+	sb.injector.Subscribe(func(msg wbgong.MQTTMessage) {
+		parts := strings.Split(msg.Topic, "/")
+		if _, isLocal := sb.localControlValue(parts[2], parts[4]); !isLocal {
+			sb.publish(strings.TrimSuffix(msg.Topic, "/on"), msg.Payload, true)
+		}
+	}, "/devices/+/controls/+/on")
+}
+
+// localControlValue returns the current value of the control
+// if it belongs to a device defined by the scripts
+func (sb *sandbox) localControlValue(devId, ctrlId string) (value string, isLocal bool) {
+	sb.driver.Access(func(tx wbgong.DriverTx) error {
+		dev := tx.GetDevice(devId)
+		if dev == nil {
+			return nil
+		}
+		if _, isLocal = dev.(wbgong.LocalDevice); !isLocal {
+			return nil
+		}
+		if ctrl := dev.GetControl(ctrlId); ctrl != nil {
+			if v, err := ctrl.GetValue(); err == nil {
+				value = formatControlValue(v)
+			}
+		}
+		return nil
+	})
+	return
+}
@@ -0,0 +1,165 @@
+package wbrules
+
+import (
+	"sort"
+	"time"
+
+	"github.com/contactless/wbgong"
+	"github.com/stretchr/objx"
+)
+
+const (
+	// SCHEDULE_CRON_NEXT_COUNT is the number of upcoming
+	// fire times listed for each cron rule
+	SCHEDULE_CRON_NEXT_COUNT = 3
+)
+
+// ScheduledCronRule describes upcoming runs of a cron rule
+type ScheduledCronRule struct {
+	Id     RuleId  `json:"id"`
+	Name   string  `json:"name"`
+	Spec   string  `json:"spec"`
+	Script string  `json:"script,omitempty"`
+	Next   []int64 `json:"next"` // unix time in ms, empty if the rule never fires
+}
+
+// ScheduledTimer describes an active timer
+type ScheduledTimer struct {
+	Id         TimerId `json:"id"`
+	Name       string  `json:"name,omitempty"` // empty for anonymous timers
+	Interval   float64 `json:"interval"`       // ms
+	Periodic   bool    `json:"periodic"`
+	Persistent bool    `json:"persistent,omitempty"`
+	Paused     bool    `json:"paused,omitempty"`
+	Remaining  float64 `json:"remaining"` // ms
+	Script     string  `json:"script,omitempty"`
+}
+
+// Schedule lists upcoming cron rule runs and active timers
+type Schedule struct {
+	Cron   []ScheduledCronRule `json:"cron"`
+	Timers []ScheduledTimer    `json:"timers"`
+}
+
+// SetTimerScript sets the script which owns the timer
+func (engine *RuleEngine) SetTimerScript(n TimerId, script string) {
+	engine.timersMutex.Lock()
+	defer engine.timersMutex.Unlock()
+	if entry, found := engine.timers[n]; found {
+		entry.Lock()
+		entry.script = script
+		entry.Unlock()
+	}
+}
+
+// Schedule returns upcoming cron rule runs
+// and active timers of the engine
+func (engine *RuleEngine) Schedule() *Schedule {
+	now := engine.nowFunc()
+	return &Schedule{
+		Cron:   engine.scheduledCronRules(now),
+		Timers: engine.scheduledTimers(now),
+	}
+}
+
+func (engine *RuleEngine) scheduledCronRules(now time.Time) []ScheduledCronRule {
+	entries := make([]ScheduledCronRule, 0)
+	func() {
+		engine.rulesMutex.Lock()
+		defer engine.rulesMutex.Unlock()
+		for _, ruleId := range engine.ruleList {
+			rule := engine.ruleMap[ruleId]
+			if cond, ok := rule.cond.(*CronRuleCondition); ok {
+				entries = append(entries, ScheduledCronRule{
+					Id:     rule.id,
+					Name:   rule.name,
+					Spec:   cond.spec,
+					Script: rule.location.File,
+				})
+			}
+		}
+	}()
+
+	// the schedules are parsed without holding the rules
+	// because the first astronomical spec adds the location
+	// controls to the settings device
+	for i := range entries {
+		entries[i].Next = make([]int64, 0, SCHEDULE_CRON_NEXT_COUNT)
+		schedule, err := engine.ParseCronSpec(entries[i].Spec)
+		if err != nil {
+			wbgong.Debug.Printf("rule %s: invalid cron spec: %s", entries[i].Name, err)
+			continue
+		}
+		for t := now; len(entries[i].Next) < SCHEDULE_CRON_NEXT_COUNT; {
+			if t = schedule.Next(t); t.IsZero() {
+				break
+			}
+			entries[i].Next = append(entries[i].Next, t.UnixNano()/int64(time.Millisecond))
+		}
+	}
+	return entries
+}
+
+func (engine *RuleEngine) scheduledTimers(now time.Time) []ScheduledTimer {
+	engine.timersMutex.Lock()
+	defer engine.timersMutex.Unlock()
+
+	timers := make([]ScheduledTimer, 0, len(engine.timers))
+	for n, entry := range engine.timers {
+		entry.Lock()
+		timer := ScheduledTimer{
+			Id:         n,
+			Name:       entry.name,
+			Interval:   durationToMs(entry.interval),
+			Periodic:   entry.periodic,
+			Persistent: entry.persistent,
+			Paused:     entry.paused,
+			Remaining:  durationToMs(timerRemaining(entry, now)),
+			Script:     entry.script,
+		}
+		active := entry.active
+		entry.Unlock()
+		if active {
+			timers = append(timers, timer)
+		}
+	}
+	sort.Slice(timers, func(i, j int) bool {
+		return timers[i].Id < timers[j].Id
+	})
+	return timers
+}
+
+// jsObject converts the schedule to the object returned by scheduled()
+func (s *Schedule) jsObject() objx.Map {
+	cron := make([]interface{}, len(s.Cron))
+	for i, entry := range s.Cron {
+		next := make([]interface{}, len(entry.Next))
+		for j, t := range entry.Next {
+			next[j] = t
+		}
+		cron[i] = objx.Map{
+			"id":     uint32(entry.Id),
+			"name":   entry.Name,
+			"spec":   entry.Spec,
+			"script": entry.Script,
+			"next":   next,
+		}
+	}
+	timers := make([]interface{}, len(s.Timers))
+	for i, timer := range s.Timers {
+		timers[i] = objx.Map{
+			"id":         uint64(timer.Id),
+			"name":       timer.Name,
+			"interval":   timer.Interval,
+			"periodic":   timer.Periodic,
+			"persistent": timer.Persistent,
+			"paused":     timer.Paused,
+			"remaining":  timer.Remaining,
+			"script":     timer.Script,
+		}
+	}
+	return objx.Map{
+		"cron":   cron,
+		"timers": timers,
+	}
+}
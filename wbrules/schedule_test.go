@@ -0,0 +1,74 @@
+package wbrules
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/contactless/wbgong/testutils"
+)
+
+type ScheduleSuite struct {
+	RuleSuiteBase
+}
+
+func (s *ScheduleSuite) SetupTest() {
+	s.SetupSkippingDefs("testrules_schedule.js")
+}
+
+func (s *ScheduleSuite) TestSchedule() {
+	s.publish("/devices/somedev/controls/foo/meta/type", "text", "somedev/foo")
+	s.publish("/devices/somedev/controls/foo", "start", "somedev/foo")
+	s.Verify(
+		"tst -> /devices/somedev/controls/foo/meta/type: [text] (QoS 1, retained)",
+		"tst -> /devices/somedev/controls/foo: [start] (QoS 1, retained)",
+		"new fake ticker: 1, 5000",
+		"new fake timer: 2, 1000",
+	)
+
+	schedule := s.engine.Schedule()
+	s.Require().Len(schedule.Cron, 1)
+	s.Equal("scheduleHourly", schedule.Cron[0].Name)
+	s.Equal("@hourly", schedule.Cron[0].Spec)
+	s.True(strings.HasSuffix(schedule.Cron[0].Script, "testrules_schedule.js"))
+	s.Require().Len(schedule.Cron[0].Next, SCHEDULE_CRON_NEXT_COUNT)
+	s.Equal(int64(time.Hour/time.Millisecond), schedule.Cron[0].Next[1]-schedule.Cron[0].Next[0])
+
+	s.Require().Len(schedule.Timers, 2)
+	s.Equal(TimerId(1), schedule.Timers[0].Id)
+	s.Equal("tick", schedule.Timers[0].Name)
+	s.Equal(5000.0, schedule.Timers[0].Interval)
+	s.True(schedule.Timers[0].Periodic)
+	s.True(strings.HasSuffix(schedule.Timers[0].Script, "testrules_schedule.js"))
+	s.Equal(TimerId(2), schedule.Timers[1].Id)
+	s.Equal("", schedule.Timers[1].Name)
+	s.Equal(1000.0, schedule.Timers[1].Interval)
+	s.False(schedule.Timers[1].Periodic)
+	for _, timer := range schedule.Timers {
+		s.True(timer.Remaining > 0 && timer.Remaining <= timer.Interval,
+			"bad remaining time %v", timer.Remaining)
+	}
+
+	s.publish("/devices/somedev/controls/foo", "show", "somedev/foo")
+	s.Verify(
+		"tst -> /devices/somedev/controls/foo: [show] (QoS 1, retained)",
+		"[info] cron: scheduleHourly @hourly 3",
+		"[info] timer: tick 5000 true",
+		"[info] timer: - 1000 false",
+	)
+
+	s.FireTimer(2, s.AdvanceTime(time.Second))
+	s.Verify(
+		"timer.fire(): 2",
+		"[info] timeout",
+	)
+	s.WaitFor(func() bool {
+		return len(s.engine.Schedule().Timers) == 1
+	})
+}
+
+func TestScheduleSuite(t *testing.T) {
+	testutils.RunSuites(t,
+		new(ScheduleSuite),
+	)
+}
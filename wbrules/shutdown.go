@@ -0,0 +1,180 @@
+package wbrules
+
+import (
+	"sort"
+	"sync/atomic"
+	"time"
+
+	wbgong "github.com/contactless/wbgong"
+)
+
+const (
+	DEFAULT_SHUTDOWN_PHASE_TIMEOUT = 5 * time.Second
+	SHUTDOWN_POLL_INTERVAL         = 10 * time.Millisecond
+)
+
+// ShutdownOptions sets the time limits of the shutdown phases
+type ShutdownOptions struct {
+	drainTimeout   time.Duration
+	unloadTimeout  time.Duration
+	processTimeout time.Duration
+}
+
+func NewShutdownOptions() *ShutdownOptions {
+	return &ShutdownOptions{
+		drainTimeout:   DEFAULT_SHUTDOWN_PHASE_TIMEOUT,
+		unloadTimeout:  DEFAULT_SHUTDOWN_PHASE_TIMEOUT,
+		processTimeout: DEFAULT_SHUTDOWN_PHASE_TIMEOUT,
+	}
+}
+
+// SetDrainTimeout sets the time limit for processing
+// the events received before the shutdown
+func (o *ShutdownOptions) SetDrainTimeout(timeout time.Duration) *ShutdownOptions {
+	o.drainTimeout = timeout
+	return o
+}
+
+// SetUnloadTimeout sets the time limit for onUnload hooks
+func (o *ShutdownOptions) SetUnloadTimeout(timeout time.Duration) *ShutdownOptions {
+	o.unloadTimeout = timeout
+	return o
+}
+
+// SetProcessTimeout sets the time to wait for child
+// processes before killing them
+func (o *ShutdownOptions) SetProcessTimeout(timeout time.Duration) *ShutdownOptions {
+	o.processTimeout = timeout
+	return o
+}
+
+// callSyncTimeout runs the thunk in the sync loop waiting for it
+// to complete. Returns false if the thunk isn't done in time
+func (engine *RuleEngine) callSyncTimeout(thunk func(), timeout time.Duration) bool {
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	done := make(chan struct{})
+	select {
+	case engine.syncQueue <- func() {
+		thunk()
+		close(done)
+	}:
+	case <-timer.C:
+		return false
+	}
+
+	select {
+	case <-done:
+		return true
+	case <-timer.C:
+		return false
+	}
+}
+
+// stopAcceptingEvents makes the engine ignore driver events
+// and stops cron. Timers keep running till the engine is stopped
+func (engine *RuleEngine) stopAcceptingEvents(timeout time.Duration) bool {
+	atomic.StoreUint32(&engine.active, ENGINE_SHUTDOWN)
+	return engine.callSyncTimeout(func() {
+		if engine.cron != nil {
+			engine.cron.Stop()
+		}
+	}, timeout)
+}
+
+func (engine *RuleEngine) eventsPending() bool {
+	// mainLoop sets the flag before retrieving the events,
+	// so they can't be missed in between
+	return engine.eventBuffer.length() > 0 ||
+		atomic.LoadUint32(&engine.processingEvents) == ATOMIC_TRUE
+}
+
+// drainEvents waits till the buffered events are processed and
+// the sync queue is empty. Returns false if it doesn't happen
+// in time
+func (engine *RuleEngine) drainEvents(timeout time.Duration) bool {
+	deadline := time.Now().Add(timeout)
+	for {
+		if !engine.eventsPending() {
+			// the thunks of the processed events are queued
+			// by now, wait till they are done
+			if !engine.callSyncTimeout(func() {}, time.Until(deadline)) {
+				return false
+			}
+			if !engine.eventsPending() && len(engine.syncQueue) == 0 {
+				return true
+			}
+		}
+		if time.Now().After(deadline) {
+			return false
+		}
+		time.Sleep(SHUTDOWN_POLL_INTERVAL)
+	}
+}
+
+// runUnloadHooks runs onUnload() hooks of the script.
+// Must be called from the sync loop
+func (engine *ESEngine) runUnloadHooks(ctx *ESContext) {
+	hooks := engine.unloadHooks[ctx]
+	delete(engine.unloadHooks, ctx)
+	for _, hook := range hooks {
+		hook(nil)
+	}
+}
+
+func (engine *ESEngine) runAllUnloadHooks() {
+	paths := make([]string, 0, len(engine.localCtxs))
+	for path := range engine.localCtxs {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+	for _, path := range paths {
+		engine.runUnloadHooks(engine.localCtxs[path])
+	}
+}
+
+// Shutdown stops the engine gracefully. The engine stops accepting
+// driver events and processes the pending ones, runs onUnload()
+// hooks of the scripts and waits for the child processes to exit,
+// killing them after the timeout. Then the engine is stopped and
+// the persistent DB is closed. A phase that isn't done in time is
+// abandoned. The driver must be stopped after Shutdown returns
+func (engine *ESEngine) Shutdown(options *ShutdownOptions) {
+	if options == nil {
+		options = NewShutdownOptions()
+	}
+	start := time.Now()
+
+	wbgong.Info.Println("[engine] Shutdown: not accepting driver events anymore")
+	if !engine.stopAcceptingEvents(options.drainTimeout) {
+		wbgong.Warn.Printf("[engine] Shutdown: cron is not stopped in %s", options.drainTimeout)
+	}
+
+	wbgong.Info.Println("[engine] Shutdown: processing pending events")
+	if !engine.drainEvents(options.drainTimeout) {
+		wbgong.Warn.Printf("[engine] Shutdown: pending events are not processed in %s", options.drainTimeout)
+	}
+
+	wbgong.Info.Println("[engine] Shutdown: running onUnload hooks")
+	if !engine.callSyncTimeout(engine.runAllUnloadHooks, options.unloadTimeout) {
+		wbgong.Warn.Printf("[engine] Shutdown: onUnload hooks are not done in %s", options.unloadTimeout)
+	}
+
+	wbgong.Info.Println("[engine] Shutdown: waiting for child processes")
+	if killed := engine.processes.waitOrKill(options.processTimeout); killed > 0 {
+		wbgong.Warn.Printf("[engine] Shutdown: killed %d child processes after %s", killed, options.processTimeout)
+	}
+
+	wbgong.Info.Println("[engine] Shutdown: stopping the engine")
+	engine.Stop()
+
+	if engine.persistentDB != nil {
+		wbgong.Info.Println("[engine] Shutdown: flushing persistent DB")
+		if err := engine.ClosePersistentDB(); err != nil {
+			wbgong.Error.Printf("[engine] Shutdown: failed to close persistent DB: %s", err)
+		}
+	}
+
+	wbgong.Info.Printf("[engine] Shutdown: done in %s", time.Since(start))
+}
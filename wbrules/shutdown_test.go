@@ -0,0 +1,67 @@
+package wbrules
+
+import (
+	"testing"
+	"time"
+
+	"github.com/contactless/wbgong/testutils"
+)
+
+type ShutdownSuite struct {
+	RuleSuiteBase
+}
+
+func (s *ShutdownSuite) SetupTest() {
+	s.SetupSkippingDefs("testrules_shutdown.js")
+	s.publish("/devices/somedev/controls/cmd/meta/type", "text", "somedev/cmd")
+	s.Verify("tst -> /devices/somedev/controls/cmd/meta/type: [text] (QoS 1, retained)")
+}
+
+func (s *ShutdownSuite) TestUnloadOnRemove() {
+	s.publish("/devices/somedev/controls/cmd", "true", "somedev/cmd")
+	s.Verify(
+		"tst -> /devices/somedev/controls/cmd: [true] (QoS 1, retained)",
+		"[info] cmd: true",
+		"[info] exit(0): true",
+	)
+
+	s.RemoveScript("testrules_shutdown.js")
+	s.Verify(
+		"[info] unload",
+		"[removed] testrules_shutdown.js",
+	)
+}
+
+func (s *ShutdownSuite) TestShutdown() {
+	s.publish("/devices/somedev/controls/cmd", "sleep 60", "somedev/cmd")
+	s.Verify(
+		"tst -> /devices/somedev/controls/cmd: [sleep 60] (QoS 1, retained)",
+		"[info] cmd: sleep 60",
+	)
+
+	s.engine.Shutdown(NewShutdownOptions().SetProcessTimeout(100 * time.Millisecond))
+	s.False(s.engine.IsActive())
+
+	// the hooks run before the child processes are killed
+	s.Verify(
+		"[info] unload",
+		"[info] exit(-1): sleep 60",
+	)
+}
+
+func (s *ShutdownSuite) TestIgnoringEventsOnShutdown() {
+	s.Require().True(s.engine.stopAcceptingEvents(time.Second))
+
+	// the rule doesn't run
+	s.publish("/devices/somedev/controls/cmd", "true")
+	s.Verify("tst -> /devices/somedev/controls/cmd: [true] (QoS 1, retained)")
+
+	s.engine.Shutdown(nil)
+	s.Verify("[info] unload")
+}
+
+func TestShutdownSuite(t *testing.T) {
+	testutils.RunSuites(t,
+		new(ShutdownSuite),
+	)
+}
@@ -6,8 +6,10 @@ import (
 	"io"
 	"os"
 	"os/exec"
+	"strings"
 	"sync"
 	"syscall"
+	"time"
 
 	wbgong "github.com/contactless/wbgong"
 )
@@ -31,7 +33,77 @@ func captureCommandOutput(pipe io.ReadCloser, wg *sync.WaitGroup, result *string
 	}()
 }
 
+// processTracker keeps the running child processes, so they
+// can be waited for or killed when the engine is shut down
+type processTracker struct {
+	sync.Mutex
+	wg        sync.WaitGroup // the goroutines running the commands
+	processes map[*os.Process]string
+}
+
+func newProcessTracker() *processTracker {
+	return &processTracker{processes: make(map[*os.Process]string)}
+}
+
+func (t *processTracker) add(p *os.Process, cmdline string) {
+	t.Lock()
+	defer t.Unlock()
+	t.processes[p] = cmdline
+}
+
+func (t *processTracker) remove(p *os.Process) {
+	t.Lock()
+	defer t.Unlock()
+	delete(t.processes, p)
+}
+
+func (t *processTracker) wait(timeout time.Duration) bool {
+	done := make(chan struct{})
+	go func() {
+		t.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return true
+	case <-time.After(timeout):
+		return false
+	}
+}
+
+// waitOrKill waits for the commands to finish killing the processes
+// which are still running after the timeout. Returns the number
+// of the killed processes
+func (t *processTracker) waitOrKill(timeout time.Duration) (killed int) {
+	if t.wait(timeout) {
+		return
+	}
+
+	t.Lock()
+	for p, cmdline := range t.processes {
+		wbgong.Warn.Printf("killing child process %d: %s", p.Pid, cmdline)
+		if err := p.Kill(); err != nil {
+			wbgong.Error.Printf("failed to kill child process %d: %s", p.Pid, err)
+		} else {
+			killed++
+		}
+	}
+	t.Unlock()
+
+	// give the commands some time to run their callbacks
+	if !t.wait(timeout) {
+		wbgong.Warn.Printf("child process callbacks are still running")
+	}
+	return
+}
+
 func Spawn(name string, args []string, captureOutput bool, captureErrorOutput bool, input *string) (*CommandResult, error) {
+	return spawnTracked(nil, name, args, captureOutput, captureErrorOutput, input)
+}
+
+// spawnTracked runs the command like Spawn, the child
+// process is kept by the tracker if it's not nil
+func spawnTracked(tracker *processTracker, name string, args []string, captureOutput bool, captureErrorOutput bool, input *string) (*CommandResult, error) {
 	r := &CommandResult{0, "", ""}
 	var err error
 	var stdinPipe io.WriteCloser
@@ -59,6 +131,10 @@ func Spawn(name string, args []string, captureOutput bool, captureErrorOutput bo
 	if err = cmd.Start(); err != nil {
 		return nil, fmt.Errorf("cmd.Start() failed: %s", err)
 	}
+	if tracker != nil {
+		tracker.add(cmd.Process, strings.Join(cmd.Args, " "))
+		defer tracker.remove(cmd.Process)
+	}
 
 	if stdinPipe != nil || stdoutPipe != nil || stderrPipe != nil {
 		var wg sync.WaitGroup
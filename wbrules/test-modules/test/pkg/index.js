@@ -0,0 +1,4 @@
+exports.name = "pkg";
+
+// relative to the package directory
+exports.settings = require("../settings.json");
@@ -0,0 +1,13 @@
+defineRule("lightsOn", {
+  when: cron("@sunset+15m"),
+  then: function () {
+    log("lights on");
+  }
+});
+
+defineRule("lightsOff", {
+  when: cron("@sunrise-30m notbefore 07:00"),
+  then: function () {
+    log("lights off");
+  }
+});
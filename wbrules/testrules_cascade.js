@@ -0,0 +1,63 @@
+// -*- mode: js2-mode -*-
+
+defineVirtualDevice("cascade", {
+  title: "Cascade Test",
+  cells: {
+    a: {
+      type: "value",
+      value: 0
+    },
+    b: {
+      type: "value",
+      value: 0
+    },
+    c: {
+      type: "value",
+      value: 0
+    },
+    d: {
+      type: "value",
+      value: 0
+    }
+  }
+});
+
+defineRule("pingA", {
+  whenChanged: "cascade/a",
+  then: function (newValue) {
+    log("pingA: {}", newValue);
+    dev["cascade/b"] = newValue + 1;
+  }
+});
+
+defineRule("pingB", {
+  whenChanged: "cascade/b",
+  then: function (newValue) {
+    log("pingB: {}", newValue);
+    dev["cascade/a"] = newValue + 1;
+  }
+});
+
+defineRule("watchA", {
+  whenChanged: "cascade/a",
+  then: function (newValue) {
+    log("watchA: {}", newValue);
+  }
+});
+
+defineRule("delayedC", {
+  whenChanged: "cascade/c",
+  then: function (newValue) {
+    setTimeout(function () {
+      dev["cascade/d"] = newValue + 1;
+    }, 100);
+  }
+});
+
+defineRule("pongD", {
+  whenChanged: "cascade/d",
+  then: function (newValue) {
+    log("pongD: {}", newValue);
+    dev["cascade/c"] = newValue + 1;
+  }
+});
@@ -0,0 +1,5 @@
+defineVirtualDevice("check_dev", { cells: { on: { type: "switch", value: false } } });
+
+defineRule("check_rule", { whenChanged: "check_dev/on/extra", then: function () {} });
+
+defineRule("check_cron", { when: cron("no such spec"), then: function () {} });
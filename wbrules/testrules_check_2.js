@@ -0,0 +1,6 @@
+// rule names are local to the file, but duplicates are confusing
+defineRule("check_rule", { whenChanged: "check_dev/on", then: function () {} });
+
+defineRule("check_alias", { whenChanged: "noSuchAlias", then: function () {} });
+
+defineRule("check_alias_2", { whenChanged: ["check_dev/on", "otherAlias"], then: function () {} });
@@ -0,0 +1 @@
+defineVirtualDevice("check_dev", { cells: { on: { type: "switch", value: false } } });
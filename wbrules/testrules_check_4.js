@@ -0,0 +1,2 @@
+defineVirtualDevice("check_dev_2", { cells: { on: { type: "switch", value: false, writeable: true } } });
+defineVirtualDevice("check_dev_3", { cells: { on: { type: "switch", value: false, writeable: false } } });
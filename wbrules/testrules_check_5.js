@@ -0,0 +1,6 @@
+defineRule("check_syntax", {
+  whenChanged: "check_dev/on",
+  then: function () {
+    if (); // syntax error
+  }
+});
@@ -0,0 +1,29 @@
+// -*- mode: js2-mode -*-
+
+defineRule("debounced", {
+  whenChanged: "somedev/foo",
+  debounce: 500,
+  then: function (newValue) {
+    log("debounced: {}", newValue);
+  }
+});
+
+defineRule("throttled", {
+  whenChanged: "somedev/bar",
+  throttle: 500,
+  then: function (newValue) {
+    log("throttled: {}", newValue);
+  }
+});
+
+defineRule("debouncedLeading", {
+  asSoonAs: function () {
+    return dev.somedev.baz == "on";
+  },
+  debounce: 300,
+  leading: true,
+  trailing: false,
+  then: function () {
+    log("debouncedLeading fired");
+  }
+});
@@ -0,0 +1,37 @@
+// -*- mode: js2-mode -*-
+
+defineVirtualDevice("dryrun", {
+  title: "Dry Run Test",
+  cells: {
+    trigger: {
+      type: "switch",
+      value: false
+    },
+    state: {
+      type: "value",
+      value: 0
+    }
+  }
+});
+
+defineRule("actuate", {
+  whenChanged: "dryrun/trigger",
+  then: function (newValue) {
+    dev["somedev/sw"] = newValue;
+    dev["dryrun/state"] = 42;
+    getDevice("dryrun").getControl("state").setDescription("new description");
+    publish("/abc/def", "hello");
+    runShellCommand("touch /nonexistent/file", {
+      exitCallback: function (exitCode) {
+        log("exit({})", exitCode);
+      }
+    });
+  }
+});
+
+defineRule("stateChanged", {
+  whenChanged: "dryrun/state",
+  then: function (newValue) {
+    log("state: {}", newValue);
+  }
+});
@@ -0,0 +1,9 @@
+// -*- mode: js2-mode -*-
+
+defineRule("actuateForReal", {
+  whenChanged: "dryrun/trigger",
+  then: function (newValue) {
+    dev["somedev/temp"] = 20;
+    publish("/abc/real", "hello");
+  }
+});
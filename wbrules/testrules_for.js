@@ -0,0 +1,21 @@
+// -*- mode: js2-mode -*-
+
+defineRule("doorOpenTooLong", {
+  asSoonAs: function () {
+    return dev.somedev.door == "open";
+  },
+  "for": 5000,
+  then: function () {
+    log("door open for 5s");
+  }
+});
+
+defineRule("hotForAWhile", {
+  when: function () {
+    return dev.somedev.temp > 30;
+  },
+  "for": 1000,
+  then: function () {
+    log("still hot: {}", dev.somedev.temp);
+  }
+});
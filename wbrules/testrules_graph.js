@@ -0,0 +1,22 @@
+// -*- mode: js2-mode -*-
+
+defineRule("graphCtrl", {
+  whenChanged: "somedev/foo",
+  then: function () {}
+});
+
+defineRule("graphTimer", {
+  when: function () {
+    return timers.graphTimer.firing;
+  },
+  then: function () {}
+});
+
+var graphCounter = 0;
+
+defineRule("graphNoControls", {
+  when: function () {
+    return graphCounter > 100;
+  },
+  then: function () {}
+});
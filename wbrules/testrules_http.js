@@ -0,0 +1,10 @@
+// -*- mode: js2-mode -*-
+
+trackMqtt("/http-test/request", function (msg) {
+  http.request(JSON.parse(msg.value), function (err, resp) {
+    if (err)
+      log("http error: {}", err.message);
+    else
+      log("http response: {} {} [{}]", resp.status, resp.headers["X-Test"], resp.body);
+  });
+});
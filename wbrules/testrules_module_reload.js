@@ -0,0 +1,7 @@
+// -*- mode: js2-mode -*-
+
+var m = require("reloadable");
+log("reloadable value: {}", m.value);
+
+var settings = require("reloadable_settings.json");
+log("reloadable setpoint: {}", settings.setpoint);
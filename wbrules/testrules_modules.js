@@ -27,6 +27,10 @@ defineVirtualDevice("test", {
         cache: {
             type: "switch",
             value: false
+        },
+        resolve: {
+            type: "switch",
+            value: false
         }
     }
 });
@@ -100,3 +104,18 @@ defineRule("cache2", {
         log("Value: {}", m.hello);
     }
 });
+
+defineRule("resolve", {
+    whenChanged: "test/resolve",
+    then: function() {
+        var pkg = require("test/pkg");
+        log("package: {}, setpoint: {}", pkg.name, pkg.settings.setpoint);
+        log("json: {}", require("test/settings.json").setpoint);
+        log("relative: {}", require("./testrules_modules_helper").value);
+        try {
+            require("test/nosuchmodule");
+        } catch (e) {
+            log(e.message);
+        }
+    }
+});
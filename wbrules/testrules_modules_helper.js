@@ -0,0 +1,2 @@
+// required relative to testrules_modules.js
+exports.value = "helper";
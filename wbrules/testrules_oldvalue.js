@@ -0,0 +1,10 @@
+// -*- mode: js2-mode -*-
+
+defineRule("oldValue", {
+  whenChanged: "somedev/counter",
+  then: function (newValue, devName, cellName, oldValue, meta) {
+    log("{}/{}: {} -> {}, retained: {}, has timestamp: {}",
+        devName, cellName, oldValue === null ? "none" : oldValue, newValue,
+        meta.retained, meta.timestamp > 0);
+  }
+});
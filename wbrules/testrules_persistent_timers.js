@@ -0,0 +1,26 @@
+// -*- mode: js2-mode -*-
+
+defineRule("ventilationControl", {
+  whenChanged: "somedev/foo",
+  then: function (newValue) {
+    if (newValue == "start")
+      startTimer("ventilation", 3600000, { persistent: true });
+    else if (newValue == "startTimeout")
+      setPersistentTimeout("ventilation", 60000);
+    else if (newValue == "stop")
+      timers.ventilation.stop();
+    else if (newValue == "pause")
+      timers.ventilation.pause();
+    else if (newValue == "resume")
+      timers.ventilation.resume();
+  }
+});
+
+defineRule("ventilationOff", {
+  when: function () {
+    return timers.ventilation.firing;
+  },
+  then: function () {
+    log("ventilation off, late: {}", timers.ventilation.late);
+  }
+});
@@ -0,0 +1,8 @@
+// -*- mode: js2-mode -*-
+
+defineRule("comfort", {
+  whenChanged: "somedev/foo",
+  then: function (newValue) {
+    log("comfort: {}", newValue);
+  }
+});
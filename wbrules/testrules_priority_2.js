@@ -0,0 +1,16 @@
+// -*- mode: js2-mode -*-
+
+defineRule("lighting", {
+  whenChanged: "somedev/foo",
+  then: function (newValue) {
+    log("lighting: {}", newValue);
+  }
+});
+
+defineRule("interlock", {
+  whenChanged: "somedev/foo",
+  priority: 100,
+  then: function (newValue) {
+    log("interlock: {}", newValue);
+  }
+});
@@ -0,0 +1,17 @@
+// -*- mode: js2-mode -*-
+
+defineRule("buttonToRelay", {
+  whenChanged: "room/button",
+  then: function (newValue) {
+    dev["room/relay"] = newValue;
+  }
+});
+
+defineRule("relayChanged", {
+  whenChanged: "room/relay",
+  then: function (newValue) {
+    if (newValue) {
+      log("relay: " + newValue);
+    }
+  }
+});
@@ -0,0 +1,10 @@
+// -*- mode: js2-mode -*-
+
+trackMqtt("/rpc-test/call", function (msg) {
+  rpcCall("wb-mqtt-serial", "port", "Load", { path: "/dev/ttyRS485-1", msg: msg.value }, { timeout: 200 }, function (err, result) {
+    if (err)
+      log("rpc error: {} {} timeout={}", err.code, err.message, err.timeout);
+    else
+      log("rpc result: {}", JSON.stringify(result));
+  });
+});
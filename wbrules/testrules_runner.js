@@ -0,0 +1,34 @@
+// -*- mode: js2-mode -*-
+
+defineVirtualDevice("heating", {
+  title: "Heating",
+  cells: {
+    enabled: {
+      type: "switch",
+      value: false
+    },
+    setpoint: {
+      type: "range",
+      value: 21,
+      max: 30
+    }
+  }
+});
+
+defineRule("heaterControl", {
+  whenChanged: ["heating/enabled", "room/temp"],
+  then: function () {
+    dev["room/heater"] = dev["heating/enabled"] && dev["room/temp"] < dev["heating/setpoint"];
+  }
+});
+
+defineRule("heaterWatchdog", {
+  asSoonAs: function () {
+    return dev["heating/enabled"];
+  },
+  then: function () {
+    setTimeout(function () {
+      log("heating is on for 10s");
+    }, 10000);
+  }
+});
@@ -0,0 +1,31 @@
+// -*- mode: js2-mode -*-
+
+describe("heating", function () {
+  mockDevice("room", {
+    temp: { type: "temperature", value: 19 },
+    heater: false
+  });
+
+  it("turns the heater on", function () {
+    setControl("heating/enabled", true);
+    expectPublished("/devices/heating/controls/enabled", true);
+    expectPublished("/devices/room/controls/heater/on", "1");
+  });
+
+  it("turns the heater off when it's warm", function () {
+    setControl("heating/enabled", true);
+    setControl("room/temp", 25);
+    expectPublished("/devices/room/controls/heater/on", "0");
+  });
+
+  it("reports long heating", function () {
+    setControl("heating/enabled", true);
+    advanceTime(10000);
+    expectLog("info", "heating is on for 10s");
+  });
+
+  it("fails without heating", function () {
+    advanceTime(10000);
+    expectLog("heating is on for 10s");
+  });
+});
@@ -0,0 +1,28 @@
+// -*- mode: js2-mode -*-
+
+defineRule("scheduleHourly", {
+  when: cron("@hourly"),
+  then: function () {
+    log("hourly");
+  }
+});
+
+defineRule("scheduleShow", {
+  whenChanged: "somedev/foo",
+  then: function (newValue) {
+    if (newValue == "start") {
+      startTicker("tick", 5000);
+      setTimeout(function () {
+        log("timeout");
+      }, 1000);
+      return;
+    }
+    var s = scheduled();
+    s.cron.forEach(function (c) {
+      log("cron: {} {} {}", c.name, c.spec, c.next.length);
+    });
+    s.timers.forEach(function (t) {
+      log("timer: {} {} {}", t.name || "-", t.interval, t.periodic);
+    });
+  }
+});
@@ -0,0 +1,15 @@
+// -*- mode: js2-mode -*-
+
+defineRule("runCommand", {
+  whenChanged: "somedev/cmd",
+  then: function (cmd) {
+    log("cmd: {}", cmd);
+    runShellCommand(cmd, function (exitCode) {
+      log("exit({}): {}", exitCode, cmd);
+    });
+  }
+});
+
+onUnload(function () {
+  log("unload");
+});
@@ -0,0 +1,15 @@
+// -*- mode: js2-mode -*-
+
+defineRule("statsOk", {
+  whenChanged: "somedev/foo",
+  then: function (newValue) {
+    log("statsOk fired: {}", newValue);
+  }
+});
+
+defineRule("statsBroken", {
+  whenChanged: "somedev/foo",
+  then: function () {
+    throw new Error("broken rule");
+  }
+});
@@ -0,0 +1,24 @@
+// -*- mode: js2-mode -*-
+
+defineRule("heatingOnVacation", {
+  whenChanged: "somedev/foo",
+  tags: ["heating", "vacation"],
+  then: function (newValue) {
+    log("heatingOnVacation: {}", newValue);
+  }
+});
+
+defineRule("untagged", {
+  whenChanged: "somedev/foo",
+  then: function (newValue) {
+    log("untagged: {}", newValue);
+  }
+});
+
+defineRule("vacationCron", {
+  when: cron("@hourly"),
+  tags: ["vacation"],
+  then: function () {
+    log("vacationCron fired");
+  }
+});
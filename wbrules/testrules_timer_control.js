@@ -0,0 +1,48 @@
+// -*- mode: js2-mode -*-
+
+defineRule("timerControl", {
+  whenChanged: "somedev/foo",
+  then: function (newValue) {
+    var args = newValue.split(" "), timer = timers[args[1]];
+    switch (args[0]) {
+    case "motion":
+      // staircase light, the countdown starts anew on each motion
+      if (!timer.restart(args[2] ? parseInt(args[2]) : 0))
+        startTimer(args[1], 60000);
+      break;
+    case "tick":
+      startTicker(args[1], 1000);
+      break;
+    case "pause":
+      log("pause: {}", timer.pause());
+      break;
+    case "resume":
+      log("resume: {}", timer.resume());
+      break;
+    case "show":
+      log("remaining: {}", timer.remaining);
+      timers.list().forEach(function (t) {
+        log("timer: {} {} {}", t.name, t.remaining, t.paused);
+      });
+      break;
+    }
+  }
+});
+
+defineRule("stairsOff", {
+  when: function () {
+    return timers.stairs.firing;
+  },
+  then: function () {
+    log("stairs off");
+  }
+});
+
+defineRule("blink", {
+  when: function () {
+    return timers.blink.firing;
+  },
+  then: function () {
+    log("blink");
+  }
+});
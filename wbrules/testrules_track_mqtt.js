@@ -17,3 +17,14 @@ trackMqtt("/wierd/#", function (obj) {
     log("4. wierd topic got value");
     log("topic: {}, value: {}".format(obj.topic, obj.value));
 });
+
+var jsonTracker = trackMqtt("/json/+", function (msg) {
+    if (msg.jsonError)
+        log("json error: {}", msg.topic);
+    else
+        log("json: {} {} qos={} retained={}", msg.topic, msg.json.name, msg.qos, msg.retained);
+}, { json: true });
+
+trackMqtt("/untrack", function (msg) {
+    log("untrack: {}", untrackMqtt(jsonTracker));
+});
@@ -0,0 +1,540 @@
+package wbrules
+
+import (
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	duktape "github.com/contactless/go-duktape"
+	"github.com/contactless/wbgong"
+	"github.com/stretchr/objx"
+)
+
+const (
+	TEST_REPORT_TAP   = "tap"
+	TEST_REPORT_JUNIT = "junit"
+
+	TEST_LOG_TOPIC_PREFIX = "/wbrules/log/"
+)
+
+// TestResult is the outcome of a single test case
+type TestResult struct {
+	Name     string
+	Failure  string // empty if the test has passed
+	Duration time.Duration
+}
+
+func (result TestResult) Passed() bool {
+	return result.Failure == ""
+}
+
+// TestRunner runs the tests for the scripts written in JS using
+// describe() and it(). Each test case runs in its own sandbox
+// with the scripts loaded anew, so the tests don't affect
+// each other
+type TestRunner struct {
+	specPath string
+	scripts  []string
+	options  *ESEngineOptions
+}
+
+// NewTestRunner creates the runner for the spec file. scripts
+// lists the script files and directories to be tested
+func NewTestRunner(specPath string, scripts []string, options *ESEngineOptions) *TestRunner {
+	return &TestRunner{specPath, scripts, options}
+}
+
+// Run runs all the test cases defined in the spec
+func (runner *TestRunner) Run() (results []TestResult, err error) {
+	scripts, err := expandScriptPaths(runner.scripts, runner.specPath)
+	if err != nil {
+		return nil, err
+	}
+	for i := 0; ; i++ {
+		result, count, err := runner.runTest(scripts, i)
+		switch {
+		case err != nil:
+			return results, err
+		case count == 0:
+			return nil, fmt.Errorf("no tests defined in %s", runner.specPath)
+		}
+		results = append(results, result)
+		if i+1 >= count {
+			return results, nil
+		}
+	}
+}
+
+// runTest runs the test case with the specified index. It returns
+// the number of test cases in the spec, too
+func (runner *TestRunner) runTest(scripts []string, index int) (result TestResult, count int, err error) {
+	session, err := newTestSession(runner.options)
+	if err != nil {
+		return
+	}
+	defer session.Close()
+
+	if err = session.load(scripts, runner.specPath); err != nil {
+		return
+	}
+	count = len(session.tests)
+	if index < count {
+		result = session.run(session.tests[index])
+	}
+	return
+}
+
+// testStep is an action or an expectation recorded by the test API
+type testStep struct {
+	where string
+	run   func() error
+}
+
+// testScope corresponds to describe() block
+type testScope struct {
+	name   string
+	parent *testScope
+	setup  []testStep
+}
+
+func (scope *testScope) fullName(name string) string {
+	names := []string{name}
+	for ; scope != nil; scope = scope.parent {
+		if scope.name != "" {
+			names = append([]string{scope.name}, names...)
+		}
+	}
+	return strings.TrimSpace(strings.Join(names, " "))
+}
+
+type testCase struct {
+	name  string
+	scope *testScope
+	ctx   *ESContext
+	fn    ESCallbackFunc
+}
+
+// testSession is a sandbox running a single test case
+type testSession struct {
+	sb    *sandbox
+	clock *VirtualClock
+
+	publishedMutex sync.Mutex
+	published      []wbgong.MQTTMessage // not matched by the expectations yet
+
+	// the following fields are used from the engine's sync loop
+	scope   *testScope
+	steps   *[]testStep
+	inTest  bool
+	tests   []*testCase
+	loadErr error
+}
+
+func newTestSession(options *ESEngineOptions) (session *testSession, err error) {
+	session = &testSession{
+		clock: NewVirtualClock(time.Now()),
+		scope: &testScope{},
+	}
+	session.steps = &session.scope.setup
+	if session.sb, err = newSandbox(session.clock, session.notePublished, options); err != nil {
+		return nil, err
+	}
+	return session, nil
+}
+
+func (session *testSession) Close() {
+	session.sb.Close()
+}
+
+func (session *testSession) notePublished(clientId string, msg wbgong.MQTTMessage) {
+	if clientId == SANDBOX_INJECTOR_CLIENT {
+		return
+	}
+	session.publishedMutex.Lock()
+	defer session.publishedMutex.Unlock()
+	session.published = append(session.published, msg)
+}
+
+// takePublished removes the first message matching the filter
+// from the list of published messages
+func (session *testSession) takePublished(match func(msg wbgong.MQTTMessage) bool) bool {
+	session.publishedMutex.Lock()
+	defer session.publishedMutex.Unlock()
+	for i, msg := range session.published {
+		if match(msg) {
+			session.published = append(session.published[:i], session.published[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+// publishedTo returns the payloads of not yet matched
+// messages published to the topics matching the filter
+func (session *testSession) publishedTo(filter string) (payloads []string) {
+	session.publishedMutex.Lock()
+	defer session.publishedMutex.Unlock()
+	for _, msg := range session.published {
+		if mqttTopicMatch(filter, msg.Topic) {
+			payloads = append(payloads, msg.Payload)
+		}
+	}
+	return
+}
+
+func (session *testSession) load(scripts []string, specPath string) error {
+	engine := session.sb.engine
+	engine.DefineGlobalFunctions(map[string]func(*ESContext) int{
+		"describe":        session.esDescribe,
+		"it":              session.esIt,
+		"mockDevice":      session.esMockDevice,
+		"setControl":      session.esSetControl,
+		"advanceTime":     session.esAdvanceTime,
+		"expectPublished": session.esExpectPublished,
+		"expectLog":       session.esExpectLog,
+	})
+	for _, path := range scripts {
+		if err := engine.LoadFile(path); err != nil {
+			return fmt.Errorf("error loading script %s: %s", path, err)
+		}
+	}
+	if err := engine.LoadFile(specPath); err != nil {
+		return fmt.Errorf("error loading spec %s: %s", specPath, err)
+	}
+	if session.loadErr != nil {
+		return session.loadErr
+	}
+	if err := session.sb.waitReady(); err != nil {
+		return err
+	}
+
+	// only the messages published by the test steps
+	// are checked by the expectations
+	session.publishedMutex.Lock()
+	session.published = nil
+	session.publishedMutex.Unlock()
+	return nil
+}
+
+func (session *testSession) run(test *testCase) (result TestResult) {
+	result.Name = test.name
+	start := time.Now()
+	defer func() { result.Duration = time.Since(start) }()
+
+	// setup steps of the enclosing describe() blocks go first
+	var steps []testStep
+	for scope := test.scope; scope != nil; scope = scope.parent {
+		steps = append(append([]testStep(nil), scope.setup...), steps...)
+	}
+
+	// the test body only records the steps, which are executed
+	// outside the engine's sync loop so the engine can process
+	// the events in between
+	var body []testStep
+	var err error
+	done := make(chan struct{})
+	session.sb.engine.CallSync(func() {
+		defer close(done)
+		session.inTest = true
+		err = session.invoke(&body, test.ctx, test.fn)
+		session.inTest = false
+	})
+	<-done
+	if err != nil {
+		result.Failure = err.Error()
+		return
+	}
+
+	for _, step := range append(steps, body...) {
+		if err := step.run(); err != nil {
+			result.Failure = fmt.Sprintf("%s: %s", step.where, err)
+			return
+		}
+	}
+	return
+}
+
+// invoke calls JS function recording the test steps
+// to the specified list. Must be called from the
+// engine's sync loop
+func (session *testSession) invoke(steps *[]testStep, ctx *ESContext, fn ESCallbackFunc) error {
+	prevSteps := session.steps
+	session.steps = steps
+	defer func() { session.steps = prevSteps }()
+
+	ctx.lastCallbackError = nil
+	fn(nil)
+	if ctx.lastCallbackError != nil {
+		return ctx.lastCallbackError
+	}
+	return nil
+}
+
+func (session *testSession) addStep(ctx *ESContext, run func() error) {
+	*session.steps = append(*session.steps, testStep{stepLocation(ctx), run})
+}
+
+// stepLocation returns the location of the test API call in the spec
+func stepLocation(ctx *ESContext) string {
+	filename := ctx.GetCurrentFilename()
+	for _, loc := range ctx.GetTraceback() {
+		if loc.filename == filename {
+			return fmt.Sprintf("%s:%d", filepath.Base(filename), loc.line)
+		}
+	}
+	return filepath.Base(filename)
+}
+
+func (session *testSession) esDescribe(ctx *ESContext) int {
+	if ctx.GetTop() != 2 || !ctx.IsString(0) || !ctx.IsFunction(1) || session.inTest {
+		return duktape.DUK_RET_TYPE_ERROR
+	}
+	scope := &testScope{name: ctx.GetString(0), parent: session.scope}
+	fn := ctx.WrapCallback(1)
+
+	session.scope = scope
+	err := session.invoke(&scope.setup, ctx, fn)
+	session.scope = scope.parent
+	if err != nil && session.loadErr == nil {
+		session.loadErr = fmt.Errorf("describe(\"%s\") failed: %s", scope.fullName(""), err)
+	}
+	return 0
+}
+
+func (session *testSession) esIt(ctx *ESContext) int {
+	if ctx.GetTop() != 2 || !ctx.IsString(0) || !ctx.IsFunction(1) || session.inTest {
+		return duktape.DUK_RET_TYPE_ERROR
+	}
+	session.tests = append(session.tests, &testCase{
+		name:  session.scope.fullName(ctx.GetString(0)),
+		scope: session.scope,
+		ctx:   ctx,
+		fn:    ctx.WrapCallback(1),
+	})
+	return 0
+}
+
+// mockControlType guesses the type of mock control by its value
+func mockControlType(value interface{}) string {
+	switch value.(type) {
+	case bool:
+		return "switch"
+	case float64:
+		return "value"
+	default:
+		return "text"
+	}
+}
+
+func (session *testSession) esMockDevice(ctx *ESContext) int {
+	if ctx.GetTop() != 2 || !ctx.IsString(0) || !ctx.IsObject(1) {
+		return duktape.DUK_RET_TYPE_ERROR
+	}
+	devId := ctx.GetString(0)
+	controls, ok := ctx.GetJSObject(1).(objx.Map)
+	if !ok {
+		return duktape.DUK_RET_TYPE_ERROR
+	}
+
+	ctrlIds := make([]string, 0, len(controls))
+	for ctrlId := range controls {
+		ctrlIds = append(ctrlIds, ctrlId)
+	}
+	sort.Strings(ctrlIds)
+
+	session.addStep(ctx, func() error {
+		session.sb.publish(fmt.Sprintf("/devices/%s/meta/name", devId), devId, true)
+		for _, ctrlId := range ctrlIds {
+			value := controls[ctrlId]
+			ctrlType := mockControlType(value)
+			// the control may be described as {type: ..., value: ...}
+			if def, ok := value.(objx.Map); ok {
+				value = def[VDEV_CONTROL_DESCR_PROP_VALUE]
+				ctrlType = mockControlType(value)
+				if t, ok := def[VDEV_CONTROL_DESCR_PROP_TYPE].(string); ok {
+					ctrlType = t
+				}
+			}
+			topic := fmt.Sprintf("/devices/%s/controls/%s", devId, ctrlId)
+			session.sb.publish(topic+"/meta/type", ctrlType, true)
+			session.sb.publish(topic, formatControlValue(value), true)
+		}
+		session.sb.settle()
+		return nil
+	})
+	return 0
+}
+
+func (session *testSession) esSetControl(ctx *ESContext) int {
+	if ctx.GetTop() != 2 || !ctx.IsString(0) {
+		return duktape.DUK_RET_TYPE_ERROR
+	}
+	parts := strings.SplitN(ctx.GetString(0), "/", 2)
+	if len(parts) != 2 {
+		return duktape.DUK_RET_TYPE_ERROR
+	}
+	payload := formatControlValue(ctx.GetJSObject(1))
+	session.addStep(ctx, func() error {
+		session.sb.setControl(parts[0], parts[1], payload, true)
+		session.sb.settle()
+		return nil
+	})
+	return 0
+}
+
+func (session *testSession) esAdvanceTime(ctx *ESContext) int {
+	if ctx.GetTop() != 1 || !ctx.IsNumber(0) {
+		return duktape.DUK_RET_TYPE_ERROR
+	}
+	d := time.Duration(ctx.GetNumber(0) * float64(time.Millisecond))
+	session.addStep(ctx, func() error {
+		session.clock.AdvanceTo(session.clock.Now().Add(d), session.sb.settle)
+		session.sb.settle()
+		return nil
+	})
+	return 0
+}
+
+func (session *testSession) esExpectPublished(ctx *ESContext) int {
+	top := ctx.GetTop()
+	if top < 1 || top > 2 || !ctx.IsString(0) {
+		return duktape.DUK_RET_TYPE_ERROR
+	}
+	topic := ctx.GetString(0)
+	anyPayload := top == 1
+	payload := ""
+	if !anyPayload {
+		payload = formatControlValue(ctx.GetJSObject(1))
+	}
+	session.addStep(ctx, func() error {
+		if session.takePublished(func(msg wbgong.MQTTMessage) bool {
+			return msg.Topic == topic && (anyPayload || msg.Payload == payload)
+		}) {
+			return nil
+		}
+		expected := topic
+		if !anyPayload {
+			expected = fmt.Sprintf("%s: [%s]", topic, payload)
+		}
+		return notFoundError(fmt.Sprintf("expected %s to be published", expected), session.publishedTo(topic))
+	})
+	return 0
+}
+
+func (session *testSession) esExpectLog(ctx *ESContext) int {
+	level := "+"
+	switch {
+	case ctx.GetTop() == 1 && ctx.IsString(0):
+	case ctx.GetTop() == 2 && ctx.IsString(0) && ctx.IsString(1):
+		level = ctx.GetString(0)
+	default:
+		return duktape.DUK_RET_TYPE_ERROR
+	}
+	message := ctx.GetString(-1)
+	filter := TEST_LOG_TOPIC_PREFIX + level
+	session.addStep(ctx, func() error {
+		if session.takePublished(func(msg wbgong.MQTTMessage) bool {
+			return mqttTopicMatch(filter, msg.Topic) && msg.Payload == message
+		}) {
+			return nil
+		}
+		return notFoundError(fmt.Sprintf("expected %q to be logged", message), session.publishedTo(filter))
+	})
+	return 0
+}
+
+func notFoundError(message string, got []string) error {
+	if len(got) == 0 {
+		return errors.New(message + ", got nothing")
+	}
+	quoted := make([]string, len(got))
+	for i, payload := range got {
+		quoted[i] = strconv.Quote(payload)
+	}
+	return fmt.Errorf("%s, got: %s", message, strings.Join(quoted, ", "))
+}
+
+// WriteTAP writes the results in Test Anything Protocol format
+func WriteTAP(w io.Writer, results []TestResult) error {
+	if _, err := fmt.Fprintf(w, "TAP version 13\n1..%d\n", len(results)); err != nil {
+		return err
+	}
+	for i, result := range results {
+		status := "ok"
+		if !result.Passed() {
+			status = "not ok"
+		}
+		if _, err := fmt.Fprintf(w, "%s %d - %s\n", status, i+1, result.Name); err != nil {
+			return err
+		}
+		if !result.Passed() {
+			if _, err := fmt.Fprintf(w, "  ---\n  message: %s\n  ...\n", strconv.Quote(result.Failure)); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+type junitFailure struct {
+	Message string `xml:"message,attr"`
+	Text    string `xml:",chardata"`
+}
+
+type junitTestCase struct {
+	Name      string        `xml:"name,attr"`
+	ClassName string        `xml:"classname,attr"`
+	Time      string        `xml:"time,attr"`
+	Failure   *junitFailure `xml:"failure,omitempty"`
+}
+
+type junitTestSuite struct {
+	XMLName  xml.Name        `xml:"testsuite"`
+	Name     string          `xml:"name,attr"`
+	Tests    int             `xml:"tests,attr"`
+	Failures int             `xml:"failures,attr"`
+	Time     string          `xml:"time,attr"`
+	Cases    []junitTestCase `xml:"testcase"`
+}
+
+func junitTime(d time.Duration) string {
+	return strconv.FormatFloat(d.Seconds(), 'f', 3, 64)
+}
+
+// WriteJUnit writes the results as JUnit XML report
+func WriteJUnit(w io.Writer, suiteName string, results []TestResult) error {
+	suite := junitTestSuite{Name: suiteName, Tests: len(results)}
+	var total time.Duration
+	for _, result := range results {
+		tc := junitTestCase{
+			Name:      result.Name,
+			ClassName: suiteName,
+			Time:      junitTime(result.Duration),
+		}
+		if !result.Passed() {
+			suite.Failures++
+			tc.Failure = &junitFailure{result.Failure, result.Failure}
+		}
+		total += result.Duration
+		suite.Cases = append(suite.Cases, tc)
+	}
+	suite.Time = junitTime(total)
+
+	if _, err := io.WriteString(w, xml.Header); err != nil {
+		return err
+	}
+	enc := xml.NewEncoder(w)
+	enc.Indent("", "  ")
+	if err := enc.Encode(suite); err != nil {
+		return err
+	}
+	_, err := io.WriteString(w, "\n")
+	return err
+}
@@ -0,0 +1,68 @@
+package wbrules
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTestRunner(t *testing.T) {
+	runner := NewTestRunner("testrules_runner_spec.js", []string{"testrules_runner.js"}, NewESEngineOptions())
+	results, err := runner.Run()
+	require.NoError(t, err)
+	require.Len(t, results, 4)
+
+	assert.Equal(t, "heating turns the heater on", results[0].Name)
+	assert.True(t, results[0].Passed(), results[0].Failure)
+	assert.Equal(t, "heating turns the heater off when it's warm", results[1].Name)
+	assert.True(t, results[1].Passed(), results[1].Failure)
+	assert.Equal(t, "heating reports long heating", results[2].Name)
+	assert.True(t, results[2].Passed(), results[2].Failure)
+
+	assert.Equal(t, "heating fails without heating", results[3].Name)
+	assert.Contains(t, results[3].Failure,
+		`testrules_runner_spec.js:29: expected "heating is on for 10s" to be logged`)
+}
+
+func TestESEngineOptionsCopy(t *testing.T) {
+	options := NewESEngineOptions()
+	options.SetPersistentDBFile("/var/lib/wirenboard/wbrules-persistent.db")
+
+	c := options.Copy()
+	c.SetPersistentDBFile("/tmp/persistent.db")
+	c.SetDryRun(true)
+	assert.Equal(t, "/var/lib/wirenboard/wbrules-persistent.db", options.PersistentDBFile)
+	assert.False(t, options.dryRun)
+	assert.True(t, c.dryRun)
+}
+
+func TestTestReports(t *testing.T) {
+	results := []TestResult{
+		{Name: "first", Duration: 1500 * time.Millisecond},
+		{Name: "second", Failure: "spec.js:3: expected /a/b to be published, got nothing", Duration: 250 * time.Millisecond},
+	}
+
+	var buf bytes.Buffer
+	require.NoError(t, WriteTAP(&buf, results))
+	assert.Equal(t, "TAP version 13\n"+
+		"1..2\n"+
+		"ok 1 - first\n"+
+		"not ok 2 - second\n"+
+		"  ---\n"+
+		"  message: \"spec.js:3: expected /a/b to be published, got nothing\"\n"+
+		"  ...\n", buf.String())
+
+	buf.Reset()
+	require.NoError(t, WriteJUnit(&buf, "spec.js", results))
+	assert.Equal(t, `<?xml version="1.0" encoding="UTF-8"?>
+<testsuite name="spec.js" tests="2" failures="1" time="1.750">
+  <testcase name="first" classname="spec.js" time="1.500"></testcase>
+  <testcase name="second" classname="spec.js" time="0.250">
+    <failure message="spec.js:3: expected /a/b to be published, got nothing">spec.js:3: expected /a/b to be published, got nothing</failure>
+  </testcase>
+</testsuite>
+`, buf.String())
+}
@@ -0,0 +1,118 @@
+package wbrules
+
+import (
+	"time"
+)
+
+// FindTimerByName returns the id of the active timer
+// with the specified name
+func (engine *RuleEngine) FindTimerByName(name string) (n TimerId, found bool) {
+	engine.timersMutex.Lock()
+	defer engine.timersMutex.Unlock()
+	for id, entry := range engine.timers {
+		if entry.name == name {
+			return id, true
+		}
+	}
+	return
+}
+
+// timerRemaining returns the time left till the timer fires.
+// Must be called with the entry locked
+func timerRemaining(entry *TimerEntry, now time.Time) time.Duration {
+	switch {
+	case entry.paused:
+		return entry.remaining
+	case entry.deadline.IsZero():
+		// not started yet
+		return entry.interval
+	}
+	if remaining := entry.deadline.Sub(now); remaining > 0 {
+		return remaining
+	}
+	// the timer fired, but it's not processed yet
+	return 0
+}
+
+// TimerRemaining returns the time left till the timer fires
+func (engine *RuleEngine) TimerRemaining(n TimerId) (remaining time.Duration, found bool) {
+	entry, found := engine.FindTimerByIndex(n)
+	if !found {
+		return
+	}
+	entry.Lock()
+	defer entry.Unlock()
+	if !entry.active {
+		return 0, false
+	}
+	return timerRemaining(entry, engine.nowFunc()), true
+}
+
+// PauseTimer stops the countdown of the timer keeping the time
+// left till the timer fires. Returns false if the timer isn't
+// active or it's already paused
+func (engine *RuleEngine) PauseTimer(n TimerId) bool {
+	entry, found := engine.FindTimerByIndex(n)
+	if !found {
+		return false
+	}
+	entry.Lock()
+	if !entry.active || entry.paused {
+		entry.Unlock()
+		return false
+	}
+	entry.remaining = timerRemaining(entry, engine.nowFunc())
+	entry.paused = true
+	entry.disarm()
+	entry.Unlock()
+
+	engine.maybeUpdatePersistentTimer(entry)
+	return true
+}
+
+// ResumeTimer continues the countdown of the paused timer.
+// Returns false if the timer isn't active or it isn't paused
+func (engine *RuleEngine) ResumeTimer(n TimerId) bool {
+	entry, found := engine.FindTimerByIndex(n)
+	if !found {
+		return false
+	}
+	entry.Lock()
+	if !entry.active || !entry.paused {
+		entry.Unlock()
+		return false
+	}
+	entry.paused = false
+	engine.armTimer(n, entry, entry.remaining)
+	entry.Unlock()
+
+	engine.maybeUpdatePersistentTimer(entry)
+	return true
+}
+
+// RestartTimer starts the countdown of the timer anew keeping
+// its id, so the rules depending on the timer stay the same.
+// If interval is not zero, it replaces the interval of the
+// timer. Returns false if the timer isn't active
+func (engine *RuleEngine) RestartTimer(n TimerId, interval time.Duration) bool {
+	entry, found := engine.FindTimerByIndex(n)
+	if !found {
+		return false
+	}
+	entry.Lock()
+	if !entry.active {
+		entry.Unlock()
+		return false
+	}
+	if interval > 0 {
+		entry.interval = interval
+	}
+	entry.cascade = engine.currentCascade()
+	entry.paused = false
+	entry.disarm()
+	engine.armTimer(n, entry, entry.interval)
+	entry.Unlock()
+
+	engine.maybeUpdatePersistentTimer(entry)
+	return true
+}
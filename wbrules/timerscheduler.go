@@ -0,0 +1,172 @@
+package wbrules
+
+import (
+	"container/heap"
+	"sync"
+	"time"
+)
+
+// scheduledItem is a timer run by timerScheduler
+type scheduledItem struct {
+	deadline time.Time
+	period   time.Duration // zero for one-shot timers
+	thunk    func()
+	index    int // position in the heap, -1 if the item is removed
+}
+
+type timerHeap []*scheduledItem
+
+func (h timerHeap) Len() int { return len(h) }
+
+func (h timerHeap) Less(i, j int) bool { return h[i].deadline.Before(h[j].deadline) }
+
+func (h timerHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].index = i
+	h[j].index = j
+}
+
+func (h *timerHeap) Push(x interface{}) {
+	item := x.(*scheduledItem)
+	item.index = len(*h)
+	*h = append(*h, item)
+}
+
+func (h *timerHeap) Pop() interface{} {
+	old := *h
+	n := len(old)
+	item := old[n-1]
+	old[n-1] = nil
+	item.index = -1
+	*h = old[:n-1]
+	return item
+}
+
+// timerScheduler runs all the timers in a single goroutine
+// keeping them in a min-heap ordered by the deadline. The thunks
+// of the timers that are due are pushed into the fire channel,
+// which is the sync queue of the engine
+type timerScheduler struct {
+	mutex   sync.Mutex
+	items   timerHeap
+	fireCh  chan<- func()
+	wakeCh  chan struct{}
+	quit    chan struct{}
+	quitted chan struct{}
+}
+
+func newTimerScheduler(fireCh chan<- func()) *timerScheduler {
+	s := &timerScheduler{
+		items:   make(timerHeap, 0),
+		fireCh:  fireCh,
+		wakeCh:  make(chan struct{}, 1),
+		quit:    make(chan struct{}),
+		quitted: make(chan struct{}),
+	}
+	go s.run()
+	return s
+}
+
+// add schedules the thunk to be run after d and then
+// with the period if it's not zero
+func (s *timerScheduler) add(d, period time.Duration, thunk func()) *scheduledItem {
+	item := &scheduledItem{
+		deadline: time.Now().Add(d),
+		period:   period,
+		thunk:    thunk,
+	}
+	s.mutex.Lock()
+	heap.Push(&s.items, item)
+	first := item.index == 0
+	s.mutex.Unlock()
+
+	if first {
+		// the scheduler needs to wait less now
+		select {
+		case s.wakeCh <- struct{}{}:
+		default:
+		}
+	}
+	return item
+}
+
+// remove cancels the item. The thunk may still be run
+// if it's already pushed into the fire channel
+func (s *timerScheduler) remove(item *scheduledItem) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if item.index >= 0 {
+		heap.Remove(&s.items, item.index)
+	}
+}
+
+func (s *timerScheduler) stop() {
+	close(s.quit)
+	<-s.quitted
+}
+
+// popDue removes the items which are due from the heap
+// rescheduling the periodic ones. Returns the thunks of
+// the items and the time till the next deadline
+func (s *timerScheduler) popDue(now time.Time) (thunks []func(), wait time.Duration, hasNext bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	for len(s.items) > 0 && !s.items[0].deadline.After(now) {
+		item := s.items[0]
+		thunks = append(thunks, item.thunk)
+		if item.period == 0 {
+			heap.Pop(&s.items)
+			continue
+		}
+		// like time.Ticker, drop the ticks if
+		// the thunks are not processed in time
+		item.deadline = item.deadline.Add(item.period)
+		if !item.deadline.After(now) {
+			item.deadline = now.Add(item.period)
+		}
+		heap.Fix(&s.items, 0)
+	}
+	if len(s.items) > 0 {
+		return thunks, s.items[0].deadline.Sub(now), true
+	}
+	return thunks, 0, false
+}
+
+func (s *timerScheduler) run() {
+	defer close(s.quitted)
+
+	timer := time.NewTimer(time.Hour)
+	timer.Stop()
+	for {
+		thunks, wait, hasNext := s.popDue(time.Now())
+		for _, thunk := range thunks {
+			// exit immediately on quit signal as
+			// the sync queue may be not processed
+			select {
+			case s.fireCh <- thunk:
+			case <-s.quit:
+				return
+			}
+		}
+		if len(thunks) > 0 {
+			// some time may pass while pushing the thunks
+			continue
+		}
+
+		var timerCh <-chan time.Time
+		if hasNext {
+			timer.Reset(wait)
+			timerCh = timer.C
+		}
+		select {
+		case <-timerCh:
+		case <-s.wakeCh:
+			if timerCh != nil && !timer.Stop() {
+				<-timer.C
+			}
+		case <-s.quit:
+			timer.Stop()
+			return
+		}
+	}
+}
@@ -0,0 +1,165 @@
+package wbrules
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func recordingThunk(fired *[]string, name string) func() {
+	return func() {
+		*fired = append(*fired, name)
+	}
+}
+
+// runThunks runs the specified number of thunks
+// received from the channel
+func runThunks(t *testing.T, ch <-chan func(), count int) {
+	for i := 0; i < count; i++ {
+		select {
+		case thunk := <-ch:
+			thunk()
+		case <-time.After(5 * time.Second):
+			require.FailNow(t, "timeout waiting for the timer")
+		}
+	}
+}
+
+func TestTimerSchedulerPopDue(t *testing.T) {
+	var fired []string
+	s := &timerScheduler{items: make(timerHeap, 0), wakeCh: make(chan struct{}, 1)}
+	start := time.Now()
+	s.add(30*time.Millisecond, 0, recordingThunk(&fired, "a"))
+	s.add(10*time.Millisecond, 0, recordingThunk(&fired, "b"))
+	ticker := s.add(20*time.Millisecond, 100*time.Millisecond, recordingThunk(&fired, "c"))
+
+	thunks, wait, hasNext := s.popDue(start)
+	assert.Empty(t, thunks)
+	assert.True(t, hasNext)
+	assert.True(t, wait >= 10*time.Millisecond, "bad wait time %s", wait)
+
+	now := start.Add(25 * time.Millisecond)
+	thunks, wait, hasNext = s.popDue(now)
+	for _, thunk := range thunks {
+		thunk()
+	}
+	assert.Equal(t, []string{"b", "c"}, fired)
+	assert.True(t, hasNext)
+	assert.True(t, wait > 0 && wait <= 30*time.Millisecond, "bad wait time %s", wait)
+	require.Len(t, s.items, 2)
+	assert.True(t, ticker.deadline.After(now.Add(90*time.Millisecond)),
+		"the ticker is not rescheduled")
+
+	s.remove(ticker)
+	s.remove(ticker)
+	require.Len(t, s.items, 1)
+	thunks, _, hasNext = s.popDue(now.Add(time.Hour))
+	assert.Len(t, thunks, 1)
+	assert.False(t, hasNext)
+}
+
+func TestTimerScheduler(t *testing.T) {
+	var fired []string
+	ch := make(chan func(), 10)
+	s := newTimerScheduler(ch)
+	defer s.stop()
+
+	s.add(70*time.Millisecond, 0, recordingThunk(&fired, "c"))
+	s.add(10*time.Millisecond, 0, recordingThunk(&fired, "a"))
+	removed := s.add(20*time.Millisecond, 0, recordingThunk(&fired, "removed"))
+	s.add(40*time.Millisecond, 0, recordingThunk(&fired, "b"))
+	s.remove(removed)
+
+	runThunks(t, ch, 3)
+	assert.Equal(t, []string{"a", "b", "c"}, fired)
+}
+
+func TestTimerSchedulerPeriodic(t *testing.T) {
+	var fired []string
+	ch := make(chan func(), 10)
+	s := newTimerScheduler(ch)
+	defer s.stop()
+
+	ticker := s.add(10*time.Millisecond, 10*time.Millisecond, recordingThunk(&fired, "tick"))
+	runThunks(t, ch, 3)
+	assert.Equal(t, []string{"tick", "tick", "tick"}, fired)
+
+	s.remove(ticker)
+	s.mutex.Lock()
+	assert.Empty(t, s.items)
+	s.mutex.Unlock()
+}
+
+func TestTimerSchedulerStop(t *testing.T) {
+	// nobody reads the channel, but the scheduler
+	// must stop anyway
+	s := newTimerScheduler(make(chan func()))
+	s.add(0, 0, func() {})
+	time.Sleep(10 * time.Millisecond)
+	s.stop()
+}
+
+const benchmarkTimerCount = 10000
+
+// benchmarkTimers starts 10k timers and waits till they fire
+// or stops them before they fire, e.g. when debouncing
+func benchmarkTimers(b *testing.B, timerFunc TimerFunc, stop bool) {
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		engine := &RuleEngine{
+			syncQueue: make(chan func(), SYNC_QUEUE_LEN),
+			timerFunc: timerFunc,
+			nowFunc:   time.Now,
+		}
+		entries := make([]*TimerEntry, benchmarkTimerCount)
+		for n := range entries {
+			entries[n] = &TimerEntry{interval: 10 * time.Millisecond, active: true}
+			entries[n].Lock()
+			engine.armTimer(TimerId(n+1), entries[n], entries[n].interval)
+			entries[n].Unlock()
+		}
+		if stop {
+			for _, entry := range entries {
+				entry.stop()
+			}
+		} else {
+			for range entries {
+				<-engine.syncQueue
+			}
+		}
+		engine.stopTimerScheduler()
+	}
+}
+
+func BenchmarkTimersFireGoroutines(b *testing.B) {
+	benchmarkTimers(b, newTimer, false)
+}
+
+func BenchmarkTimersFireScheduler(b *testing.B) {
+	benchmarkTimers(b, nil, false)
+}
+
+func BenchmarkTimersStopGoroutines(b *testing.B) {
+	benchmarkTimers(b, newTimer, true)
+}
+
+func BenchmarkTimersStopScheduler(b *testing.B) {
+	benchmarkTimers(b, nil, true)
+}
+
+// BenchmarkScheduler adds timers with different deadlines
+// to the heap and pops them when they're due
+func BenchmarkScheduler(b *testing.B) {
+	b.ReportAllocs()
+	s := &timerScheduler{items: make(timerHeap, 0), wakeCh: make(chan struct{}, 1)}
+	start := time.Now()
+	for i := 0; i < b.N; i++ {
+		s.add(time.Duration(i%benchmarkTimerCount)*time.Millisecond, 0, func() {})
+	}
+	thunks, _, hasNext := s.popDue(start.Add(time.Hour))
+	if len(thunks) != b.N || hasNext {
+		b.Fatalf("popped %d timers of %d", len(thunks), b.N)
+	}
+}